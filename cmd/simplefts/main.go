@@ -1,50 +1,65 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/calebpalmer/simpleftsservice/internal/config"
 	"github.com/calebpalmer/simpleftsservice/internal/handlers"
+	"github.com/calebpalmer/simpleftsservice/internal/logging"
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	recoverFlag := flag.Bool("recover", false, "repair a corrupt catalog from its backup and drop unreadable documents")
+	flag.Parse()
+
 	config, err := config.New("config.yaml")
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *recoverFlag {
+		config.Recover = true
+	}
+
+	logger, err := logging.New(config.LoggingConfig, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
 	router := mux.NewRouter()
 
-	if err := handlers.RegisterHandlers(router, config); err != nil {
+	shutdownTimeout, err := config.HttpConfig.ShutdownTimeout()
+	if err != nil {
+		log.Fatal(err)
+	}
+	closeTimeout, err := config.HttpConfig.CloseTimeout()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	indexManager, err := handlers.RegisterHandlers(router, config)
+	if err != nil {
 		log.Fatal(err)
 	}
 
 	err = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		pathTemplate, err := route.GetPathTemplate()
-		if err == nil {
-			fmt.Println("ROUTE:", pathTemplate)
-		}
-		pathRegexp, err := route.GetPathRegexp()
-		if err == nil {
-			fmt.Println("Path regexp:", pathRegexp)
-		}
-		queriesTemplates, err := route.GetQueriesTemplates()
-		if err == nil {
-			fmt.Println("Queries templates:", strings.Join(queriesTemplates, ","))
-		}
-		queriesRegexps, err := route.GetQueriesRegexp()
-		if err == nil {
-			fmt.Println("Queries regexps:", strings.Join(queriesRegexps, ","))
+		if err != nil {
+			return nil
 		}
-		methods, err := route.GetMethods()
-		if err == nil {
-			fmt.Println("Methods:", strings.Join(methods, ","))
-		}
-		fmt.Println()
+		methods, _ := route.GetMethods()
+		slog.Debug("route", "path", pathTemplate, "methods", strings.Join(methods, ","))
 		return nil
 	})
 
@@ -54,13 +69,50 @@ func main() {
 
 	addr := fmt.Sprintf(":%d", config.HttpConfig.Port)
 
-	fmt.Printf("Starting server on %s\n", addr)
 	httpServer := http.Server{
 		Addr:    addr,
 		Handler: router,
 	}
 
-	if err := httpServer.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	// stop on SIGINT or SIGTERM.  A second signal kills the service without
+	// waiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "addr", addr)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	// the indexes are saved whether the server stopped on a signal or failed
+	exitCode := 0
+	select {
+	case err := <-serveErr:
+		slog.Error("server failed", "error", err)
+		exitCode = 1
+	case <-ctx.Done():
+		stop()
+	}
+
+	// stop accepting connections and give in-flight requests time to finish,
+	// then give background tasks their own time to stop before saving the
+	// indexes
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("in-flight requests did not finish", "error", err)
+	}
+	cancelShutdown()
+
+	closeCtx, cancelClose := context.WithTimeout(context.Background(), closeTimeout)
+	if err := indexManager.Close(closeCtx); err != nil {
+		slog.Error("saving indexes", "error", err)
+		exitCode = 1
+	}
+	cancelClose()
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
+	slog.Info("stopped")
 }
@@ -1,10 +1,13 @@
 module github.com/calebpalmer/simpleftsservice
 
-go 1.13
+go 1.21
 
 require (
-	github.com/bradfitz/gomemcache v0.0.0-20220106215444-fb4bf637b56d // indirect
+	github.com/bradfitz/gomemcache v0.0.0-20220106215444-fb4bf637b56d
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/mux v1.8.0
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.0.0-20200923182605-d9f96fdee20d // indirect
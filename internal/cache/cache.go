@@ -1,48 +1,169 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
+	"unicode"
 
-	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/calebpalmer/simpleftsservice/internal/config"
 )
 
-type Cache struct {
-	ConnString                string
-	Client                    *memcache.Client
-	ItemExpirationTimeSeconds int32 `default:60`
-}
+const (
+	// DefaultKeyPrefix is the key prefix used when none is configured.
+	DefaultKeyPrefix = "fts"
+	// DefaultTTL is how long responses are cached when no TTL is configured.
+	DefaultTTL = time.Minute
+	// DefaultMaxItemBytes is the size of the largest response cached when no
+	// limit is configured.  It is memcached's default item size limit.
+	DefaultMaxItemBytes = 1 << 20
+
+	// maxKeyPrefixLength keeps keys within memcached's 250 byte limit.
+	maxKeyPrefixLength = 250 - 1 - 2*sha256.Size
+	// maxTTL is the longest expiration memcached takes as a relative time.
+	maxTTL = 30 * 24 * time.Hour
+)
+
+var ErrInvalidConfig = errors.New("invalid cache config")
 
-func NewCache(connString string) *Cache {
-	client := memcache.New(connString)
-	return &Cache{Client: client, ConnString: connString}
+// Cache stores encoded search responses by index, index generation, search
+// value and any other parameters that change the response.
+type Cache interface {
+	// Get returns a cached response, or nil when there isn't one.
+	Get(indexName string, generation string, searchValue string, extra string) ([]byte, error)
+
+	// Add caches a response.  Responses larger than the maximum item size
+	// are not cached.
+	Add(indexName string, generation string, searchValue string, extra string, results []byte) error
+
+	// Flush removes the cached responses of an index, or of every index when
+	// indexName is empty, from the caches able to find them.  Other caches
+	// rely on the flushed indexes moving to a new generation.
+	Flush(indexName string) error
 }
 
-func makeKey(indexName string, searchValue string, extra string) string {
-	return fmt.Sprintf("%s_%s_%s", indexName, searchValue, extra)
+// Options are the settings shared by the cache implementations.
+type Options struct {
+	// KeyPrefix is prepended to every key.
+	KeyPrefix string
+	// TTL is how long responses are cached.  Zero keeps them until evicted.
+	TTL time.Duration
+	// MaxItemBytes is the size of the largest response cached.
+	MaxItemBytes int
 }
 
-func (c *Cache) Get(indexName string, searchValue string, extra string) ([]byte, error) {
-	key := makeKey(indexName, searchValue, extra)
+// New returns the cache described by the cache config, counting its
+// operations in metrics.  An in-process LRU and memcached can each be used
+// alone or together, with the LRU in front of memcached.
+func New(config config.CacheConfig, metrics *Metrics) (Cache, error) {
+	options := Options{KeyPrefix: config.KeyPrefix, TTL: time.Duration(config.TTLSeconds) * time.Second, MaxItemBytes: config.MaxItemBytes}
+	if options.KeyPrefix == "" {
+		options.KeyPrefix = DefaultKeyPrefix
+	}
+	if options.TTL == 0 {
+		options.TTL = DefaultTTL
+	}
+	if options.MaxItemBytes == 0 {
+		options.MaxItemBytes = DefaultMaxItemBytes
+	}
+
+	if err := validateKeyPrefix(options.KeyPrefix); err != nil {
+		return nil, err
+	}
+	if options.TTL < 0 || options.TTL > maxTTL {
+		return nil, fmt.Errorf("%w: ttl-seconds must be between 1 and %d", ErrInvalidConfig, int(maxTTL.Seconds()))
+	}
+	if options.MaxItemBytes < 0 {
+		return nil, fmt.Errorf("%w: max-item-bytes must be positive", ErrInvalidConfig)
+	}
 
-	item, err := c.Client.Get(key)
-	if err != nil {
-		// this a normal event
-		if err == memcache.ErrCacheMiss {
-			return nil, nil
+	tiers := make([]Cache, 0, 2)
+	if config.Local != nil {
+		if config.Local.MaxBytes <= 0 {
+			return nil, fmt.Errorf("%w: local max-bytes must be positive", ErrInvalidConfig)
+		}
+		localOptions := options
+		if config.Local.TTLSeconds > 0 {
+			localOptions.TTL = time.Duration(config.Local.TTLSeconds) * time.Second
 		}
-		return []byte{}, err
+		lru := NewLRU(config.Local.MaxBytes, localOptions)
+		lru.OnEvict = metrics.recordEviction
+		tiers = append(tiers, lru)
+	}
+	if config.ConnString != "" {
+		tiers = append(tiers, NewMemcached(config.ConnString, options))
+	}
+
+	switch len(tiers) {
+	case 0:
+		return nil, fmt.Errorf("%w: needs a local cache or a connection-string", ErrInvalidConfig)
+	case 1:
+		return &instrumented{tiers[0], metrics}, nil
+	default:
+		return &instrumented{NewTiered(tiers...), metrics}, nil
+	}
+}
+
+// Peek returns a cached response like Get but without counting the lookup in
+// the metrics or copying it between tiers, for inspecting the cache.
+func Peek(c Cache, indexName string, generation string, searchValue string, extra string) ([]byte, error) {
+	if i, ok := c.(*instrumented); ok {
+		c = i.cache
 	}
+	if t, ok := c.(*Tiered); ok {
+		return t.get(indexName, generation, searchValue, extra, false)
+	}
+	return c.Get(indexName, generation, searchValue, extra)
+}
 
-	return item.Value, nil
+// instrumented counts the operations of a cache in metrics.
+type instrumented struct {
+	cache   Cache
+	metrics *Metrics
 }
 
-func (c *Cache) Add(indexName string, searchValue string, extra string, results []byte) error {
-	key := makeKey(indexName, searchValue, extra)
+func (c *instrumented) Get(indexName string, generation string, searchValue string, extra string) ([]byte, error) {
+	start := time.Now()
+	value, err := c.cache.Get(indexName, generation, searchValue, extra)
+	c.metrics.recordGet(indexName, value, err, time.Since(start))
+	return value, err
+}
 
-	err := c.Client.Set(&memcache.Item{Key: key, Value: results, Expiration: c.ItemExpirationTimeSeconds})
-	if err != nil {
-		return err
-	}
+func (c *instrumented) Add(indexName string, generation string, searchValue string, extra string, results []byte) error {
+	start := time.Now()
+	err := c.cache.Add(indexName, generation, searchValue, extra, results)
+	c.metrics.recordAdd(indexName, err, time.Since(start))
+	return err
+}
+
+func (c *instrumented) Flush(indexName string) error {
+	return c.cache.Flush(indexName)
+}
 
+// validateKeyPrefix checks that keys made with prefix are valid memcached
+// keys: short and without whitespace or control characters.
+func validateKeyPrefix(prefix string) error {
+	if len(prefix) > maxKeyPrefixLength {
+		return fmt.Errorf("%w: key-prefix is longer than %d bytes", ErrInvalidConfig, maxKeyPrefixLength)
+	}
+	if strings.IndexFunc(prefix, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("%w: key-prefix %q contains whitespace or control characters", ErrInvalidConfig, prefix)
+	}
 	return nil
 }
+
+// makeKey builds the key of a search result.  The parameters are hashed, so
+// any index name and search value make a key memcached accepts.  The
+// generation identifies the state of the index, so results cached before the
+// index changed are never found again and simply expire.
+func makeKey(prefix string, indexName string, generation string, searchValue string, extra string) string {
+	hash := sha256.New()
+	for _, param := range []string{indexName, generation, searchValue, extra} {
+		// the length keeps the boundaries between parameters unambiguous
+		fmt.Fprintf(hash, "%d:%s", len(param), param)
+	}
+	return prefix + ":" + hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+
+	"github.com/calebpalmer/simpleftsservice/internal/config"
+)
+
+func TestMakeKey(t *testing.T) {
+	type params struct{ prefix, index, generation, search, extra string }
+	tests := []struct {
+		name string
+		a, b params
+		same bool
+	}{
+		{"same parameters", params{"fts", "books", "1", "hobbit", ""}, params{"fts", "books", "1", "hobbit", ""}, true},
+		{"prefix", params{"fts", "books", "1", "hobbit", ""}, params{"svc", "books", "1", "hobbit", ""}, false},
+		{"index", params{"fts", "books", "1", "hobbit", ""}, params{"fts", "films", "1", "hobbit", ""}, false},
+		{"generation", params{"fts", "books", "1", "hobbit", ""}, params{"fts", "books", "2", "hobbit", ""}, false},
+		{"search", params{"fts", "books", "1", "hobbit", ""}, params{"fts", "books", "1", "ring", ""}, false},
+		{"extra", params{"fts", "books", "1", "hobbit", ""}, params{"fts", "books", "1", "hobbit", "wantDocuments"}, false},
+		{"parameter boundaries", params{"fts", "books", "1", "hobbit", "and"}, params{"fts", "books", "1", "hobbita", "nd"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := makeKey(test.a.prefix, test.a.index, test.a.generation, test.a.search, test.a.extra)
+			b := makeKey(test.b.prefix, test.b.index, test.b.generation, test.b.search, test.b.extra)
+			if (a == b) != test.same {
+				t.Errorf("keys %s and %s, want the same: %t", a, b, test.same)
+			}
+			if !strings.HasPrefix(a, test.a.prefix+":") {
+				t.Errorf("key %s doesn't start with its prefix", a)
+			}
+		})
+	}
+}
+
+func TestMakeKeyIsValidForMemcached(t *testing.T) {
+	prefix := strings.Repeat("p", maxKeyPrefixLength)
+	for _, search := range []string{"", "hobbit ring", "ünïcödé\t\n", strings.Repeat("long ", 10000)} {
+		key := makeKey(prefix, "books", "1", search, "")
+		if len(key) > 250 {
+			t.Errorf("key for %.20q is %d bytes", search, len(key))
+		}
+		if strings.IndexFunc(key, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+			t.Errorf("key for %.20q has whitespace or control characters", search)
+		}
+	}
+}
+
+func TestValidateKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		valid  bool
+	}{
+		{"fts", true},
+		{"my-service:v2", true},
+		{"ünïcödé", true},
+		{strings.Repeat("p", maxKeyPrefixLength), true},
+		{strings.Repeat("p", maxKeyPrefixLength+1), false},
+		{"with space", false},
+		{"tab\t", false},
+		{"newline\n", false},
+		{"nul\x00", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			err := validateKeyPrefix(test.prefix)
+			if (err == nil) != test.valid {
+				t.Errorf("validateKeyPrefix = %v, want valid: %t", err, test.valid)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("validateKeyPrefix = %v, want %v", err, ErrInvalidConfig)
+			}
+		})
+	}
+}
+
+func TestNewAppliesConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.CacheConfig
+		// local and shared are the options each tier should have, nil when
+		// the tier isn't used
+		local  *Options
+		shared *Options
+	}{
+		{
+			name:   "defaults",
+			config: config.CacheConfig{ConnString: "localhost:11211"},
+			shared: &Options{KeyPrefix: DefaultKeyPrefix, TTL: DefaultTTL, MaxItemBytes: DefaultMaxItemBytes},
+		},
+		{
+			name:   "memcached",
+			config: config.CacheConfig{ConnString: "localhost:11211", KeyPrefix: "svc", TTLSeconds: 90, MaxItemBytes: 4096},
+			shared: &Options{KeyPrefix: "svc", TTL: 90 * time.Second, MaxItemBytes: 4096},
+		},
+		{
+			name:   "local",
+			config: config.CacheConfig{KeyPrefix: "svc", TTLSeconds: 90, MaxItemBytes: 4096, Local: &config.LocalCacheConfig{MaxBytes: 1 << 20}},
+			local:  &Options{KeyPrefix: "svc", TTL: 90 * time.Second, MaxItemBytes: 4096},
+		},
+		{
+			name: "both with a local ttl",
+			config: config.CacheConfig{ConnString: "localhost:11211", KeyPrefix: "svc", TTLSeconds: 90, MaxItemBytes: 4096,
+				Local: &config.LocalCacheConfig{MaxBytes: 1 << 20, TTLSeconds: 5}},
+			local:  &Options{KeyPrefix: "svc", TTL: 5 * time.Second, MaxItemBytes: 4096},
+			shared: &Options{KeyPrefix: "svc", TTL: 90 * time.Second, MaxItemBytes: 4096},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := New(test.config, NewMetrics())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var tiers []Cache
+			switch inner := c.(*instrumented).cache.(type) {
+			case *Tiered:
+				tiers = inner.tiers
+			default:
+				tiers = []Cache{inner}
+			}
+
+			var local, shared *Options
+			for _, tier := range tiers {
+				switch tier := tier.(type) {
+				case *LRU:
+					if len(tiers) > 1 && tier != tiers[0] {
+						t.Error("the local cache isn't in front")
+					}
+					if tier.maxBytes != test.config.Local.MaxBytes {
+						t.Errorf("local max bytes = %d, want %d", tier.maxBytes, test.config.Local.MaxBytes)
+					}
+					local = &tier.options
+				case *Memcached:
+					shared = &Options{
+						KeyPrefix:    tier.KeyPrefix,
+						TTL:          time.Duration(tier.ItemExpirationTimeSeconds) * time.Second,
+						MaxItemBytes: tier.MaxItemBytes,
+					}
+				}
+			}
+
+			for _, tier := range []struct {
+				name      string
+				got, want *Options
+			}{{"local", local, test.local}, {"memcached", shared, test.shared}} {
+				if (tier.got == nil) != (tier.want == nil) {
+					t.Errorf("%s cache used: %t, want %t", tier.name, tier.got != nil, tier.want != nil)
+				} else if tier.got != nil && *tier.got != *tier.want {
+					t.Errorf("%s cache options = %+v, want %+v", tier.name, *tier.got, *tier.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.CacheConfig
+	}{
+		{"no cache", config.CacheConfig{}},
+		{"negative ttl", config.CacheConfig{ConnString: "localhost:11211", TTLSeconds: -1}},
+		{"ttl memcached takes as a timestamp", config.CacheConfig{ConnString: "localhost:11211", TTLSeconds: int(maxTTL.Seconds()) + 1}},
+		{"negative item size", config.CacheConfig{ConnString: "localhost:11211", MaxItemBytes: -1}},
+		{"invalid prefix", config.CacheConfig{ConnString: "localhost:11211", KeyPrefix: "my service"}},
+		{"local cache without a size", config.CacheConfig{Local: &config.LocalCacheConfig{}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := New(test.config, NewMetrics()); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("New = %v, want %v", err, ErrInvalidConfig)
+			}
+		})
+	}
+}
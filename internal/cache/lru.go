@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruEntryOverhead approximates the memory used by an entry besides its key
+// and value: the list element, the map entry and the entry itself.
+const lruEntryOverhead = 128
+
+// LRU caches responses in process, evicting the least recently used ones once
+// their total size exceeds a limit.
+type LRU struct {
+	mu       sync.Mutex
+	maxBytes int64
+	options  Options
+	size     int64
+	items    map[string]*list.Element
+	order    *list.List // most recently used first
+
+	// OnEvict, when set, is called with the index of each response evicted
+	// to make room for another.  It is called with the lock held.
+	OnEvict func(indexName string)
+}
+
+// lruEntry is a cached response.
+type lruEntry struct {
+	index   string
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU returns an empty LRU holding at most maxBytes of responses.
+func NewLRU(maxBytes int64, options Options) *LRU {
+	return &LRU{maxBytes: maxBytes, options: options, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *LRU) Get(indexName string, generation string, searchValue string, extra string) ([]byte, error) {
+	key := makeKey(c.options.KeyPrefix, indexName, generation, searchValue, extra)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := element.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil, nil
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, nil
+}
+
+func (c *LRU) Add(indexName string, generation string, searchValue string, extra string, results []byte) error {
+	if len(results) > c.options.MaxItemBytes {
+		return nil
+	}
+
+	key := makeKey(c.options.KeyPrefix, indexName, generation, searchValue, extra)
+	entry := &lruEntry{index: indexName, key: key, value: results}
+	if c.options.TTL > 0 {
+		entry.expires = time.Now().Add(c.options.TTL)
+	}
+
+	// a response bigger than the whole cache would only evict everything else
+	if entrySize(entry) > c.maxBytes {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+	c.items[key] = c.order.PushFront(entry)
+	c.size += entrySize(entry)
+
+	for c.size > c.maxBytes {
+		evicted := c.remove(c.order.Back())
+		if c.OnEvict != nil {
+			c.OnEvict(evicted.index)
+		}
+	}
+	return nil
+}
+
+func (c *LRU) Flush(indexName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if indexName == "" {
+		c.items = make(map[string]*list.Element)
+		c.order.Init()
+		c.size = 0
+		return nil
+	}
+
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*lruEntry).index == indexName {
+			c.remove(element)
+		}
+		element = next
+	}
+	return nil
+}
+
+// remove removes an entry and returns it.  The caller must hold the lock.
+func (c *LRU) remove(element *list.Element) *lruEntry {
+	entry := c.order.Remove(element).(*lruEntry)
+	delete(c.items, entry.key)
+	c.size -= entrySize(entry)
+	return entry
+}
+
+// entrySize returns the number of bytes an entry counts against the limit.
+func entrySize(entry *lruEntry) int64 {
+	return int64(len(entry.key) + len(entry.value) + lruEntryOverhead)
+}
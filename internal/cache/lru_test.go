@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testEntrySize is the size an entry for a 100 byte response counts against
+// the limit of an LRU using the default key prefix.
+var testEntrySize = entrySize(&lruEntry{key: makeKey(DefaultKeyPrefix, "", "", "", ""), value: make([]byte, 100)})
+
+// newTestLRU returns an LRU with room for entries responses of 100 bytes and
+// the indexes of the responses it evicts.
+func newTestLRU(entries int, ttl time.Duration) (*LRU, *[]string) {
+	lru := NewLRU(int64(entries)*testEntrySize, Options{KeyPrefix: DefaultKeyPrefix, TTL: ttl, MaxItemBytes: DefaultMaxItemBytes})
+	evicted := make([]string, 0)
+	lru.OnEvict = func(indexName string) { evicted = append(evicted, indexName) }
+	return lru, &evicted
+}
+
+// response returns the 100 byte response cached for a search of books.
+func response(search string) []byte {
+	return bytes.Repeat([]byte(search), 100/len(search))
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	tests := []struct {
+		name string
+		// ops are "add" or "get" followed by the search
+		ops     []string
+		cached  []string
+		evicted []string
+	}{
+		{"within the limit", []string{"add a", "add b", "add c"}, []string{"a", "b", "c"}, []string{}},
+		{"oldest evicted", []string{"add a", "add b", "add c", "add d"}, []string{"b", "c", "d"}, []string{"books"}},
+		{"read keeps an entry", []string{"add a", "add b", "add c", "get a", "add d"}, []string{"a", "c", "d"}, []string{"books"}},
+		{"replacing keeps an entry", []string{"add a", "add b", "add c", "add a", "add d", "add e"}, []string{"a", "d", "e"}, []string{"books", "books"}},
+		{"misses don't count", []string{"add a", "add b", "add c", "get x", "add d"}, []string{"b", "c", "d"}, []string{"books"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lru, evicted := newTestLRU(3, 0)
+			for _, op := range test.ops {
+				var name, search string
+				fmt.Sscan(op, &name, &search)
+				if name == "add" {
+					if err := lru.Add("books", "1", search, "", response(search)); err != nil {
+						t.Fatal(err)
+					}
+				} else if _, err := lru.Get("books", "1", search, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cached := make([]string, 0)
+			for _, search := range []string{"a", "b", "c", "d", "e", "x"} {
+				if value, _ := lru.Get("books", "1", search, ""); value != nil {
+					cached = append(cached, search)
+					if !bytes.Equal(value, response(search)) {
+						t.Errorf("%s has the wrong response", search)
+					}
+				}
+			}
+			if !reflect.DeepEqual(cached, test.cached) {
+				t.Errorf("cached %v, want %v", cached, test.cached)
+			}
+			if !reflect.DeepEqual(*evicted, test.evicted) {
+				t.Errorf("evicted %v, want %v", *evicted, test.evicted)
+			}
+			if lru.size > lru.maxBytes || lru.size != int64(len(cached))*testEntrySize {
+				t.Errorf("size = %d, want %d within %d", lru.size, int64(len(cached))*testEntrySize, lru.maxBytes)
+			}
+		})
+	}
+}
+
+func TestLRUExpiresEntries(t *testing.T) {
+	lru, _ := newTestLRU(3, 20*time.Millisecond)
+	if err := lru.Add("books", "1", "a", "", response("a")); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := lru.Get("books", "1", "a", ""); value == nil {
+		t.Fatal("missed before the ttl")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if value, _ := lru.Get("books", "1", "a", ""); value != nil {
+		t.Error("hit after the ttl")
+	}
+	if lru.size != 0 || len(lru.items) != 0 {
+		t.Errorf("expired entry still counts %d bytes", lru.size)
+	}
+
+	// without a ttl entries are kept until evicted
+	lru, _ = newTestLRU(3, 0)
+	lru.Add("books", "1", "a", "", response("a"))
+	time.Sleep(30 * time.Millisecond)
+	if value, _ := lru.Get("books", "1", "a", ""); value == nil {
+		t.Error("entry without a ttl expired")
+	}
+}
+
+func TestLRURejectsOversizedResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxItemBytes int
+		response     []byte
+	}{
+		{"over the item limit", 99, response("a")},
+		{"over the cache limit", DefaultMaxItemBytes, make([]byte, 3*testEntrySize)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lru, evicted := newTestLRU(3, 0)
+			lru.options.MaxItemBytes = test.maxItemBytes
+			lru.Add("books", "1", "a", "", []byte("a"))
+
+			if err := lru.Add("books", "1", "b", "", test.response); err != nil {
+				t.Fatal(err)
+			}
+			if value, _ := lru.Get("books", "1", "b", ""); value != nil {
+				t.Error("oversized response was cached")
+			}
+			if value, _ := lru.Get("books", "1", "a", ""); value == nil || len(*evicted) != 0 {
+				t.Error("oversized response evicted others")
+			}
+		})
+	}
+}
+
+func TestLRUFlush(t *testing.T) {
+	lru, evicted := newTestLRU(3, 0)
+	lru.Add("books", "1", "a", "", response("a"))
+	lru.Add("films", "1", "a", "", response("a"))
+
+	if err := lru.Flush("books"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := lru.Get("books", "1", "a", ""); value != nil {
+		t.Error("flushed index still cached")
+	}
+	if value, _ := lru.Get("films", "1", "a", ""); value == nil {
+		t.Error("other index flushed")
+	}
+
+	if err := lru.Flush(""); err != nil {
+		t.Fatal(err)
+	}
+	if lru.size != 0 || len(lru.items) != 0 || len(*evicted) != 0 {
+		t.Errorf("flushing everything left %d bytes", lru.size)
+	}
+}
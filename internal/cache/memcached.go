@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// MemcacheClient is the part of the memcached client the cache uses.
+type MemcacheClient interface {
+	Get(key string) (*memcache.Item, error)
+	Set(item *memcache.Item) error
+}
+
+// Memcached caches responses in memcached so they are shared by every
+// instance of the service.
+type Memcached struct {
+	ConnString                string
+	Client                    MemcacheClient
+	KeyPrefix                 string
+	ItemExpirationTimeSeconds int32
+	MaxItemBytes              int
+}
+
+// NewMemcached returns a cache using the memcached servers in connString.
+func NewMemcached(connString string, options Options) *Memcached {
+	client := memcache.New(connString)
+	return &Memcached{
+		ConnString:                connString,
+		Client:                    client,
+		KeyPrefix:                 options.KeyPrefix,
+		ItemExpirationTimeSeconds: int32(options.TTL.Seconds()),
+		MaxItemBytes:              options.MaxItemBytes,
+	}
+}
+
+func (c *Memcached) Get(indexName string, generation string, searchValue string, extra string) ([]byte, error) {
+	key := makeKey(c.KeyPrefix, indexName, generation, searchValue, extra)
+
+	item, err := c.Client.Get(key)
+	if err != nil {
+		// this a normal event
+		if err == memcache.ErrCacheMiss {
+			return nil, nil
+		}
+		return []byte{}, err
+	}
+
+	return item.Value, nil
+}
+
+func (c *Memcached) Add(indexName string, generation string, searchValue string, extra string, results []byte) error {
+	// memcached would refuse it
+	if len(results) > c.MaxItemBytes {
+		return nil
+	}
+
+	key := makeKey(c.KeyPrefix, indexName, generation, searchValue, extra)
+
+	err := c.Client.Set(&memcache.Item{Key: key, Value: results, Expiration: c.ItemExpirationTimeSeconds})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Flush does nothing: keys are hashed so an index's responses can't be found,
+// and flushing the whole server would drop the keys of other services sharing
+// it.  Flushed responses are left to expire.
+func (c *Memcached) Flush(indexName string) error {
+	return nil
+}
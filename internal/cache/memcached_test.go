@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var errUnavailable = errors.New("memcached unavailable")
+
+// fakeMemcacheClient is an in-memory memcached whose operations fail while
+// err is set.
+type fakeMemcacheClient struct {
+	items map[string]*memcache.Item
+	gets  int
+	err   error
+}
+
+func newFakeMemcached(options Options) (*Memcached, *fakeMemcacheClient) {
+	client := &fakeMemcacheClient{items: make(map[string]*memcache.Item)}
+	cache := NewMemcached("localhost:11211", options)
+	cache.Client = client
+	return cache, client
+}
+
+func (c *fakeMemcacheClient) Get(key string) (*memcache.Item, error) {
+	c.gets++
+	if c.err != nil {
+		return nil, c.err
+	}
+	item, ok := c.items[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	return item, nil
+}
+
+func (c *fakeMemcacheClient) Set(item *memcache.Item) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.items[item.Key] = item
+	return nil
+}
+
+func TestMemcached(t *testing.T) {
+	cache, client := newFakeMemcached(Options{KeyPrefix: "svc", TTL: 90 * time.Second, MaxItemBytes: 100})
+
+	if value, err := cache.Get("books", "1", "a", ""); value != nil || err != nil {
+		t.Errorf("Get of a missing response = %q, %v, want a miss", value, err)
+	}
+
+	if err := cache.Add("books", "1", "a", "", response("a")); err != nil {
+		t.Fatal(err)
+	}
+	key := makeKey("svc", "books", "1", "a", "")
+	item, ok := client.items[key]
+	if !ok {
+		t.Fatalf("response not set under %s", key)
+	}
+	if item.Expiration != 90 {
+		t.Errorf("expiration = %d, want 90", item.Expiration)
+	}
+	if value, err := cache.Get("books", "1", "a", ""); string(value) != string(response("a")) || err != nil {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+
+	// memcached would refuse responses over its item size
+	if err := cache.Add("books", "1", "b", "", make([]byte, 101)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.items) != 1 {
+		t.Error("oversized response was set")
+	}
+
+	client.err = errUnavailable
+	if _, err := cache.Get("books", "1", "a", ""); !errors.Is(err, errUnavailable) {
+		t.Errorf("Get = %v, want %v", err, errUnavailable)
+	}
+	if err := cache.Add("books", "1", "c", "", response("c")); !errors.Is(err, errUnavailable) {
+		t.Errorf("Add = %v, want %v", err, errUnavailable)
+	}
+}
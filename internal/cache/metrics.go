@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts the cache operations of each index since the process
+// started.
+type Metrics struct {
+	mu      sync.Mutex
+	indexes map[string]*indexMetrics
+}
+
+// indexMetrics are the counters of an index.
+type indexMetrics struct {
+	hits      atomic.Int64
+	misses    atomic.Int64
+	errors    atomic.Int64
+	evictions atomic.Int64
+	gets      atomic.Int64
+	adds      atomic.Int64
+	getNanos  atomic.Int64
+	addNanos  atomic.Int64
+}
+
+// IndexMetrics describe how the cache served an index.  Errors count failed
+// lookups and additions.  Evictions count responses the in-process cache
+// dropped to make room for others.
+type IndexMetrics struct {
+	Hits            int64   `json:"hits"`
+	Misses          int64   `json:"misses"`
+	Errors          int64   `json:"errors"`
+	Evictions       int64   `json:"evictions"`
+	Adds            int64   `json:"adds"`
+	HitRatio        float64 `json:"hitRatio"`
+	GetSeconds      float64 `json:"getSeconds"`
+	AddSeconds      float64 `json:"addSeconds"`
+	AvgGetLatencyMs float64 `json:"avgGetLatencyMs"`
+	AvgAddLatencyMs float64 `json:"avgAddLatencyMs"`
+}
+
+// NewMetrics returns metrics with nothing counted.
+func NewMetrics() *Metrics {
+	return &Metrics{indexes: make(map[string]*indexMetrics)}
+}
+
+// index returns the counters of an index, creating them if needed.
+func (m *Metrics) index(indexName string) *indexMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counters, ok := m.indexes[indexName]
+	if !ok {
+		counters = &indexMetrics{}
+		m.indexes[indexName] = counters
+	}
+	return counters
+}
+
+// recordGet counts a lookup.
+func (m *Metrics) recordGet(indexName string, value []byte, err error, elapsed time.Duration) {
+	counters := m.index(indexName)
+	switch {
+	case err != nil:
+		counters.errors.Add(1)
+	case value != nil:
+		counters.hits.Add(1)
+	default:
+		counters.misses.Add(1)
+	}
+	counters.gets.Add(1)
+	counters.getNanos.Add(int64(elapsed))
+}
+
+// recordAdd counts an addition.
+func (m *Metrics) recordAdd(indexName string, err error, elapsed time.Duration) {
+	counters := m.index(indexName)
+	if err != nil {
+		counters.errors.Add(1)
+	}
+	counters.adds.Add(1)
+	counters.addNanos.Add(int64(elapsed))
+}
+
+// recordEviction counts a response evicted from the in-process cache.
+func (m *Metrics) recordEviction(indexName string) {
+	m.index(indexName).evictions.Add(1)
+}
+
+// Index returns the metrics of an index.
+func (m *Metrics) Index(indexName string) IndexMetrics {
+	return m.index(indexName).snapshot()
+}
+
+// Indexes returns the metrics of every index the cache has served.
+func (m *Metrics) Indexes() map[string]IndexMetrics {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.indexes))
+	for name := range m.indexes {
+		names = append(names, name)
+	}
+	m.mu.Unlock()
+
+	sort.Strings(names)
+	metrics := make(map[string]IndexMetrics, len(names))
+	for _, name := range names {
+		metrics[name] = m.Index(name)
+	}
+	return metrics
+}
+
+// Total returns the metrics of every index combined.
+func (m *Metrics) Total() IndexMetrics {
+	var total indexMetrics
+	m.mu.Lock()
+	for _, counters := range m.indexes {
+		total.hits.Add(counters.hits.Load())
+		total.misses.Add(counters.misses.Load())
+		total.errors.Add(counters.errors.Load())
+		total.evictions.Add(counters.evictions.Load())
+		total.gets.Add(counters.gets.Load())
+		total.adds.Add(counters.adds.Load())
+		total.getNanos.Add(counters.getNanos.Load())
+		total.addNanos.Add(counters.addNanos.Load())
+	}
+	m.mu.Unlock()
+
+	return total.snapshot()
+}
+
+// Forget drops the metrics of a deleted index.
+func (m *Metrics) Forget(indexName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.indexes, indexName)
+}
+
+// snapshot reads the counters.
+func (c *indexMetrics) snapshot() IndexMetrics {
+	metrics := IndexMetrics{
+		Hits:       c.hits.Load(),
+		Misses:     c.misses.Load(),
+		Errors:     c.errors.Load(),
+		Evictions:  c.evictions.Load(),
+		Adds:       c.adds.Load(),
+		GetSeconds: time.Duration(c.getNanos.Load()).Seconds(),
+		AddSeconds: time.Duration(c.addNanos.Load()).Seconds(),
+	}
+
+	if lookups := metrics.Hits + metrics.Misses; lookups > 0 {
+		metrics.HitRatio = float64(metrics.Hits) / float64(lookups)
+	}
+	if gets := c.gets.Load(); gets > 0 {
+		metrics.AvgGetLatencyMs = metrics.GetSeconds * 1000 / float64(gets)
+	}
+	if metrics.Adds > 0 {
+		metrics.AvgAddLatencyMs = metrics.AddSeconds * 1000 / float64(metrics.Adds)
+	}
+	return metrics
+}
@@ -0,0 +1,66 @@
+package cache
+
+// Tiered layers caches, typically a small in-process cache in front of a
+// shared one.  Lookups try each tier in order and a hit is copied into the
+// tiers in front of the one it was found in.  Responses are added to every
+// tier.
+type Tiered struct {
+	tiers []Cache
+}
+
+// NewTiered returns a cache trying tiers in order.
+func NewTiered(tiers ...Cache) *Tiered {
+	return &Tiered{tiers: tiers}
+}
+
+func (c *Tiered) Get(indexName string, generation string, searchValue string, extra string) ([]byte, error) {
+	return c.get(indexName, generation, searchValue, extra, true)
+}
+
+// get looks a response up in each tier, copying a hit into the tiers in front
+// of the one it was found in when backfill is true.
+func (c *Tiered) get(indexName string, generation string, searchValue string, extra string, backfill bool) ([]byte, error) {
+	var firstErr error
+	for j, tier := range c.tiers {
+		value, err := tier.Get(indexName, generation, searchValue, extra)
+		if err != nil {
+			// a failing tier is skipped so the others can still serve
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if value == nil {
+			continue
+		}
+
+		if backfill {
+			for _, front := range c.tiers[:j] {
+				front.Add(indexName, generation, searchValue, extra, value)
+			}
+		}
+		return value, nil
+	}
+
+	return nil, firstErr
+}
+
+func (c *Tiered) Add(indexName string, generation string, searchValue string, extra string, results []byte) error {
+	var firstErr error
+	for _, tier := range c.tiers {
+		if err := tier.Add(indexName, generation, searchValue, extra, results); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *Tiered) Flush(indexName string) error {
+	var firstErr error
+	for _, tier := range c.tiers {
+		if err := tier.Flush(indexName); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
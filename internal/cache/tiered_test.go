@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTieredReadThrough(t *testing.T) {
+	tests := []struct {
+		name string
+		// local and shared are the tiers holding the response
+		local, shared bool
+		sharedErr     error
+		wantHit       bool
+		wantErr       error
+		wantBackfill  bool
+	}{
+		{name: "local hit", local: true, shared: true, wantHit: true},
+		{name: "shared hit", shared: true, wantHit: true, wantBackfill: true},
+		{name: "miss everywhere"},
+		{name: "local hit while memcached fails", local: true, sharedErr: errUnavailable, wantHit: true},
+		{name: "miss while memcached fails", sharedErr: errUnavailable, wantErr: errUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lru, _ := newTestLRU(3, 0)
+			shared, client := newFakeMemcached(Options{KeyPrefix: DefaultKeyPrefix, MaxItemBytes: DefaultMaxItemBytes})
+			if test.local {
+				lru.Add("books", "1", "a", "", response("a"))
+			}
+			if test.shared {
+				shared.Add("books", "1", "a", "", response("a"))
+			}
+			client.err = test.sharedErr
+			tiered := NewTiered(lru, shared)
+
+			value, err := tiered.Get("books", "1", "a", "")
+			if (value != nil) != test.wantHit || (test.wantHit && string(value) != string(response("a"))) {
+				t.Errorf("Get = %q, want a hit: %t", value, test.wantHit)
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Get error = %v, want %v", err, test.wantErr)
+			}
+			if test.local && client.gets != 0 {
+				t.Error("memcached was asked for a response the local cache had")
+			}
+
+			// a hit in memcached is copied to the local cache
+			if cached, _ := lru.Get("books", "1", "a", ""); (cached != nil) != (test.local || test.wantBackfill) {
+				t.Errorf("local cache has the response: %t, want %t", cached != nil, test.local || test.wantBackfill)
+			}
+		})
+	}
+}
+
+func TestTieredPeekDoesNotBackfill(t *testing.T) {
+	lru, _ := newTestLRU(3, 0)
+	shared, _ := newFakeMemcached(Options{KeyPrefix: DefaultKeyPrefix, MaxItemBytes: DefaultMaxItemBytes})
+	shared.Add("books", "1", "a", "", response("a"))
+	c := &instrumented{NewTiered(lru, shared), NewMetrics()}
+
+	if value, err := Peek(c, "books", "1", "a", ""); value == nil || err != nil {
+		t.Fatalf("Peek = %q, %v", value, err)
+	}
+	if cached, _ := lru.Get("books", "1", "a", ""); cached != nil {
+		t.Error("Peek copied the response to the local cache")
+	}
+}
+
+func TestTieredAddsToEveryTier(t *testing.T) {
+	lru, _ := newTestLRU(3, 0)
+	shared, client := newFakeMemcached(Options{KeyPrefix: DefaultKeyPrefix, MaxItemBytes: DefaultMaxItemBytes})
+	tiered := NewTiered(lru, shared)
+
+	if err := tiered.Add("books", "1", "a", "", response("a")); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.items) != 1 {
+		t.Error("response not added to memcached")
+	}
+
+	// a failing tier doesn't stop the others caching the response
+	client.err = errUnavailable
+	if err := tiered.Add("books", "1", "b", "", response("b")); !errors.Is(err, errUnavailable) {
+		t.Errorf("Add = %v, want %v", err, errUnavailable)
+	}
+	if cached, _ := lru.Get("books", "1", "b", ""); cached == nil {
+		t.Error("response not added to the local cache while memcached fails")
+	}
+}
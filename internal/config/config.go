@@ -3,21 +3,128 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type HttpConfig struct {
 	Port int `yaml:"port"`
+	// ShutdownTimeoutSeconds is how long in-flight requests are given to
+	// finish when the service is stopped, 30 seconds by default.
+	ShutdownTimeoutSeconds int `yaml:"shutdown-timeout-seconds,omitempty"`
+	// CloseTimeoutSeconds is how long background tasks are then given to
+	// stop before the indexes are saved, 30 seconds by default.
+	CloseTimeoutSeconds int `yaml:"close-timeout-seconds,omitempty"`
 }
 
+// DefaultShutdownTimeout is how long in-flight requests are given to finish
+// when no shutdown timeout is configured.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// DefaultCloseTimeout is how long background tasks are given to stop when no
+// close timeout is configured.
+const DefaultCloseTimeout = 30 * time.Second
+
+// ShutdownTimeout returns how long in-flight requests are given to finish
+// when the service is stopped.
+func (c HttpConfig) ShutdownTimeout() (time.Duration, error) {
+	if c.ShutdownTimeoutSeconds < 0 {
+		return 0, fmt.Errorf("invalid shutdown-timeout-seconds %d: must not be negative", c.ShutdownTimeoutSeconds)
+	}
+	if c.ShutdownTimeoutSeconds == 0 {
+		return DefaultShutdownTimeout, nil
+	}
+	return time.Duration(c.ShutdownTimeoutSeconds) * time.Second, nil
+}
+
+// CloseTimeout returns how long background tasks are given to stop once the
+// in-flight requests have finished.
+func (c HttpConfig) CloseTimeout() (time.Duration, error) {
+	if c.CloseTimeoutSeconds < 0 {
+		return 0, fmt.Errorf("invalid close-timeout-seconds %d: must not be negative", c.CloseTimeoutSeconds)
+	}
+	if c.CloseTimeoutSeconds == 0 {
+		return DefaultCloseTimeout, nil
+	}
+	return time.Duration(c.CloseTimeoutSeconds) * time.Second, nil
+}
+
+// CacheConfig configures the search response cache.  An in-process LRU,
+// memcached or both can be used; with both the LRU is checked first.
 type CacheConfig struct {
-	ConnString string `yaml:"connection-string"`
+	// ConnString is the address of the memcached servers.
+	ConnString string `yaml:"connection-string,omitempty"`
+	// KeyPrefix is prepended to every key so services sharing memcached
+	// don't collide.  It defaults to fts.
+	KeyPrefix string `yaml:"key-prefix,omitempty"`
+	// TTLSeconds is how long responses are cached, 60 seconds by default.
+	TTLSeconds int `yaml:"ttl-seconds,omitempty"`
+	// MaxItemBytes is the size of the largest response cached, 1MiB by
+	// default.
+	MaxItemBytes int `yaml:"max-item-bytes,omitempty"`
+	// Local enables an in-process LRU cache.
+	Local *LocalCacheConfig `yaml:"local,omitempty"`
+}
+
+// LocalCacheConfig configures the in-process LRU cache.
+type LocalCacheConfig struct {
+	// MaxBytes is the most memory the cached responses may use.
+	MaxBytes int64 `yaml:"max-bytes"`
+	// TTLSeconds overrides the cache's TTLSeconds for the local cache.
+	TTLSeconds int `yaml:"ttl-seconds,omitempty"`
+}
+
+// StorageConfig is where and how the catalog and indexes are persisted.
+type StorageConfig struct {
+	// Backend is where the catalog and the indexes are kept: dir, as files in
+	// DataDir, bolt, in a bbolt database in DataDir, or memory, which keeps
+	// nothing across restarts.  It defaults to dir.
+	Backend string `yaml:"backend,omitempty"`
+	// DataDir is the directory holding the catalog and the indexes.  It
+	// defaults to the working directory.
+	DataDir string `yaml:"data-dir,omitempty"`
+	// Catalog is the path of the catalog relative to DataDir.
+	Catalog string `yaml:"catalog,omitempty"`
+	// Fsync is when writes are flushed to disk, always or never.
+	Fsync string `yaml:"fsync,omitempty"`
+	// FileMode is the octal permission of the files written, 0644 by default.
+	FileMode string `yaml:"file-mode,omitempty"`
+	// SnapshotDir is the directory snapshots are written to and restored
+	// from.  It defaults to the snapshots directory in DataDir.
+	SnapshotDir string `yaml:"snapshot-dir,omitempty"`
+}
+
+// Perm parses FileMode.  Zero means the default.
+func (c StorageConfig) Perm() (os.FileMode, error) {
+	if c.FileMode == "" {
+		return 0, nil
+	}
+
+	perm, err := strconv.ParseUint(c.FileMode, 8, 32)
+	if err != nil || perm == 0 || perm > 0777 {
+		return 0, fmt.Errorf("invalid file-mode %q: must be an octal permission such as 0644", c.FileMode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// LoggingConfig is how the service logs.
+type LoggingConfig struct {
+	// Format is text, as logfmt, or json.  It defaults to text.
+	Format string `yaml:"format,omitempty"`
+	// Level is debug, info, warn or error.  It defaults to info.
+	Level string `yaml:"level,omitempty"`
 }
 
 type Config struct {
-	HttpConfig  HttpConfig   `yaml:"http"`
-	CacheConfig *CacheConfig `yaml:"cache,omitempty"`
+	HttpConfig    HttpConfig    `yaml:"http"`
+	CacheConfig   *CacheConfig  `yaml:"cache,omitempty"`
+	StorageConfig StorageConfig `yaml:"storage,omitempty"`
+	LoggingConfig LoggingConfig `yaml:"logging,omitempty"`
+	// Recover starts the service in recovery mode, repairing a corrupt catalog
+	// from its backup and dropping unreadable documents.
+	Recover bool `yaml:"recover,omitempty"`
 }
 
 func New(configPath string) (Config, error) {
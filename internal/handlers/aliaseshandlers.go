@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+// AliasesHandler represents the handler for index aliases.
+type AliasesHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the aliases entities.
+func (h *AliasesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getAliasesHandler(w, req)
+	case http.MethodPost:
+		h.postAliasesHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getAliasesHandler returns the alias to index mapping.
+func (h *AliasesHandler) getAliasesHandler(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, map[string]map[string]string{"aliases": h.IndexManager.GetAliases()})
+}
+
+// postAliasesHandler atomically applies a list of add and remove actions.
+func (h *AliasesHandler) postAliasesHandler(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Actions []fts.AliasAction `json:"actions"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeInvalidJson(w, req, err)
+		return
+	}
+
+	if len(body.Actions) == 0 {
+		writeJsonError(w, http.StatusBadRequest, CodeInvalidRequest, "\"actions\" property is required.",
+			FieldError{Field: "actions", Message: "is required"})
+		return
+	}
+
+	err := h.IndexManager.UpdateAliases(body.Actions)
+	switch {
+	case errors.Is(err, fts.ErrIndexNotFound), errors.Is(err, fts.ErrAliasNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, fts.ErrAliasConflict):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, fts.ErrInvalidAlias):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		h.getAliasesHandler(w, req)
+	}
+}
+
+// RegisterAliasesHandlers registers the alias handlers.
+func RegisterAliasesHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
+	router.Handle("/_aliases", &AliasesHandler{indexManager}).Methods("GET", "POST")
+	return nil
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+// AnalyzeHandler represents the handler for running text through an index's analysis.
+type AnalyzeHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the analyze entity.
+func (h *AnalyzeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		h.postAnalyzeHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// postAnalyzeHandler returns the tokens produced for the text in the body.  An
+// analysis in the body is used instead of the index's to try out new settings.
+func (h *AnalyzeHandler) postAnalyzeHandler(w http.ResponseWriter, req *http.Request) {
+	index, ok := h.IndexManager.GetIndex(mux.Vars(req)["indexId"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+		return
+	}
+
+	var body struct {
+		Text     string        `json:"text"`
+		Analysis *fts.Analysis `json:"analysis,omitempty"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeInvalidJson(w, req, err)
+		return
+	}
+
+	if err := body.Analysis.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJson(w, http.StatusOK, map[string][]fts.Token{"tokens": index.Analyze(body.Text, body.Analysis)})
+}
+
+// TermVectorsHandler represents the handler for the terms of a stored document.
+type TermVectorsHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the term vectors entity.
+func (h *TermVectorsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getTermVectorsHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getTermVectorsHandler returns the terms a document produced for each search property.
+func (h *TermVectorsHandler) getTermVectorsHandler(w http.ResponseWriter, req *http.Request) {
+	index, ok := h.IndexManager.GetIndex(mux.Vars(req)["indexId"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+		return
+	}
+
+	vectors, err := index.TermVectors(mux.Vars(req)["documentId"])
+	switch {
+	case errors.Is(err, fts.ErrDocumentNotFound):
+		writeJsonError(w, http.StatusNotFound, CodeDocumentNotFound, "Document not found.")
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		writeJson(w, http.StatusOK, vectors)
+	}
+}
+
+// RegisterAnalyzeHandlers registers the analysis debugging handlers.
+func RegisterAnalyzeHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
+	router.Handle("/indexes/{indexId}/_analyze", &AnalyzeHandler{indexManager}).Methods("POST")
+	router.Handle("/indexes/{indexId}/documents/{documentId}/_termvectors", &TermVectorsHandler{indexManager}).Methods("GET")
+	return nil
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/calebpalmer/simpleftsservice/internal/cache"
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+// CacheHandler represents the handler for the search cache of all indexes.
+type CacheHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// IndexCacheHandler represents the handler for the search cache of an index.
+type IndexCacheHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// CacheEntryHandler represents the handler for a cached search response.
+type CacheEntryHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// CacheStats are the cache metrics of every index and their total.
+type CacheStats struct {
+	Enabled bool                          `json:"enabled"`
+	Total   cache.IndexMetrics            `json:"total"`
+	Indexes map[string]cache.IndexMetrics `json:"indexes"`
+}
+
+// CacheEntry describes the cached response of a search, if there is one.
+type CacheEntry struct {
+	Index      string          `json:"index"`
+	Generation string          `json:"generation"`
+	Query      string          `json:"query"`
+	Cached     bool            `json:"cached"`
+	SizeBytes  int             `json:"sizeBytes,omitempty"`
+	Response   json.RawMessage `json:"response,omitempty"`
+}
+
+// ServeHTTP is the handler for the cache entity.
+func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getCacheHandler(w, req)
+	case http.MethodDelete:
+		h.deleteCacheHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getCacheHandler returns the cache metrics of every index.
+func (h *CacheHandler) getCacheHandler(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, http.StatusOK, CacheStats{
+		Enabled: h.IndexManager.Cache != nil,
+		Total:   h.IndexManager.CacheMetrics.Total(),
+		Indexes: h.IndexManager.CacheMetrics.Indexes(),
+	})
+}
+
+// deleteCacheHandler flushes the cached responses of every index.
+func (h *CacheHandler) deleteCacheHandler(w http.ResponseWriter, req *http.Request) {
+	if err := h.IndexManager.FlushCache(""); err != nil {
+		writeInternalServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeHTTP is the handler for the index cache entity.
+func (h *IndexCacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getIndexCacheHandler(w, req)
+	case http.MethodDelete:
+		h.deleteIndexCacheHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getIndexCacheHandler returns the cache metrics of an index.
+func (h *IndexCacheHandler) getIndexCacheHandler(w http.ResponseWriter, req *http.Request) {
+	index, ok := h.IndexManager.GetIndex(mux.Vars(req)["indexId"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, h.IndexManager.CacheMetrics.Index(index.Id))
+}
+
+// deleteIndexCacheHandler flushes the cached responses of an index.
+func (h *IndexCacheHandler) deleteIndexCacheHandler(w http.ResponseWriter, req *http.Request) {
+	err := h.IndexManager.FlushCache(mux.Vars(req)["indexId"])
+	switch {
+	case errors.Is(err, fts.ErrIndexNotFound):
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ServeHTTP is the handler for the cache entry entity.
+func (h *CacheEntryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getCacheEntryHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getCacheEntryHandler returns the response cached for the search described
+// by the same parameters as a search request.  Looking it up isn't counted in
+// the cache metrics.
+func (h *CacheEntryHandler) getCacheEntryHandler(w http.ResponseWriter, req *http.Request) {
+	params, err := parseSearchParams(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	index, ok := h.IndexManager.GetIndex(mux.Vars(req)["indexId"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+		return
+	}
+
+	entry := CacheEntry{Index: index.Id, Generation: index.CacheGeneration(), Query: params.cacheQuery(index)}
+	if h.IndexManager.Cache != nil {
+		response, err := cache.Peek(h.IndexManager.Cache, entry.Index, entry.Generation, entry.Query, params.cacheExtra())
+		if err != nil {
+			writeInternalServerError(w, err)
+			return
+		}
+		if response != nil {
+			entry.Cached = true
+			entry.SizeBytes = len(response)
+			entry.Response = response
+		}
+	}
+
+	writeJson(w, http.StatusOK, entry)
+}
+
+// RegisterCacheHandlers registers the cache handlers.
+func RegisterCacheHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
+	router.Handle("/_cache", &CacheHandler{indexManager}).Methods("GET", "DELETE")
+	router.Handle("/indexes/{indexId}/_cache", &IndexCacheHandler{indexManager}).Methods("GET", "DELETE")
+	router.Handle("/indexes/{indexId}/_cache/entry", &CacheEntryHandler{indexManager}).Methods("GET")
+	return nil
+}
@@ -2,8 +2,8 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/calebpalmer/simpleftsservice/pkg/fts"
@@ -25,7 +25,7 @@ func (d *DocumentsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		d.postDocumentsHandler(w, req)
 		return
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 		return
 	}
 }
@@ -36,43 +36,21 @@ func (d *DocumentsHandler) getDocumentsHandler(w http.ResponseWriter, req *http.
 	// get the index
 	index, ok := d.IndexManager.GetIndex(indexId)
 	if !ok {
-		msg, err := json.Marshal(map[string]string{"error": "IndexNotFound"})
-		if err != nil {
-			log.Println(err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
 		return
 	}
 
 	documents := make([]interface{}, 0)
-	for _, document := range index.Documents {
+	for _, document := range index.ListDocuments() {
 		docJson, err := document.Json()
 		if err != nil {
-			log.Println(err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
+			writeInternalServerError(w, fmt.Errorf("reading document %s: %w", document.Id, err))
 			return
 		}
 		documents = append(documents, docJson)
 	}
 
-	results := map[string][]interface{}{"documents": documents}
-	bytes, err := json.Marshal(results)
-	if err != nil {
-		log.Println(err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, string(bytes))
+	writeJson(w, http.StatusOK, map[string][]interface{}{"documents": documents})
 }
 
 func (d *DocumentsHandler) postDocumentsHandler(w http.ResponseWriter, req *http.Request) {
@@ -81,17 +59,7 @@ func (d *DocumentsHandler) postDocumentsHandler(w http.ResponseWriter, req *http
 	// get the index
 	index, ok := d.IndexManager.GetIndex(indexId)
 	if !ok {
-		msg, err := json.Marshal(map[string]string{"error": "IndexNotFound"})
-		if err != nil {
-			log.Fatal(err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
 		return
 	}
 
@@ -99,45 +67,33 @@ func (d *DocumentsHandler) postDocumentsHandler(w http.ResponseWriter, req *http
 	var body map[string]interface{}
 	err := json.NewDecoder(req.Body).Decode(&body)
 	if err != nil {
-		log.Println(err)
-		msg := fmt.Sprintf("Error parsing json: %s", err)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeInvalidJson(w, req, err)
 		return
 	}
 
 	// add the doc to the index
 	var id string
-	var doc interface{}
+	var doc map[string]interface{}
 
 	id, ok = body["id"].(string)
 	if !ok {
 		id = ""
 	}
 
-	doc, ok = body["document"]
+	doc, ok = body["document"].(map[string]interface{})
 	if !ok {
-		msg, _ := json.Marshal(map[string]string{"error": "\"document\" property is required."})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusBadRequest, CodeInvalidRequest, "\"document\" property is required.",
+			FieldError{Field: "document", Message: "must be an object"})
 		return
 	}
 
-	_, err = index.AddDocument(id, doc.(map[string]interface{}))
-
-	if err != nil {
-		msg, _ := json.Marshal(map[string]string{"error": "Internal Server Error"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, string(msg))
+	_, err = index.AddDocument(id, doc)
+	switch {
+	case errors.Is(err, fts.ErrInvalidDocument):
+		writeError(w, http.StatusBadRequest, err)
 		return
-	}
-
-	if err = d.IndexManager.Save(); err != nil {
-		msg, _ := json.Marshal(map[string]string{"error": "Internal Server Error"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, string(msg))
+	case err != nil:
+		writeInternalServerError(w, err)
 		return
 	}
 
@@ -155,11 +111,14 @@ func (d *DocumentHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	case http.MethodGet:
 		d.getDocumentHandler(w, req)
 		return
-	// case http.MethodPost:
-	//	d.postDocumentsHandler(w, req)
-	//	return
+	case http.MethodPut:
+		d.putDocumentHandler(w, req)
+		return
+	case http.MethodDelete:
+		d.deleteDocumentHandler(w, req)
+		return
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 		return
 	}
 }
@@ -170,37 +129,26 @@ func (d *DocumentHandler) getDocumentHandler(w http.ResponseWriter, req *http.Re
 	// get the index
 	index, ok := d.IndexManager.GetIndex(indexId)
 	if !ok {
-		msg, _ := json.Marshal(map[string]string{"error": "IndexNotFound"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
 		return
 	}
 
 	documentId := mux.Vars(req)["documentId"]
 	document, ok := index.GetDocument(documentId)
 	if !ok {
-		msg, _ := json.Marshal(map[string]string{"error": "DocumentNotFound"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeDocumentNotFound, "Document not found.")
 		return
 	}
 
 	docJson, err := document.Json()
 	if err != nil {
-		msg, _ := json.Marshal(map[string]string{"error": "InternalServerError"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, string(msg))
+		writeInternalServerError(w, err)
 		return
 	}
 
 	bytes, err := json.Marshal(docJson)
 	if err != nil {
-		log.Println(err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
+		writeInternalServerError(w, err)
 		return
 	}
 
@@ -214,20 +162,14 @@ func (d *DocumentHandler) putDocumentHandler(w http.ResponseWriter, req *http.Re
 	// get the index
 	index, ok := d.IndexManager.GetIndex(indexId)
 	if !ok {
-		msg, _ := json.Marshal(map[string]string{"error": "IndexNotFound"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
 		return
 	}
 
 	documentId := mux.Vars(req)["documentId"]
 	document, ok := index.GetDocument(documentId)
 	if !ok {
-		msg, _ := json.Marshal(map[string]string{"error": "DocumentNotFound"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeDocumentNotFound, "Document not found.")
 		return
 	}
 
@@ -235,22 +177,64 @@ func (d *DocumentHandler) putDocumentHandler(w http.ResponseWriter, req *http.Re
 	var newDocument fts.DocumentJson
 	err := json.NewDecoder(req.Body).Decode(&newDocument)
 	if err != nil {
-		log.Println(err)
-		msg := fmt.Sprintf("Error parsing json: %s", err)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeInvalidJson(w, req, err)
 		return
 	}
 
 	if newDocument.Id != document.Id {
-		http.Error(w, "Document id does not match.", http.StatusBadRequest)
+		writeJsonError(w, http.StatusBadRequest, CodeInvalidRequest, "Document id does not match.",
+			FieldError{Field: "id", Message: "must match the document id in the path"})
+		return
+	}
+
+	contents, ok := newDocument.Document.(map[string]interface{})
+	if !ok {
+		writeJsonError(w, http.StatusBadRequest, CodeInvalidRequest, "\"document\" property is required.",
+			FieldError{Field: "document", Message: "must be an object"})
+		return
+	}
+
+	err = index.ReplaceDocument(document.Id, contents)
+	switch {
+	case errors.Is(err, fts.ErrInvalidDocument):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		writeInternalServerError(w, err)
 		return
 	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *DocumentHandler) deleteDocumentHandler(w http.ResponseWriter, req *http.Request) {
+	indexId := mux.Vars(req)["indexId"]
+
+	// get the index
+	index, ok := d.IndexManager.GetIndex(indexId)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+		return
+	}
+
+	documentId := mux.Vars(req)["documentId"]
+	err := index.DeleteDocument(documentId)
+	if errors.Is(err, fts.ErrDocumentNotFound) {
+		writeJsonError(w, http.StatusNotFound, CodeDocumentNotFound, "Document not found.")
+		return
+	}
+	if err != nil {
+		writeInternalServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // RegisterDocumentsesHandlers registers the index handlers.
 func RegisterDocumentsHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
 
 	router.Handle("/indexes/{indexId}/documents", &DocumentsHandler{indexManager}).Methods("GET", "POST")
-	router.Handle("/indexes/{indexId}/documents/{documentId}", &DocumentHandler{indexManager}).Methods("GET", "DELETE")
+	router.Handle("/indexes/{indexId}/documents/{documentId}", &DocumentHandler{indexManager}).Methods("GET", "PUT", "DELETE")
 	return nil
 }
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+func TestListDocumentsWhileWriting(t *testing.T) {
+	router, indexManager := newTestRouter(t, fts.NewMemoryStorage())
+	if err := RegisterDocumentsHandlers(router, indexManager); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodPost, "/indexes", testIndex); w.Code != http.StatusCreated {
+		t.Fatalf("creating index: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	const documents = 200
+	var writers sync.WaitGroup
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for j := 0; j < documents; j++ {
+			body := fmt.Sprintf(`{"document":{"title":"book %d"}}`, j)
+			if w := serve(router, http.MethodPost, "/indexes/books/documents", body); w.Code != http.StatusCreated {
+				t.Errorf("adding document: status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+				return
+			}
+		}
+	}()
+
+	for listed := 0; listed < documents; {
+		w := serve(router, http.MethodGet, "/indexes/books/documents", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		var response struct {
+			Documents []json.RawMessage `json:"documents"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Documents) < listed {
+			t.Fatalf("listed %d documents after %d", len(response.Documents), listed)
+		}
+		listed = len(response.Documents)
+		if t.Failed() {
+			break
+		}
+	}
+	writers.Wait()
+}
+
+func TestInvalidDocumentsAreNotWritten(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{"add without a search property", http.MethodPost, "/indexes/books/documents", `{"id":"2","document":{"author":"tolkien"}}`},
+		{"add with a search property that isn't a string", http.MethodPost, "/indexes/books/documents", `{"id":"2","document":{"title":7}}`},
+		{"replace without a search property", http.MethodPut, "/indexes/books/documents/1", `{"id":"1","document":{"author":"tolkien"}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := fts.NewMemoryStorage()
+			router, indexManager := newTestRouter(t, storage)
+			if err := RegisterDocumentsHandlers(router, indexManager); err != nil {
+				t.Fatal(err)
+			}
+			if w := serve(router, http.MethodPost, "/indexes", testIndex); w.Code != http.StatusCreated {
+				t.Fatalf("creating index: status = %d, want %d", w.Code, http.StatusCreated)
+			}
+			if w := serve(router, http.MethodPost, "/indexes/books/documents", `{"id":"1","document":{"title":"the hobbit"}}`); w.Code != http.StatusCreated {
+				t.Fatalf("adding document: status = %d, want %d", w.Code, http.StatusCreated)
+			}
+
+			w := serve(router, test.method, test.target, test.body)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body.String())
+			}
+			if code := errorCodeOf(t, w); code != CodeInvalidDocument {
+				t.Errorf("code = %q, want %q", code, CodeInvalidDocument)
+			}
+
+			// nothing was logged to be replayed on the next start
+			reopened, err := fts.NewIndexManager(storage, "indexes.json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			books, _ := reopened.GetIndex("books")
+			if _, ok := books.GetDocument("2"); ok {
+				t.Error("the invalid document was replayed")
+			}
+			document, ok := books.GetDocument("1")
+			if !ok {
+				t.Fatal("document 1 is missing")
+			}
+			if contents, err := document.Contents(); err != nil || contents["title"] != "the hobbit" {
+				t.Errorf("document 1 = %v, %v, want the original", contents, err)
+			}
+		})
+	}
+}
+
+// newDocumentsRouter returns a router over storage serving an index called
+// books that holds one document.
+func newDocumentsRouter(t *testing.T, storage fts.Storage) (*mux.Router, *fts.IndexManager) {
+	t.Helper()
+
+	router, indexManager := newTestRouter(t, storage)
+	if err := RegisterDocumentsHandlers(router, indexManager); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(router, http.MethodPost, "/indexes", testIndex); w.Code != http.StatusCreated {
+		t.Fatalf("creating index: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := serve(router, http.MethodPost, "/indexes/books/documents", `{"id":"1","document":{"title":"the hobbit"}}`); w.Code != http.StatusCreated {
+		t.Fatalf("adding document: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	return router, indexManager
+}
+
+func TestDocumentStorageFailures(t *testing.T) {
+	tests := []struct {
+		name           string
+		failFileReads  bool
+		failFileWrites bool
+		method         string
+		target         string
+		body           string
+	}{
+		{name: "add", failFileWrites: true, method: http.MethodPost, target: "/indexes/books/documents", body: `{"id":"2","document":{"title":"dune"}}`},
+		{name: "replace", failFileWrites: true, method: http.MethodPut, target: "/indexes/books/documents/1", body: `{"id":"1","document":{"title":"dune"}}`},
+		{name: "delete", failFileWrites: true, method: http.MethodDelete, target: "/indexes/books/documents/1"},
+		{name: "read", failFileReads: true, method: http.MethodGet, target: "/indexes/books/documents/1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &failingStorage{MemoryStorage: fts.NewMemoryStorage()}
+			router, _ := newDocumentsRouter(t, storage)
+
+			storage.failFileReads = test.failFileReads
+			storage.failFileWrites = test.failFileWrites
+			w := serve(router, test.method, test.target, test.body)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body.String())
+			}
+			if code := errorCodeOf(t, w); code != CodeInternal {
+				t.Errorf("code = %q, want %q", code, CodeInternal)
+			}
+			if strings.Contains(w.Body.String(), errInjected.Error()) {
+				t.Errorf("the storage error leaked into the response: %s", w.Body.String())
+			}
+
+			// the service carries on once the storage recovers
+			storage.failFileReads = false
+			storage.failFileWrites = false
+			if w := serve(router, http.MethodGet, "/indexes/books/documents/1", ""); w.Code != http.StatusOK && w.Code != http.StatusNotFound {
+				t.Errorf("reading after the failure: status = %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestBuildWithUnreadableDocuments(t *testing.T) {
+	storage := &failingStorage{MemoryStorage: fts.NewMemoryStorage()}
+	_, indexManager := newDocumentsRouter(t, storage)
+	index, _ := indexManager.GetIndex("books")
+
+	storage.failFileReads = true
+	err := index.Build()
+	if !errors.Is(err, fts.ErrCorruptDocument) {
+		t.Fatalf("Build = %v, want %v", err, fts.ErrCorruptDocument)
+	}
+	if !strings.Contains(err.Error(), "1 missing or corrupt documents: 1") {
+		t.Errorf("Build = %v, want it to name document 1", err)
+	}
+
+	storage.failFileReads = false
+	if err := index.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := index.Search("hobbit", fts.OperatorOr); len(ids) != 1 || ids[0] != "1" {
+		t.Errorf("search after rebuilding = %v, want [1]", ids)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	var logged bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+	defer slog.SetDefault(previous)
+
+	router := mux.NewRouter()
+	useMiddleware(router, recoverPanics)
+	router.HandleFunc("/panic", func(w http.ResponseWriter, req *http.Request) {
+		var index *fts.Index
+		index.Search("hobbit", fts.OperatorOr)
+	})
+
+	w := serve(router, http.MethodGet, "/panic", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if code := errorCodeOf(t, w); code != CodeInternal {
+		t.Errorf("code = %q, want %q", code, CodeInternal)
+	}
+	for _, want := range []string{"panic serving request", "nil pointer dereference", "stack=", "TestRecoverPanics"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("log doesn't contain %q: %s", want, logged.String())
+		}
+	}
+}
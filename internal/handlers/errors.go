@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+)
+
+// Error codes returned in the code of an error response.  Clients should
+// switch on the code rather than the message, which is for people.
+const (
+	CodeInvalidRequest     = "InvalidRequest"
+	CodeInvalidJson        = "InvalidJson"
+	CodeInvalidParameter   = "InvalidParameter"
+	CodeNotFound           = "NotFound"
+	CodeMethodNotAllowed   = "MethodNotAllowed"
+	CodeConflict           = "Conflict"
+	CodeInternal           = "InternalServerError"
+	CodeIndexNotFound      = "IndexNotFound"
+	CodeIndexExists        = "IndexExists"
+	CodeIndexIsAlias       = "IndexIsAlias"
+	CodeInvalidIndex       = "InvalidIndex"
+	CodeDocumentNotFound   = "DocumentNotFound"
+	CodeInvalidDocument    = "InvalidDocument"
+	CodeAliasNotFound      = "AliasNotFound"
+	CodeAliasConflict      = "AliasConflict"
+	CodeInvalidAlias       = "InvalidAlias"
+	CodeInvalidReindex     = "InvalidReindex"
+	CodeSnapshotNotFound   = "SnapshotNotFound"
+	CodeSnapshotExists     = "SnapshotExists"
+	CodeInvalidSnapshot    = "InvalidSnapshot"
+	CodeRebuildInProgress  = "RebuildInProgress"
+	CodeInvalidOperator    = "InvalidOperator"
+	CodeInvalidCompression = "InvalidCompression"
+	CodeTaskNotFound       = "TaskNotFound"
+)
+
+// errorCodes maps the errors of the fts package to their codes.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{fts.ErrIndexNotFound, CodeIndexNotFound},
+	{fts.ErrIndexExists, CodeIndexExists},
+	{fts.ErrIndexIsAlias, CodeIndexIsAlias},
+	{fts.ErrInvalidIndex, CodeInvalidIndex},
+	{fts.ErrDocumentNotFound, CodeDocumentNotFound},
+	{fts.ErrInvalidDocument, CodeInvalidDocument},
+	{fts.ErrAliasNotFound, CodeAliasNotFound},
+	{fts.ErrAliasConflict, CodeAliasConflict},
+	{fts.ErrInvalidAlias, CodeInvalidAlias},
+	{fts.ErrInvalidReindex, CodeInvalidReindex},
+	{fts.ErrSnapshotNotFound, CodeSnapshotNotFound},
+	{fts.ErrSnapshotExists, CodeSnapshotExists},
+	{fts.ErrInvalidSnapshot, CodeInvalidSnapshot},
+	{fts.ErrRebuildInProgress, CodeRebuildInProgress},
+	{fts.ErrInvalidOperator, CodeInvalidOperator},
+	{fts.ErrInvalidCompression, CodeInvalidCompression},
+}
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody describes what went wrong with a request.
+type ErrorBody struct {
+	// Code identifies the error, such as IndexNotFound.
+	Code string `json:"code"`
+	// Message describes the error.
+	Message string `json:"message"`
+	// RequestId is the id of the request, which is also in the log.
+	RequestId string `json:"requestId,omitempty"`
+	// Details lists the problems with particular fields of the request.
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// errorCode returns the code of an error, falling back to a generic code for
+// the status when the error has none of its own.
+func errorCode(err error, status int) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+
+	switch status {
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusInternalServerError:
+		return CodeInternal
+	default:
+		return CodeInvalidRequest
+	}
+}
+
+// writes an error response with the given status code.
+func writeJsonError(w http.ResponseWriter, status int, code string, message string, details ...FieldError) {
+	body, _ := json.Marshal(ErrorResponse{ErrorBody{
+		Code:      code,
+		Message:   message,
+		RequestId: w.Header().Get(requestIdHeader),
+		Details:   details,
+	}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(body))
+}
+
+// writes an error response for an error, with the code of the error.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJsonError(w, status, errorCode(err, status), err.Error())
+}
+
+// writes an internal server error from an error.  The error is logged with
+// the request id so the response can be matched with the log, but isn't
+// returned to the client.
+func writeInternalServerError(w http.ResponseWriter, err error) {
+	slog.Error("internal server error", "requestId", w.Header().Get(requestIdHeader), "error", err)
+	writeJsonError(w, http.StatusInternalServerError, CodeInternal, "Internal server error.")
+}
+
+// writes the response to a request whose method the endpoint doesn't
+// support.
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	writeJsonError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method not allowed.")
+}
+
+// writes the response to a request whose body isn't valid json, naming the
+// field when the json has a value of the wrong type.
+func writeInvalidJson(w http.ResponseWriter, req *http.Request, err error) {
+	requestLogger(req).Info("invalid request body", "error", err)
+
+	var details []FieldError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		details = append(details, FieldError{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value),
+		})
+	}
+	writeJsonError(w, http.StatusBadRequest, CodeInvalidJson, fmt.Sprintf("Error parsing json: %s", err), details...)
+}
@@ -3,15 +3,65 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+
+	"github.com/gorilla/mux"
 )
 
-// writes an internal server error from an error.
-func writeInternalServerError(w http.ResponseWriter, err error) {
-	log.Print(err)
-	w.WriteHeader(http.StatusInternalServerError)
+// writes a value as a json body with the given status code.
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		writeInternalServerError(w, err)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	msg, _ := json.Marshal(map[string]string{"details": fmt.Sprintf("%s", err)})
-	fmt.Fprint(w, string(msg))
+	w.WriteHeader(status)
+	fmt.Fprint(w, string(body))
+}
+
+// responseRecorder records the status and size of a response as it is
+// written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Status returns the status of the response, which is 200 unless another
+// was written.
+func (r *responseRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// routeTemplate returns the path template of the route matching a request,
+// such as /indexes/{indexId}, so requests can be grouped without a label per
+// index or document.
+func routeTemplate(req *http.Request) string {
+	if route := mux.CurrentRoute(req); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
 }
@@ -1,8 +1,8 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 
 	"encoding/json"
@@ -20,7 +20,7 @@ type IndexesHandler struct {
 // ServeHTTP is the handler for the indexes entities.
 func (h *IndexesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path != "/indexes" {
-		http.NotFound(w, req)
+		writeJsonError(w, http.StatusNotFound, CodeNotFound, "Not found.")
 		return
 	}
 
@@ -30,59 +30,50 @@ func (h *IndexesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	case http.MethodPost:
 		h.postIndexes(w, req)
 	default:
-		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 	}
 
 }
 
 // getIndexes returns the list of indexes.
 func (h *IndexesHandler) getIndexes(w http.ResponseWriter, req *http.Request) {
-	bytes, err := json.Marshal(h.IndexManager)
-	if err != nil {
-		log.Fatal(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, string(bytes))
+	writeJson(w, http.StatusOK, h.IndexManager)
 }
 
 // postIndexes is the handler for posting and index.
 func (h *IndexesHandler) postIndexes(w http.ResponseWriter, req *http.Request) {
 	contentType := req.Header.Get("Content-Type")
 	if contentType != "application/json" {
-		http.Error(w, "Expected json body", http.StatusBadRequest)
+		writeJsonError(w, http.StatusBadRequest, CodeInvalidRequest, "Expected json body.")
 		return
 	}
 
 	var newIndex fts.Index
 	err := json.NewDecoder(req.Body).Decode(&newIndex)
 	if err != nil {
-		log.Println(err)
-		msg := fmt.Sprintf("Error parsing json: %s", err)
-		http.Error(w, msg, http.StatusBadRequest)
+		writeInvalidJson(w, req, err)
 		return
 	}
 
 	// validate the index
 	if err = newIndex.Validate(); err != nil {
-		msg := fmt.Sprintf("Invalid index: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusBadRequest)
+		requestLogger(req).Info("invalid index", "error", err)
+		writeJsonError(w, http.StatusBadRequest, CodeInvalidIndex, fmt.Sprintf("Invalid index: %s", err))
 		return
 	}
 
-	// check to make sure index doesn't already exist
-	for _, index := range h.IndexManager.Indexes {
-		if index.Id == newIndex.Id {
-			http.Error(w, "Index exists.", http.StatusConflict)
-			return
-		}
+	// an index or an alias by that name must not already exist
+	err = h.IndexManager.AddIndex(&newIndex)
+	switch {
+	case errors.Is(err, fts.ErrIndexExists):
+		writeJsonError(w, http.StatusConflict, CodeIndexExists, "Index exists.")
+	case errors.Is(err, fts.ErrInvalidIndex):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		w.WriteHeader(http.StatusCreated)
 	}
-
-	h.IndexManager.AddIndex(&newIndex)
-	w.WriteHeader(http.StatusCreated)
 }
 
 // RegisterIndexesHandlers registeres the index handlers.
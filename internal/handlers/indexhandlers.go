@@ -2,10 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"net/http"
-
-	"log"
+	"strconv"
 
 	"github.com/calebpalmer/simpleftsservice/pkg/fts"
 	"github.com/gorilla/mux"
@@ -22,12 +21,14 @@ func (h *IndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	case http.MethodGet:
 		h.getIndexHandler(w, req)
 		return
+	case http.MethodPut:
+		h.putIndexHandler(w, req)
 	case http.MethodDelete:
 		h.deleteIndexHandler(w, req)
 	// case http.MethodPost:
 	//	h.postIndexHandler(w, req)
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 		return
 	}
 }
@@ -35,57 +36,107 @@ func (h *IndexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // getIndexHandler is the handler for getting an index
 func (i *IndexHandler) getIndexHandler(w http.ResponseWriter, req *http.Request) {
 	indexId := mux.Vars(req)["indexId"]
-	index, ok := i.IndexManager.Indexes[indexId]
+	index, ok := i.IndexManager.GetIndex(indexId)
 	if !ok {
-		msg, err := json.Marshal(map[string]string{"error": "IndexNotFound"})
-		if err != nil {
-			log.Fatal(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
 		return
 	}
 
-	jsonData, err := json.Marshal(index)
-	if err != nil {
-		log.Println(err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	writeJson(w, http.StatusOK, index)
+}
+
+// putIndexHandler is the handler for updating an index's settings.  The index
+// is rebuilt in the background so this returns the rebuild task.
+func (i *IndexHandler) putIndexHandler(w http.ResponseWriter, req *http.Request) {
+	indexId := mux.Vars(req)["indexId"]
+
+	var settings fts.IndexSettings
+	if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+		writeInvalidJson(w, req, err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(jsonData))
+	task, err := i.IndexManager.UpdateIndex(indexId, settings)
+	switch {
+	case errors.Is(err, fts.ErrIndexNotFound):
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+	case errors.Is(err, fts.ErrInvalidIndex):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, fts.ErrRebuildInProgress):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		writeJson(w, http.StatusAccepted, map[string]fts.TaskInfo{"task": task.Info()})
+	}
 }
 
 // deleteIndexHandler is the handler for creating an index
 func (i *IndexHandler) deleteIndexHandler(w http.ResponseWriter, req *http.Request) {
-	indexId := mux.Vars(req)["indexId"]
-	_, ok := i.IndexManager.Indexes[indexId]
+	// aliases aren't resolved so deleting one can't delete the index behind it
+	err := i.IndexManager.DeleteIndex(mux.Vars(req)["indexId"])
+	switch {
+	case errors.Is(err, fts.ErrIndexNotFound):
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+	case errors.Is(err, fts.ErrIndexIsAlias):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// defaultTopTerms is the number of top terms reported when not requested.
+const defaultTopTerms = 10
+
+// IndexStatsHandler represents the handler for an index's statistics.
+type IndexStatsHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the index stats entity.
+func (h *IndexStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getIndexStatsHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getIndexStatsHandler returns the statistics of an index.
+func (h *IndexStatsHandler) getIndexStatsHandler(w http.ResponseWriter, req *http.Request) {
+	index, ok := h.IndexManager.GetIndex(mux.Vars(req)["indexId"])
 	if !ok {
-		msg, err := json.Marshal(map[string]string{"error": "IndexNotFound"})
-		if err != nil {
-			log.Fatal(err)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+		return
+	}
+
+	top := defaultTopTerms
+	if value := req.FormValue("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeJsonError(w, http.StatusBadRequest, CodeInvalidParameter, "\"top\" must be a non-negative integer.",
+				FieldError{Field: "top", Message: "must be a non-negative integer"})
 			return
 		}
+		top = n
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+	stats, err := index.Stats(top)
+	if err != nil {
+		writeInternalServerError(w, err)
 		return
 	}
 
-	i.IndexManager.DeleteIndex(indexId)
-	w.WriteHeader(http.StatusNoContent)
+	writeJson(w, http.StatusOK, stats)
 }
 
 // RegisterIndexesHandlers registers the index handlers.
 func RegisterIndexHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
 
 	router.Handle("/indexes/{indexId}", &IndexHandler{indexManager}).Methods("GET", "POST", "PUT", "DELETE")
+	router.Handle("/indexes/{indexId}/_stats", &IndexStatsHandler{indexManager}).Methods("GET")
 	return nil
 }
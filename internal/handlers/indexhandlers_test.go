@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+var errInjected = errors.New("injected storage failure")
+
+// failingStorage is a MemoryStorage whose writes, removes and file reads and
+// writes fail on demand.
+type failingStorage struct {
+	*fts.MemoryStorage
+	failWrites     bool
+	failRemoves    bool
+	failFileReads  bool
+	failFileWrites bool
+}
+
+// failingFile is a file of a failingStorage.
+type failingFile struct {
+	fts.File
+	storage *failingStorage
+}
+
+func (f *failingFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.storage.failFileReads {
+		return 0, errInjected
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.storage.failFileWrites {
+		return 0, errInjected
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *failingFile) Sync() error {
+	if f.storage.failFileWrites {
+		return errInjected
+	}
+	return f.File.Sync()
+}
+
+func (s *failingStorage) OpenFile(name string) (fts.File, error) {
+	file, err := s.MemoryStorage.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: file, storage: s}, nil
+}
+
+func (s *failingStorage) WriteFile(name string, data []byte) error {
+	if s.failWrites {
+		return errInjected
+	}
+	return s.MemoryStorage.WriteFile(name, data)
+}
+
+func (s *failingStorage) RemoveAll(dir string) error {
+	if s.failRemoves {
+		return errInjected
+	}
+	return s.MemoryStorage.RemoveAll(dir)
+}
+
+// newTestRouter returns a router serving the index handlers of a new index
+// manager over storage.
+func newTestRouter(t *testing.T, storage fts.Storage) (*mux.Router, *fts.IndexManager) {
+	t.Helper()
+
+	indexManager, err := fts.NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	useMiddleware(router, recoverPanics)
+	if err := RegisterIndexesHandlers(router, indexManager); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterIndexHandlers(router, indexManager); err != nil {
+		t.Fatal(err)
+	}
+	return router, indexManager
+}
+
+// serve sends a request to the router and returns the response.
+func serve(router http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// errorCodeOf returns the code of an error response, failing the test when
+// the body isn't an error envelope.
+func errorCodeOf(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", contentType)
+	}
+	var response ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("body %q is not an error envelope: %s", w.Body.String(), err)
+	}
+	return response.Error.Code
+}
+
+const testIndex = `{"id":"books","searchProperties":["title"]}`
+
+func TestCreateIndex(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   bool
+		failWrites bool
+		status     int
+		code       string
+		created    bool
+	}{
+		{name: "created", status: http.StatusCreated, created: true},
+		{name: "exists", existing: true, status: http.StatusConflict, code: CodeIndexExists, created: true},
+		{name: "catalog write fails", failWrites: true, status: http.StatusInternalServerError, code: CodeInternal},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &failingStorage{MemoryStorage: fts.NewMemoryStorage()}
+			router, indexManager := newTestRouter(t, storage)
+			if test.existing {
+				if w := serve(router, http.MethodPost, "/indexes", testIndex); w.Code != http.StatusCreated {
+					t.Fatalf("creating index: status = %d, want %d", w.Code, http.StatusCreated)
+				}
+			}
+
+			storage.failWrites = test.failWrites
+			w := serve(router, http.MethodPost, "/indexes", testIndex)
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if test.code != "" {
+				if code := errorCodeOf(t, w); code != test.code {
+					t.Errorf("code = %q, want %q", code, test.code)
+				}
+			}
+			if _, ok := indexManager.GetIndex("books"); ok != test.created {
+				t.Errorf("index exists = %t, want %t", ok, test.created)
+			}
+		})
+	}
+}
+
+func TestDeleteIndex(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		failWrites  bool
+		failRemoves bool
+		status      int
+		code        string
+		deleted     bool
+	}{
+		{name: "deleted", target: "books", status: http.StatusNoContent, deleted: true},
+		{name: "alias", target: "library", status: http.StatusConflict, code: CodeIndexIsAlias},
+		{name: "not found", target: "films", status: http.StatusNotFound, code: CodeIndexNotFound},
+		{name: "catalog write fails", target: "books", failWrites: true, status: http.StatusInternalServerError, code: CodeInternal},
+		{name: "file removal fails", target: "books", failRemoves: true, status: http.StatusInternalServerError, code: CodeInternal, deleted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &failingStorage{MemoryStorage: fts.NewMemoryStorage()}
+			router, indexManager := newTestRouter(t, storage)
+			if w := serve(router, http.MethodPost, "/indexes", testIndex); w.Code != http.StatusCreated {
+				t.Fatalf("creating index: status = %d, want %d", w.Code, http.StatusCreated)
+			}
+			if err := indexManager.UpdateAliases([]fts.AliasAction{{Add: &fts.AliasSpec{Index: "books", Alias: "library"}}}); err != nil {
+				t.Fatal(err)
+			}
+
+			storage.failWrites = test.failWrites
+			storage.failRemoves = test.failRemoves
+			w := serve(router, http.MethodDelete, "/indexes/"+test.target, "")
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if test.code != "" {
+				if code := errorCodeOf(t, w); code != test.code {
+					t.Errorf("code = %q, want %q", code, test.code)
+				}
+			}
+			if _, ok := indexManager.GetIndex("books"); ok == test.deleted {
+				t.Errorf("index exists = %t, want %t", ok, !test.deleted)
+			}
+		})
+	}
+}
+
+func TestUpdateIndex(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		rebuilding bool
+		status     int
+		code       string
+	}{
+		{name: "rebuilt", target: "books", body: `{"searchProperties":["title","author"],"analysis":{"filters":["lowercase"]}}`, status: http.StatusAccepted},
+		{name: "not found", target: "films", body: `{"searchProperties":["title"]}`, status: http.StatusNotFound, code: CodeIndexNotFound},
+		{name: "no search properties", target: "books", body: `{"searchProperties":[]}`, status: http.StatusBadRequest, code: CodeInvalidIndex},
+		{name: "unknown filter", target: "books", body: `{"searchProperties":["title"],"analysis":{"filters":["stem"]}}`, status: http.StatusBadRequest, code: CodeInvalidIndex},
+		{name: "invalid json", target: "books", body: `{"searchProperties":"title"}`, status: http.StatusBadRequest, code: CodeInvalidJson},
+		{name: "already rebuilding", target: "books", body: `{"searchProperties":["title"]}`, rebuilding: true, status: http.StatusConflict, code: CodeRebuildInProgress},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, indexManager := newTestRouter(t, fts.NewMemoryStorage())
+			if w := serve(router, http.MethodPost, "/indexes", testIndex); w.Code != http.StatusCreated {
+				t.Fatalf("creating index: status = %d, want %d", w.Code, http.StatusCreated)
+			}
+			index, _ := indexManager.GetIndex("books")
+			if test.rebuilding {
+				if err := index.BeginRebuild(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := serve(router, http.MethodPut, "/indexes/"+test.target, test.body)
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if test.code != "" {
+				if code := errorCodeOf(t, w); code != test.code {
+					t.Errorf("code = %q, want %q", code, test.code)
+				}
+				if properties := index.Settings().SearchProperties; len(properties) != 1 {
+					t.Errorf("rejected update changed the search properties to %v", properties)
+				}
+				return
+			}
+
+			var response map[string]fts.TaskInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			task, ok := indexManager.Tasks.Get(response["task"].Id)
+			if !ok || response["task"].Type != "rebuild" {
+				t.Fatalf("response %s isn't a rebuild task", w.Body.String())
+			}
+			for deadline := time.Now().Add(5 * time.Second); task.Info().Status == fts.TaskRunning; time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("rebuild didn't finish")
+				}
+			}
+			if info := task.Info(); info.Status != fts.TaskCompleted {
+				t.Fatalf("rebuild finished %+v", info)
+			}
+
+			w = serve(router, http.MethodGet, "/indexes/books", "")
+			var settings fts.IndexSettings
+			if err := json.Unmarshal(w.Body.Bytes(), &settings); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(settings.SearchProperties) != "[title author]" || settings.Analysis == nil {
+				t.Errorf("index after updating = %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -1,47 +1,191 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/calebpalmer/simpleftsservice/internal/cache"
 	"github.com/calebpalmer/simpleftsservice/internal/config"
 	"github.com/calebpalmer/simpleftsservice/pkg/fts"
 	"github.com/gorilla/mux"
 )
 
-func RegisterHandlers(router *mux.Router, config config.Config) error {
+// checkpointInterval is how often indexes are checkpointed so their
+// write-ahead logs can be emptied.
+const checkpointInterval = time.Minute
+
+// RegisterHandlers opens the indexes and registers every handler.  The index
+// manager is returned so it can be closed when the service stops.
+func RegisterHandlers(router *mux.Router, config config.Config) (*fts.IndexManager, error) {
+	useMiddleware(router, logRequests, instrumentRequests, recoverPanics)
+
 	err := RegisterStatusHandlers(router)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var maybeCache *cache.Cache
+	cacheMetrics := cache.NewMetrics()
+	var maybeCache cache.Cache
 	if config.CacheConfig != nil {
-		maybeCache = cache.NewCache(config.CacheConfig.ConnString)
+		maybeCache, err = cache.New(*config.CacheConfig, cacheMetrics)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	indexManager := fts.NewIndexManager("indexes.json", maybeCache)
-	for _, index := range indexManager.Indexes {
-		index.Build()
+	storage, catalog, err := openStorage(config.StorageConfig)
+	if err != nil {
+		return nil, err
 	}
 
+	var indexManager *fts.IndexManager
+	if config.Recover {
+		indexManager, err = fts.RecoverIndexManager(storage, catalog, maybeCache)
+	} else {
+		indexManager, err = fts.NewIndexManager(storage, catalog, maybeCache)
+	}
+	if err != nil {
+		return nil, startupError(err)
+	}
+	perm, err := config.StorageConfig.Perm()
+	if err != nil {
+		return nil, err
+	}
+	indexManager.Snapshots = fts.NewSnapshotRepository(snapshotDir(config.StorageConfig), perm)
+	indexManager.CacheMetrics = cacheMetrics
+	indexManager.StartCheckpointing(checkpointInterval)
+
 	err = RegisterIndexesHandlers(router, indexManager)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = RegisterIndexHandlers(router, indexManager)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = RegisterAliasesHandlers(router, indexManager)
+	if err != nil {
+		return nil, err
 	}
 
 	err = RegisterDocumentsHandlers(router, indexManager)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = RegisterSearchHandlers(router, indexManager)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	err = RegisterAnalyzeHandlers(router, indexManager)
+	if err != nil {
+		return nil, err
+	}
+
+	err = RegisterReindexHandlers(router, indexManager)
+	if err != nil {
+		return nil, err
+	}
+
+	err = RegisterTasksHandlers(router, indexManager)
+	if err != nil {
+		return nil, err
+	}
+
+	err = RegisterSnapshotHandlers(router, indexManager)
+	if err != nil {
+		return nil, err
+	}
+
+	err = RegisterCacheHandlers(router, indexManager)
+	if err != nil {
+		return nil, err
+	}
+
+	err = RegisterMetricsHandlers(router, indexManager)
+	if err != nil {
+		return nil, err
+	}
+
+	return indexManager, nil
+}
+
+// boltDatabase is the name of the bbolt database in the data directory.
+const boltDatabase = "fts.db"
+
+// openStorage opens the storage backend described by the storage config and
+// checks that it is writable.  It also returns the catalog's path in it.
+func openStorage(config config.StorageConfig) (fts.Storage, string, error) {
+	dataDir := config.DataDir
+	if dataDir == "" {
+		dataDir = "."
+	}
+
+	catalog := "indexes.json"
+	if config.Catalog != "" {
+		catalog = path.Clean(config.Catalog)
+		if path.IsAbs(catalog) || catalog == ".." || strings.HasPrefix(catalog, "../") || catalog == "." {
+			return nil, "", fmt.Errorf("invalid storage catalog %q: must be a file path relative to the data directory", config.Catalog)
+		}
+	}
+
+	fsync, err := fts.ParseFsyncPolicy(config.Fsync)
+	if err != nil {
+		return nil, "", err
+	}
+	perm, err := config.Perm()
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch config.Backend {
+	case "", "dir":
+		storage := fts.NewDirStorage(dataDir, perm, fsync)
+		if err := storage.CheckWritable(); err != nil {
+			return nil, "", err
+		}
+		return storage, catalog, nil
+	case "bolt":
+		// the database is created in the data directory, which must be writable
+		if err := fts.NewDirStorage(dataDir, perm, fsync).CheckWritable(); err != nil {
+			return nil, "", err
+		}
+		storage, err := fts.OpenBoltStorage(filepath.Join(dataDir, boltDatabase), perm, fsync)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %s: %s", fts.ErrStorageNotWritable, filepath.Join(dataDir, boltDatabase), err)
+		}
+		return storage, catalog, nil
+	case "memory":
+		slog.Warn("indexes are kept in memory and are lost when the service stops")
+		return fts.NewMemoryStorage(), catalog, nil
+	default:
+		return nil, "", fmt.Errorf("invalid storage backend %q: must be dir, bolt or memory", config.Backend)
+	}
+}
+
+// snapshotDir returns the directory of the snapshot repository.
+func snapshotDir(config config.StorageConfig) string {
+	if config.SnapshotDir != "" {
+		return config.SnapshotDir
+	}
+	if config.DataDir != "" {
+		return filepath.Join(config.DataDir, "snapshots")
+	}
+	return "snapshots"
+}
+
+// startupError adds a hint about recovery mode to errors caused by corrupt files.
+func startupError(err error) error {
+	if errors.Is(err, fts.ErrCorruptCatalog) || errors.Is(err, fts.ErrCorruptDocument) || errors.Is(err, fts.ErrCorruptCheckpoint) || errors.Is(err, fts.ErrCorruptSegment) {
+		return fmt.Errorf("%w (start with -recover to repair)", err)
+	}
+	return err
 }
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/calebpalmer/simpleftsservice/internal/cache"
+	"github.com/calebpalmer/simpleftsservice/internal/metrics"
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+var (
+	httpRequests = metrics.NewCounter("fts_http_requests_total",
+		"HTTP requests by route template, method and status.", "route", "method", "status")
+	httpRequestDuration = metrics.NewHistogram("fts_http_request_duration_seconds",
+		"HTTP request latency by route template and method.", metrics.DefaultBuckets, "route", "method")
+	searchDuration = metrics.NewHistogram("fts_search_duration_seconds",
+		"Search latency by operator, whether documents were returned and how the cache served the search.",
+		metrics.DefaultBuckets, "operator", "documents", "cache")
+)
+
+// MetricsHandler represents the handler for the service metrics.
+type MetricsHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the metrics entity.
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getMetricsHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getMetricsHandler returns the metrics in the Prometheus text format.
+func (h *MetricsHandler) getMetricsHandler(w http.ResponseWriter, req *http.Request) {
+	var body bytes.Buffer
+	httpRequests.Write(&body)
+	httpRequestDuration.Write(&body)
+	searchDuration.Write(&body)
+	h.writeIndexMetrics(&body)
+	h.writeCacheMetrics(&body)
+	metrics.WriteRuntime(&body)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(body.Bytes())
+}
+
+// indexMetric is a metric with a sample for each index.
+type indexMetric struct {
+	name  string
+	help  string
+	kind  string
+	value func(counts fts.IndexCounts) float64
+}
+
+// indexMetrics only use the counts each index maintains as it changes, since
+// statistics that walk the inverted index would make every scrape cost as
+// much as the corpus.
+var indexMetrics = []indexMetric{
+	{"fts_index_documents", "Number of documents in the index.", "gauge",
+		func(counts fts.IndexCounts) float64 { return float64(counts.DocumentCount) }},
+	{"fts_index_terms", "Number of distinct terms in the index, including terms only held by deleted documents until they are merged away.", "gauge",
+		func(counts fts.IndexCounts) float64 { return float64(counts.UniqueTerms) }},
+	{"fts_index_segments", "Number of segments of the index.", "gauge",
+		func(counts fts.IndexCounts) float64 { return float64(counts.Segments) }},
+	{"fts_index_store_bytes", "Size of the index's document store.", "gauge",
+		func(counts fts.IndexCounts) float64 { return float64(counts.StoreSizeBytes) }},
+	{"fts_index_store_garbage_bytes", "Bytes of replaced and deleted documents in the index's document store.", "gauge",
+		func(counts fts.IndexCounts) float64 { return float64(counts.StoreGarbageBytes) }},
+	{"fts_index_documents_indexed_total", "Documents indexed since the service started.", "counter",
+		func(counts fts.IndexCounts) float64 { return float64(counts.DocumentsIndexed) }},
+	{"fts_index_indexing_failures_total", "Documents that failed to index since the service started.", "counter",
+		func(counts fts.IndexCounts) float64 { return float64(counts.IndexingFailures) }},
+	{"fts_index_documents_deleted_total", "Documents deleted since the service started.", "counter",
+		func(counts fts.IndexCounts) float64 { return float64(counts.DocumentsDeleted) }},
+	{"fts_index_searches_total", "Searches run since the service started.", "counter",
+		func(counts fts.IndexCounts) float64 { return float64(counts.Searches) }},
+	{"fts_index_searches_coalesced_total", "Searches that shared the result of an identical concurrent search.", "counter",
+		func(counts fts.IndexCounts) float64 { return float64(counts.SearchesCoalesced) }},
+}
+
+// writeIndexMetrics writes the size and usage of each index.
+func (h *MetricsHandler) writeIndexMetrics(body *bytes.Buffer) {
+	indexes := h.IndexManager.ListIndexes()
+	counts := make([]fts.IndexCounts, 0, len(indexes))
+	for _, index := range indexes {
+		counts = append(counts, index.Counts())
+	}
+
+	for _, metric := range indexMetrics {
+		metrics.WriteHeader(body, metric.name, metric.help, metric.kind)
+		for _, c := range counts {
+			metrics.WriteSample(body, metric.name, []metrics.Label{{Name: "index", Value: c.Id}}, metric.value(c))
+		}
+	}
+}
+
+// writeCacheMetrics writes how the cache served each index.
+func (h *MetricsHandler) writeCacheMetrics(body *bytes.Buffer) {
+	byIndex := h.IndexManager.CacheMetrics.Indexes()
+	names := make([]string, 0, len(byIndex))
+	for _, index := range h.IndexManager.ListIndexes() {
+		if _, ok := byIndex[index.Id]; ok {
+			names = append(names, index.Id)
+		}
+	}
+
+	write := func(name string, help string, kind string, value func(s cache.IndexMetrics) float64) {
+		metrics.WriteHeader(body, name, help, kind)
+		for _, index := range names {
+			metrics.WriteSample(body, name, []metrics.Label{{Name: "index", Value: index}}, value(byIndex[index]))
+		}
+	}
+	write("fts_cache_hits_total", "Searches answered from the cache.", "counter",
+		func(s cache.IndexMetrics) float64 { return float64(s.Hits) })
+	write("fts_cache_misses_total", "Searches not found in the cache.", "counter",
+		func(s cache.IndexMetrics) float64 { return float64(s.Misses) })
+	write("fts_cache_errors_total", "Failed cache lookups and additions.", "counter",
+		func(s cache.IndexMetrics) float64 { return float64(s.Errors) })
+	write("fts_cache_evictions_total", "Responses evicted from the in-process cache to make room.", "counter",
+		func(s cache.IndexMetrics) float64 { return float64(s.Evictions) })
+	write("fts_cache_hit_ratio", "Fraction of cache lookups that were hits.", "gauge",
+		func(s cache.IndexMetrics) float64 { return s.HitRatio })
+	write("fts_cache_get_seconds_total", "Time spent looking responses up in the cache.", "counter",
+		func(s cache.IndexMetrics) float64 { return s.GetSeconds })
+	write("fts_cache_add_seconds_total", "Time spent adding responses to the cache.", "counter",
+		func(s cache.IndexMetrics) float64 { return s.AddSeconds })
+}
+
+// instrumentRequests counts requests and their latency by route template.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+
+		route := routeTemplate(req)
+		httpRequests.Inc(route, req.Method, strconv.Itoa(recorder.Status()))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, req.Method)
+	})
+}
+
+// RegisterMetricsHandlers registers the metrics handler.
+func RegisterMetricsHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
+	router.Handle("/metrics", &MetricsHandler{indexManager}).Methods("GET")
+	return nil
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/calebpalmer/simpleftsservice/internal/logging"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// requestIdHeader is the header carrying the id of a request, taken from the
+// client when it sends one and returned in every response.
+const requestIdHeader = "X-Request-ID"
+
+// maxRequestIdLength bounds the length of the request ids taken from clients.
+const maxRequestIdLength = 128
+
+// useMiddleware wraps every request in middleware, including requests
+// matching no route, which mux serves without its middleware.
+func useMiddleware(router *mux.Router, middleware ...mux.MiddlewareFunc) {
+	router.Use(middleware...)
+
+	notFound := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJsonError(w, http.StatusNotFound, CodeNotFound, "Not found.")
+	}))
+	methodNotAllowed := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeMethodNotAllowed(w)
+	}))
+	for j := len(middleware) - 1; j >= 0; j-- {
+		notFound = middleware[j](notFound)
+		methodNotAllowed = middleware[j](methodNotAllowed)
+	}
+	router.NotFoundHandler = notFound
+	router.MethodNotAllowedHandler = methodNotAllowed
+}
+
+// requestId returns the id the client gave a request, or a new one when it
+// gave none or one that isn't safe to log.
+func requestId(req *http.Request) string {
+	id := req.Header.Get(requestIdHeader)
+	if id == "" || len(id) > maxRequestIdLength {
+		return uuid.New().String()
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return uuid.New().String()
+		}
+	}
+	return id
+}
+
+// logRequests assigns each request an id, which is returned in the
+// X-Request-ID header and added to everything logged through the request's
+// logger, and logs each request once it has been served.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := requestId(req)
+		w.Header().Set(requestIdHeader, id)
+
+		logger := slog.Default().With("requestId", id)
+		req = req.WithContext(logging.WithLogger(req.Context(), logger))
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+
+		logger.Info("request",
+			"method", req.Method,
+			"route", routeTemplate(req),
+			"path", req.URL.Path,
+			"status", recorder.Status(),
+			"bytes", recorder.bytes,
+			"durationMs", float64(time.Since(start).Microseconds())/1000)
+	})
+}
+
+// recoverPanics turns a panic in a handler into an internal server error so
+// one bad request can't take down the server.  The panic is logged with its
+// stack trace.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recorder := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// net/http aborts the response quietly for this one
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			requestLogger(req).Error("panic serving request",
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()))
+			if recorder.status == 0 {
+				writeJsonError(w, http.StatusInternalServerError, CodeInternal, "Internal server error.")
+			}
+		}()
+
+		next.ServeHTTP(recorder, req)
+	})
+}
+
+// requestLogger returns the logger of a request, which adds the request id to
+// everything it logs.
+func requestLogger(req *http.Request) *slog.Logger {
+	return logging.FromContext(req.Context())
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+// ReindexHandler represents the handler for copying documents between indexes.
+type ReindexHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the reindex entity.
+func (h *ReindexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		h.postReindexHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// postReindexHandler starts a reindex task and returns it without waiting for
+// it to complete.
+func (h *ReindexHandler) postReindexHandler(w http.ResponseWriter, req *http.Request) {
+	var request fts.ReindexRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		writeInvalidJson(w, req, err)
+		return
+	}
+
+	task, err := h.IndexManager.Reindex(request)
+	switch {
+	case errors.Is(err, fts.ErrIndexNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, fts.ErrInvalidReindex):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		writeJson(w, http.StatusAccepted, map[string]fts.TaskInfo{"task": task.Info()})
+	}
+}
+
+// RegisterReindexHandlers registers the reindex handlers.
+func RegisterReindexHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
+	router.Handle("/_reindex", &ReindexHandler{indexManager}).Methods("POST")
+	return nil
+}
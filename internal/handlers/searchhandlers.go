@@ -2,10 +2,13 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/calebpalmer/simpleftsservice/pkg/fts"
 	"github.com/gorilla/mux"
@@ -22,97 +25,224 @@ func (sh *SearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		sh.getSearchHandler(w, req)
 		return
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w)
 		return
 	}
 }
 
-func (sh *SearchHandler) getSearchHandler(w http.ResponseWriter, req *http.Request) {
-	indexId := mux.Vars(req)["indexId"]
-	value := req.FormValue("value")
-	wantDocuments := req.FormValue("documents") == "y"
+// searchParams are the parameters of a search request.
+type searchParams struct {
+	value         string
+	wantDocuments bool
+	explain       bool
+	operator      fts.Operator
+}
 
-	extra := ""
-	if wantDocuments {
-		extra = "wantDocuments"
+// parseSearchParams reads the parameters of a search request.
+func parseSearchParams(req *http.Request) (searchParams, error) {
+	operator, err := fts.ParseOperator(req.FormValue("operator"))
+	if err != nil {
+		return searchParams{}, err
 	}
 
-	if sh.IndexManager.Cache != nil {
-		item, err := sh.IndexManager.Cache.Get(indexId, value, extra)
-		if err != nil {
-			writeInternalServerError(w, err)
-		}
+	return searchParams{
+		value:         req.FormValue("value"),
+		wantDocuments: req.FormValue("documents") == "y",
+		explain:       req.FormValue("explain") == "true",
+		operator:      operator,
+	}, nil
+}
 
-		if item != nil {
-			if os.Getenv("DEBUG") != "" {
-				log.Println("Cache hit!")
-			}
+// cacheQuery returns the search value normalized to the terms searched, so
+// searches for the same terms share cache entries however they're written.
+// The order of the terms doesn't change the results so they are sorted.
+func (p searchParams) cacheQuery(index *fts.Index) string {
+	terms := index.QueryTerms(p.value)
+	sort.Strings(terms)
+	return strings.Join(terms, " ")
+}
 
-			fmt.Fprint(w, string(item))
-			return
-		}
+// cacheExtra returns the parameters other than the search value that change
+// the response.
+func (p searchParams) cacheExtra() string {
+	extra := ""
+	if p.wantDocuments {
+		extra = "wantDocuments"
+	}
+	if p.operator != fts.OperatorOr {
+		extra += string(p.operator)
+	}
+	return extra
+}
 
-		if os.Getenv("DEBUG") != "" {
-			log.Println("Cache miss!")
-		}
+func (sh *SearchHandler) getSearchHandler(w http.ResponseWriter, req *http.Request) {
+	indexId := mux.Vars(req)["indexId"]
+	params, err := parseSearchParams(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
 	}
+	extra := params.cacheExtra()
 
-	// get the index
+	// get the index.  The cache is keyed on the resolved index so results
+	// don't survive an alias being repointed.
 	index, ok := sh.IndexManager.GetIndex(indexId)
 	if !ok {
-		msg, _ := json.Marshal(map[string]string{"error": "IndexNotFound"})
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, string(msg))
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
 		return
 	}
 
-	ids := index.SearchValue(value)
+	// explanations are for debugging so they bypass the cache and aren't
+	// coalesced
+	useCache := sh.IndexManager.Cache != nil && !params.explain
+
+	start := time.Now()
+	cacheResult := "none"
+	defer func() {
+		searchDuration.Observe(time.Since(start).Seconds(), string(params.operator), strconv.FormatBool(params.wantDocuments), cacheResult)
+	}()
+
+	// the generation is read before searching so a change made during the
+	// search can't leave its results cached as current
+	generation := index.CacheGeneration()
+
+	query := params.cacheQuery(index)
 
 	w.Header().Set("Content-Type", "application/json")
 
-	if wantDocuments {
-		// get documents instead of ids
-		docs := []interface{}{}
-		for _, id := range ids {
-			doc, ok := index.GetDocument(id)
-			if !ok {
-				log.Printf("Document %s does not exist.", id)
-				continue
+	if useCache {
+		item, err := sh.IndexManager.Cache.Get(index.Id, generation, query, extra)
+		if err != nil {
+			// the search is still answered, just without the cache
+			requestLogger(req).Warn("reading cache", "index", index.Id, "error", err)
+		}
+
+		if item != nil {
+			cacheResult = "hit"
+			requestLogger(req).Debug("cache hit", "index", index.Id)
+
+			fmt.Fprint(w, string(item))
+			return
+		}
+
+		cacheResult = "miss"
+		requestLogger(req).Debug("cache miss", "index", index.Id)
+	}
+
+	search := func() ([]byte, error) {
+		ids := index.Search(params.value, params.operator)
+
+		var explanations map[string]fts.Explanation
+		if params.explain {
+			explanations = make(map[string]fts.Explanation, len(ids))
+			for _, id := range ids {
+				result, err := index.Explain(id, params.value, params.operator)
+				if err != nil {
+					requestLogger(req).Warn("explaining document", "index", index.Id, "documentId", id, "error", err)
+					continue
+				}
+				explanations[id] = result.Explanation
 			}
-			docJson, err := doc.Json()
-			if err != nil {
-				writeInternalServerError(w, err)
+		}
+
+		var results map[string]interface{}
+		if params.wantDocuments {
+			// get documents instead of ids
+			docs := []interface{}{}
+			for _, id := range ids {
+				doc, ok := index.GetDocument(id)
+				if !ok {
+					requestLogger(req).Warn("search result missing document", "index", index.Id, "documentId", id)
+					continue
+				}
+				docJson, err := doc.Json()
+				if err != nil {
+					return nil, err
+				}
+				docs = append(docs, docJson)
 			}
-			docs = append(docs, docJson)
+			results = map[string]interface{}{"results": docs}
+		} else {
+			results = map[string]interface{}{"results": ids}
 		}
-		response, err := json.Marshal(map[string]interface{}{"results": docs})
-		if err != nil {
-			writeInternalServerError(w, err)
-			return
+		if params.explain {
+			results["explanations"] = explanations
 		}
 
-		fmt.Fprint(w, string(response))
-		if sh.IndexManager.Cache != nil {
-			err = sh.IndexManager.Cache.Add(indexId, value, extra, response)
+		response, err := json.Marshal(results)
+		if err != nil {
+			return nil, err
 		}
 
-	} else {
-		response, _ := json.Marshal(map[string][]string{"results": ids})
-		fmt.Fprint(w, string(response))
-		if sh.IndexManager.Cache != nil {
-			err := sh.IndexManager.Cache.Add(indexId, value, extra, response)
+		if useCache {
+			err = sh.IndexManager.Cache.Add(index.Id, generation, query, extra, response)
 			if err != nil {
-				fmt.Errorf("Error adding to cache: %v", err)
+				requestLogger(req).Warn("adding to cache", "index", index.Id, "error", err)
 			}
 		}
+		return response, nil
 	}
 
+	var response []byte
+	if params.explain {
+		response, err = search()
+	} else {
+		// identical concurrent searches, common while the cache is cold, run
+		// once and share the response
+		response, err = index.CoalesceSearch(strings.Join([]string{generation, query, extra}, "\x00"), search)
+	}
+	if err != nil {
+		writeInternalServerError(w, err)
+		return
+	}
+
+	fmt.Fprint(w, string(response))
+}
+
+// ExplainHandler represents the handler for explaining how a document matches a search.
+type ExplainHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the explain entity.
+func (eh *ExplainHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		eh.getExplainHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+func (eh *ExplainHandler) getExplainHandler(w http.ResponseWriter, req *http.Request) {
+	index, ok := eh.IndexManager.GetIndex(mux.Vars(req)["indexId"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, CodeIndexNotFound, "Index not found.")
+		return
+	}
+
+	operator, err := fts.ParseOperator(req.FormValue("operator"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := index.Explain(mux.Vars(req)["documentId"], req.FormValue("value"), operator)
+	switch {
+	case errors.Is(err, fts.ErrDocumentNotFound):
+		writeJsonError(w, http.StatusNotFound, CodeDocumentNotFound, "Document not found.")
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		writeJson(w, http.StatusOK, result)
+	}
 }
 
 // RegisterDocumentsesHandlers registers the index handlers.
 func RegisterSearchHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
 	router.Handle("/indexes/{indexId}/search", &SearchHandler{indexManager}).
 		Methods("GET")
+	router.Handle("/indexes/{indexId}/_explain/{documentId}", &ExplainHandler{indexManager}).
+		Methods("GET")
 	return nil
 }
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/calebpalmer/simpleftsservice/internal/cache"
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+)
+
+func TestCacheQueryNormalizesSearches(t *testing.T) {
+	index := fts.MakeIndex("books", []string{"title"})
+	lru := cache.NewLRU(1<<20, cache.Options{KeyPrefix: cache.DefaultKeyPrefix, MaxItemBytes: cache.DefaultMaxItemBytes})
+
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"case", "Hobbit", "hobbit", true},
+		{"punctuation and spacing", "  hobbit,   ring! ", "hobbit ring", true},
+		{"stopwords", "the hobbit", "hobbit", true},
+		{"repeated terms", "ring ring hobbit", "hobbit ring", true},
+		{"term order", "ring hobbit", "hobbit ring", true},
+		{"different terms", "hobbit", "ring", false},
+		{"extra term", "hobbit", "hobbit ring", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the generation keeps the cases apart
+			a := searchParams{value: test.a}.cacheQuery(&index)
+			if err := lru.Add(index.Id, test.name, a, "", []byte(`{"results":[]}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			b := searchParams{value: test.b}.cacheQuery(&index)
+			cached, err := lru.Get(index.Id, test.name, b, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (cached != nil) != test.same {
+				t.Errorf("%q cached as %q and %q as %q, want the same entry: %t", test.a, a, test.b, b, test.same)
+			}
+		})
+	}
+}
+
+func TestExplainOperator(t *testing.T) {
+	router, indexManager := newDocumentsRouter(t, fts.NewMemoryStorage())
+	if err := RegisterSearchHandlers(router, indexManager); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		code    string
+		matched bool
+	}{
+		{name: "or", query: "value=hobbit+ring", status: http.StatusOK, matched: true},
+		{name: "and", query: "value=hobbit+ring&operator=and", status: http.StatusOK},
+		{name: "and with every term", query: "value=the+hobbit&operator=AND", status: http.StatusOK, matched: true},
+		{name: "invalid operator", query: "value=hobbit&operator=xor", status: http.StatusBadRequest, code: CodeInvalidOperator},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(router, http.MethodGet, "/indexes/books/_explain/1?"+test.query, "")
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if test.code != "" {
+				if code := errorCodeOf(t, w); code != test.code {
+					t.Errorf("code = %q, want %q", code, test.code)
+				}
+				return
+			}
+			var result fts.ExplainResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Matched != test.matched {
+				t.Errorf("matched = %t, want %t", result.Matched, test.matched)
+			}
+		})
+	}
+}
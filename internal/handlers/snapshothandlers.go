@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+// SnapshotHandler represents the handler for creating snapshots.
+type SnapshotHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// RestoreHandler represents the handler for restoring snapshots.
+type RestoreHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the snapshot entity.
+func (h *SnapshotHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		h.postSnapshotHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// postSnapshotHandler archives the requested indexes, or all of them when the
+// body is empty, and returns the snapshot once it is complete.
+func (h *SnapshotHandler) postSnapshotHandler(w http.ResponseWriter, req *http.Request) {
+	var request fts.SnapshotRequest
+	if err := decodeOptionalJson(req, &request); err != nil {
+		writeInvalidJson(w, req, err)
+		return
+	}
+
+	info, err := h.IndexManager.Snapshot(mux.Vars(req)["name"], request)
+	switch {
+	case errors.Is(err, fts.ErrIndexNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, fts.ErrSnapshotExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, fts.ErrInvalidSnapshot):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		writeJson(w, http.StatusOK, map[string]fts.SnapshotInfo{"snapshot": info})
+	}
+}
+
+// ServeHTTP is the handler for the snapshot restore entity.
+func (h *RestoreHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		h.postRestoreHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// postRestoreHandler restores the requested indexes of a snapshot, or all of
+// them when the body is empty.
+func (h *RestoreHandler) postRestoreHandler(w http.ResponseWriter, req *http.Request) {
+	var request fts.RestoreRequest
+	if err := decodeOptionalJson(req, &request); err != nil {
+		writeInvalidJson(w, req, err)
+		return
+	}
+
+	ids, err := h.IndexManager.Restore(mux.Vars(req)["name"], request)
+	switch {
+	case errors.Is(err, fts.ErrSnapshotNotFound), errors.Is(err, fts.ErrIndexNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, fts.ErrIndexExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, fts.ErrInvalidSnapshot):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		writeInternalServerError(w, err)
+	default:
+		writeJson(w, http.StatusOK, map[string][]string{"indexes": ids})
+	}
+}
+
+// decodeOptionalJson decodes the request body into value unless it is empty.
+func decodeOptionalJson(req *http.Request, value interface{}) error {
+	err := json.NewDecoder(req.Body).Decode(value)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// RegisterSnapshotHandlers registers the snapshot handlers.
+func RegisterSnapshotHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
+	router.Handle("/_snapshot/{name}", &SnapshotHandler{indexManager}).Methods("POST")
+	router.Handle("/_snapshot/{name}/_restore", &RestoreHandler{indexManager}).Methods("POST")
+	return nil
+}
@@ -16,14 +16,16 @@ type GetStatusHandler struct{}
 
 func (h *GetStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.URL.Path != "/status" {
-		http.NotFound(w, req)
+		writeJsonError(w, http.StatusNotFound, CodeNotFound, "Not found.")
 		return
 	}
 
 	resp, err := json.Marshal(Status{"ok"})
 	if err != nil {
-		panic(err)
+		writeInternalServerError(w, err)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprint(w, string(resp))
 }
 
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/calebpalmer/simpleftsservice/pkg/fts"
+	"github.com/gorilla/mux"
+)
+
+// TasksHandler represents the handler for background tasks.
+type TasksHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for the tasks entities.
+func (h *TasksHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		writeJson(w, http.StatusOK, map[string][]fts.TaskInfo{"tasks": h.IndexManager.Tasks.List()})
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// TaskHandler represents the handler for a background task.
+type TaskHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for a task entity.
+func (h *TaskHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		h.getTaskHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// getTaskHandler returns the progress of a task.
+func (h *TaskHandler) getTaskHandler(w http.ResponseWriter, req *http.Request) {
+	task, ok := h.IndexManager.Tasks.Get(mux.Vars(req)["taskId"])
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, CodeTaskNotFound, "Task not found.")
+		return
+	}
+
+	writeJson(w, http.StatusOK, task.Info())
+}
+
+// TaskCancelHandler represents the handler for cancelling a background task.
+type TaskCancelHandler struct {
+	IndexManager *fts.IndexManager
+}
+
+// ServeHTTP is the handler for cancelling a task.
+func (h *TaskCancelHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		h.postTaskCancelHandler(w, req)
+	default:
+		writeMethodNotAllowed(w)
+	}
+}
+
+// postTaskCancelHandler requests cancellation of a task.  Cancellation happens
+// asynchronously so the task may still be running when this returns.
+func (h *TaskCancelHandler) postTaskCancelHandler(w http.ResponseWriter, req *http.Request) {
+	taskId := mux.Vars(req)["taskId"]
+	if !h.IndexManager.Tasks.Cancel(taskId) {
+		writeJsonError(w, http.StatusNotFound, CodeTaskNotFound, "Task not found.")
+		return
+	}
+
+	task, _ := h.IndexManager.Tasks.Get(taskId)
+	writeJson(w, http.StatusAccepted, task.Info())
+}
+
+// RegisterTasksHandlers registers the task handlers.
+func RegisterTasksHandlers(router *mux.Router, indexManager *fts.IndexManager) error {
+	router.Handle("/_tasks", &TasksHandler{indexManager}).Methods("GET")
+	router.Handle("/_tasks/{taskId}", &TaskHandler{indexManager}).Methods("GET")
+	router.Handle("/_tasks/{taskId}/_cancel", &TaskCancelHandler{indexManager}).Methods("POST")
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package logging sets up the structured logger of the service and carries
+// request scoped loggers in contexts.
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/calebpalmer/simpleftsservice/internal/config"
+)
+
+var ErrInvalidConfig = errors.New("invalid logging config")
+
+// contextKey is the key of the logger in a context.
+type contextKey struct{}
+
+// New returns a logger writing to w as described by the logging config.  The
+// level is info unless configured, or debug when the DEBUG environment
+// variable is set.
+func New(config config.LoggingConfig, w io.Writer) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if os.Getenv("DEBUG") != "" {
+		level = slog.LevelDebug
+	}
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return nil, fmt.Errorf("%w: level %q must be debug, info, warn or error", ErrInvalidConfig, config.Level)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(config.Format) {
+	case "", "text", "logfmt":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	default:
+		return nil, fmt.Errorf("%w: format %q must be json or text", ErrInvalidConfig, config.Format)
+	}
+}
+
+// WithLogger returns a context carrying logger.
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
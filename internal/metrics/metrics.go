@@ -0,0 +1,201 @@
+// Package metrics collects counters and histograms and writes them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histogram
+// buckets, from a millisecond to ten seconds.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Label is the name and value of a label of a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// WriteHeader writes the help and type lines of a metric.
+func WriteHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// WriteSample writes a sample of a series.
+func WriteSample(w io.Writer, name string, labels []Label, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+// formatLabels formats labels as {name="value",...}, or nothing when there
+// are none.
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(labels))
+	for j, label := range labels {
+		parts[j] = fmt.Sprintf(`%s="%s"`, label.Name, escape.Replace(label.Value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatValue formats a sample value.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// seriesKey identifies the series of a metric with the given label values.
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// labels pairs label names with values.
+func labels(names []string, values []string) []Label {
+	r := make([]Label, len(names))
+	for j, name := range names {
+		r[j] = Label{name, values[j]}
+	}
+	return r
+}
+
+// Counter is a count that only goes up, with a series for each combination
+// of label values.
+type Counter struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	series     map[string]*counterSeries
+}
+
+// counterSeries is the count of a combination of label values.
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounter returns a counter with the given label names.
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{name: name, help: help, labelNames: labelNames, series: make(map[string]*counterSeries)}
+}
+
+// Inc adds one to the series with labelValues, given in the order of the
+// label names.
+func (c *Counter) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := seriesKey(labelValues)
+	series, ok := c.series[key]
+	if !ok {
+		series = &counterSeries{labelValues: labelValues}
+		c.series[key] = series
+	}
+	series.value++
+}
+
+// Write writes the counter.
+func (c *Counter) Write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	WriteHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := c.series[key]
+		WriteSample(w, c.name, labels(c.labelNames, series.labelValues), series.value)
+	}
+}
+
+// Histogram counts observations in buckets, with a series for each
+// combination of label values.
+type Histogram struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+// histogramSeries are the buckets of a combination of label values.
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+// NewHistogram returns a histogram with buckets, the sorted upper bounds of
+// the buckets, and the given label names.
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{name: name, help: help, buckets: buckets, labelNames: labelNames, series: make(map[string]*histogramSeries)}
+}
+
+// Observe records a value in the series with labelValues, given in the order
+// of the label names.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := seriesKey(labelValues)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+
+	if j := sort.SearchFloat64s(h.buckets, value); j < len(h.buckets) {
+		series.counts[j]++
+	}
+	series.count++
+	series.sum += value
+}
+
+// Write writes the histogram.
+func (h *Histogram) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	WriteHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+		seriesLabels := labels(h.labelNames, series.labelValues)
+
+		cumulative := uint64(0)
+		for j, bound := range h.buckets {
+			cumulative += series.counts[j]
+			WriteSample(w, h.name+"_bucket", append(seriesLabels, Label{"le", formatValue(bound)}), float64(cumulative))
+		}
+		WriteSample(w, h.name+"_bucket", append(seriesLabels, Label{"le", "+Inf"}), float64(series.count))
+		WriteSample(w, h.name+"_sum", seriesLabels, series.sum)
+		WriteSample(w, h.name+"_count", seriesLabels, float64(series.count))
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"io"
+	"runtime"
+)
+
+// WriteRuntime writes statistics of the Go runtime: goroutines, memory and
+// garbage collection.
+func WriteRuntime(w io.Writer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	WriteHeader(w, "go_info", "Information about the Go environment.", "gauge")
+	WriteSample(w, "go_info", []Label{{"version", runtime.Version()}}, 1)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine())},
+		{"go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", float64(stats.Alloc)},
+		{"go_memstats_sys_bytes", "Number of bytes obtained from the system.", float64(stats.Sys)},
+		{"go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(stats.HeapInuse)},
+		{"go_memstats_heap_objects", "Number of allocated objects.", float64(stats.HeapObjects)},
+		{"go_memstats_next_gc_bytes", "Number of heap bytes when the next garbage collection will take place.", float64(stats.NextGC)},
+		{"go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of the last garbage collection.", float64(stats.LastGC) / 1e9},
+	}
+	for _, gauge := range gauges {
+		WriteHeader(w, gauge.name, gauge.help, "gauge")
+		WriteSample(w, gauge.name, nil, gauge.value)
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.", float64(stats.TotalAlloc)},
+		{"go_memstats_mallocs_total", "Total number of allocations.", float64(stats.Mallocs)},
+		{"go_memstats_frees_total", "Total number of frees.", float64(stats.Frees)},
+		{"go_gc_cycles_total", "Number of completed garbage collection cycles.", float64(stats.NumGC)},
+		{"go_gc_pause_seconds_total", "Total time the world was stopped for garbage collection.", float64(stats.PauseTotalNs) / 1e9},
+	}
+	for _, counter := range counters {
+		WriteHeader(w, counter.name, counter.help, "counter")
+		WriteSample(w, counter.name, nil, counter.value)
+	}
+}
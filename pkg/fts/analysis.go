@@ -0,0 +1,74 @@
+package fts
+
+import (
+	"fmt"
+)
+
+const (
+	LowercaseFilter = "lowercase"
+	StopwordsFilter = "stopwords"
+)
+
+// Analysis describes how text is turned into terms.  A nil Analysis uses the
+// default chain of lowercasing followed by stopword removal.
+type Analysis struct {
+	// Filters is the ordered list of filters applied to tokens.  When nil the
+	// default chain is used, an empty list disables filtering.
+	Filters []string `json:"filters"`
+	// Stopwords replaces the default stopword list when set.
+	Stopwords []string `json:"stopwords,omitempty"`
+}
+
+// Validate checks that the analysis settings can be used.
+func (a *Analysis) Validate() error {
+	if a == nil {
+		return nil
+	}
+
+	for _, filter := range a.Filters {
+		if filter != LowercaseFilter && filter != StopwordsFilter {
+			return fmt.Errorf("Unknown analysis filter %s", filter)
+		}
+	}
+
+	return nil
+}
+
+// analyzer turns text into terms according to an Analysis.  The zero value is
+// the default analyzer.
+type analyzer struct {
+	filters   []string
+	stopwords map[string]struct{}
+}
+
+// newAnalyzer compiles analysis settings.
+func newAnalyzer(a *Analysis) *analyzer {
+	if a == nil || (a.Filters == nil && a.Stopwords == nil) {
+		return &analyzer{}
+	}
+
+	an := &analyzer{filters: a.Filters}
+	if an.filters == nil {
+		an.filters = []string{LowercaseFilter, StopwordsFilter}
+	}
+
+	if a.Stopwords != nil {
+		an.stopwords = make(map[string]struct{}, len(a.Stopwords))
+		for _, word := range a.Stopwords {
+			an.stopwords[word] = struct{}{}
+		}
+	}
+
+	return an
+}
+
+// tokens returns the terms for text, which are the terms of its analyzed
+// tokens.
+func (an *analyzer) tokens(text string) []string {
+	analyzed := an.analyze(text)
+	terms := make([]string, len(analyzed))
+	for j, token := range analyzed {
+		terms[j] = token.Term
+	}
+	return terms
+}
@@ -0,0 +1,148 @@
+package fts
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var ErrDocumentNotFound = errors.New("document not found")
+
+// Token is a term produced by analysis along with where it came from.
+// Offsets are byte offsets into the analyzed text.
+type Token struct {
+	Term        string `json:"term"`
+	Position    int    `json:"position"`
+	StartOffset int    `json:"startOffset"`
+	EndOffset   int    `json:"endOffset"`
+}
+
+// TermVector describes the occurrences of a term in a document field.
+type TermVector struct {
+	Term    string  `json:"term"`
+	Freq    int     `json:"freq"`
+	DocFreq int     `json:"docFreq"`
+	Tokens  []Token `json:"tokens"`
+}
+
+// TermVectors are the terms a document produced for each search property.
+type TermVectors struct {
+	Id     string                  `json:"id"`
+	Fields map[string][]TermVector `json:"fields"`
+}
+
+// tokenizeWithOffsets splits text the same way as tokenize but keeps track of
+// where each token came from.
+func tokenizeWithOffsets(text string) []Token {
+	tokens := make([]Token, 0)
+	start := -1
+	for offset, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if start < 0 {
+				start = offset
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, Token{text[start:offset], len(tokens), start, offset})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, Token{text[start:], len(tokens), start, len(text)})
+	}
+	return tokens
+}
+
+// analyze returns the tokens for text.  Tokens removed by a filter leave a gap
+// in the positions.
+func (an *analyzer) analyze(text string) []Token {
+	filters := an.filters
+	if filters == nil {
+		filters = []string{LowercaseFilter, StopwordsFilter}
+	}
+	words := an.stopwords
+	if words == nil {
+		words = stopwords
+	}
+
+	tokens := tokenizeWithOffsets(text)
+	for _, filter := range filters {
+		switch filter {
+		case LowercaseFilter:
+			for j := range tokens {
+				tokens[j].Term = strings.ToLower(tokens[j].Term)
+			}
+		case StopwordsFilter:
+			r := make([]Token, 0, len(tokens))
+			for _, token := range tokens {
+				if _, ok := words[token.Term]; !ok {
+					r = append(r, token)
+				}
+			}
+			tokens = r
+		}
+	}
+	return tokens
+}
+
+// Analyze runs text through the index's analysis chain, or through analysis
+// when it is not nil.
+func (i *Index) Analyze(text string, analysis *Analysis) []Token {
+	if analysis != nil {
+		return newAnalyzer(analysis).analyze(text)
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.getAnalyzer().analyze(text)
+}
+
+// TermVectors returns the terms a stored document produces for each of the
+// index's search properties.
+func (i *Index) TermVectors(documentId string) (TermVectors, error) {
+	document, ok := i.GetDocument(documentId)
+	if !ok {
+		return TermVectors{}, fmt.Errorf("%w: %s", ErrDocumentNotFound, documentId)
+	}
+
+	contents, err := document.Contents()
+	if err != nil {
+		return TermVectors{}, err
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	vectors := TermVectors{Id: documentId, Fields: make(map[string][]TermVector)}
+	for _, property := range i.SearchProperties {
+		value, ok := contents[property].(string)
+		if !ok {
+			continue
+		}
+
+		byTerm := make(map[string]*TermVector)
+		terms := make([]TermVector, 0)
+		for _, token := range i.getAnalyzer().analyze(value) {
+			vector, ok := byTerm[token.Term]
+			if !ok {
+				vector = &TermVector{Term: token.Term, DocFreq: i.postings.docFreq(token.Term)}
+				byTerm[token.Term] = vector
+			}
+			vector.Freq++
+			vector.Tokens = append(vector.Tokens, token)
+		}
+		for _, vector := range byTerm {
+			terms = append(terms, *vector)
+		}
+		sort.Slice(terms, func(a, b int) bool {
+			return terms[a].Term < terms[b].Term
+		})
+		vectors.Fields[property] = terms
+	}
+
+	return vectors, nil
+}
@@ -0,0 +1,105 @@
+package fts
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name     string
+		analysis *Analysis
+		text     string
+		want     []Token
+	}{
+		{"empty", nil, "", []Token{}},
+		{"offsets", nil, "  Dune, Messiah!", []Token{
+			{"dune", 0, 2, 6},
+			{"messiah", 1, 8, 15},
+		}},
+		{"multibyte offsets", nil, "Ünïcödé café", []Token{
+			{"ünïcödé", 0, 0, 11},
+			{"café", 1, 12, 17},
+		}},
+		{"stopwords leave gaps", nil, "The Lord of the Rings", []Token{
+			{"lord", 1, 4, 8},
+			{"rings", 4, 16, 21},
+		}},
+		{"no filters", &Analysis{Filters: []string{}}, "The Hobbit", []Token{
+			{"The", 0, 0, 3},
+			{"Hobbit", 1, 4, 10},
+		}},
+		{"stopwords before lowercase", &Analysis{Filters: []string{StopwordsFilter, LowercaseFilter}}, "The hobbit and the ring", []Token{
+			{"the", 0, 0, 3},
+			{"hobbit", 1, 4, 10},
+			{"ring", 4, 19, 23},
+		}},
+		{"custom stopwords", &Analysis{Stopwords: []string{"lord", "rings"}}, "The Lord of the Rings", []Token{
+			{"the", 0, 0, 3},
+			{"of", 2, 9, 11},
+			{"the", 3, 12, 15},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			an := newAnalyzer(test.analysis)
+			tokens := an.analyze(test.text)
+			if !reflect.DeepEqual(tokens, test.want) {
+				t.Errorf("analyze = %v, want %v", tokens, test.want)
+			}
+			for _, token := range tokens {
+				if text := test.text[token.StartOffset:token.EndOffset]; !strings.EqualFold(text, token.Term) {
+					t.Errorf("token %s has the offsets of %q", token.Term, text)
+				}
+			}
+
+			// the terms indexed are the terms of the analyzed tokens
+			terms := make([]string, 0, len(test.want))
+			for _, token := range test.want {
+				terms = append(terms, token.Term)
+			}
+			if got := an.tokens(test.text); !reflect.DeepEqual(got, terms) {
+				t.Errorf("tokens = %v, want %v", got, terms)
+			}
+		})
+	}
+}
+
+func TestIndexAnalyze(t *testing.T) {
+	index := MakeIndex("books", []string{"title"})
+	index.Analysis = &Analysis{Filters: []string{LowercaseFilter}}
+
+	if tokens := index.Analyze("The Hobbit", nil); !reflect.DeepEqual(tokens, []Token{{"the", 0, 0, 3}, {"hobbit", 1, 4, 10}}) {
+		t.Errorf("index analysis = %v", tokens)
+	}
+	if tokens := index.Analyze("The Hobbit", &Analysis{}); !reflect.DeepEqual(tokens, []Token{{"hobbit", 1, 4, 10}}) {
+		t.Errorf("default analysis = %v", tokens)
+	}
+}
+
+func TestTermVectors(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	index, _ := indexManager.GetIndex("books")
+	if _, err := index.AddDocument("2", map[string]interface{}{"title": "The Ring and the Ring-bearer", "pages": float64(412)}); err != nil {
+		t.Fatal(err)
+	}
+
+	vectors, err := index.TermVectors("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TermVector{
+		{Term: "bearer", Freq: 1, DocFreq: 1, Tokens: []Token{{"bearer", 5, 22, 28}}},
+		{Term: "ring", Freq: 2, DocFreq: 1, Tokens: []Token{{"ring", 1, 4, 8}, {"ring", 4, 17, 21}}},
+	}
+	if !reflect.DeepEqual(vectors.Fields["title"], want) || len(vectors.Fields) != 1 {
+		t.Errorf("term vectors = %+v, want %+v", vectors.Fields, want)
+	}
+
+	if _, err := index.TermVectors("3"); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("TermVectors of a missing document = %v, want %v", err, ErrDocumentNotFound)
+	}
+}
@@ -0,0 +1,80 @@
+package fts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filePerm is the permission used for persisted files.
+const filePerm = 0644
+
+// tmpSuffix marks the temporary files created by writeFileAtomic.
+const tmpSuffix = ".tmp"
+
+// writeFileAtomic replaces the file at path with data.  The data is written to
+// a temporary file in the same directory, synced and then renamed over path so
+// a crash leaves either the old or the new contents, never a partial write.
+// Without sync the data and rename are left for the operating system to flush.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, sync bool) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if sync {
+		if err = tmp.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if !sync {
+		return nil
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes a directory so renames and removals in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// isTmpFile returns true for leftovers of an interrupted write.  Document files
+// from before the document store always end in .json so a document id can't
+// be mistaken for one.
+func isTmpFile(name string) bool {
+	return strings.Contains(name, tmpSuffix) && !strings.HasSuffix(name, ".json")
+}
+
+// checksum returns the hex encoded sha256 of data.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,387 @@
+package fts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltPageSize is the size of the pages files are split into.  Writing to a
+// file only rewrites the pages it touches.
+const boltPageSize = 64 << 10
+
+var (
+	boltFilesBucket = []byte("files")
+	boltPagesBucket = []byte("pages")
+)
+
+// BoltStorage keeps files in a bbolt database, a single file holding a
+// transactional key value store.  The files bucket maps each file name to its
+// size and the pages bucket holds the contents as pages keyed by the file
+// name, a zero byte and the big endian page number.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// OpenBoltStorage opens the bbolt database at path as a Storage, creating it
+// with perm, or 0644 when it is zero, if it doesn't exist.  Commits are only
+// flushed to disk when the fsync policy isn't FsyncNever.
+func OpenBoltStorage(path string, perm os.FileMode, fsync FsyncPolicy) (*BoltStorage, error) {
+	if perm == 0 {
+		perm = filePerm
+	}
+	db, err := bolt.Open(path, perm, &bolt.Options{Timeout: time.Second, NoSync: fsync == FsyncNever})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltFilesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltPagesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{db: db}, nil
+}
+
+// pageKey returns the key of a page of a file.
+func pageKey(name string, page int64) []byte {
+	key := make([]byte, len(name)+9)
+	copy(key, name)
+	binary.BigEndian.PutUint64(key[len(name)+1:], uint64(page))
+	return key
+}
+
+// fileSize returns the size of a file and false if it doesn't exist.
+func fileSize(tx *bolt.Tx, name string) (int64, bool) {
+	value := tx.Bucket(boltFilesBucket).Get([]byte(name))
+	if value == nil {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(value)), true
+}
+
+// putFileSize records the size of a file, creating it if needed.
+func putFileSize(tx *bolt.Tx, name string, size int64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(size))
+	return tx.Bucket(boltFilesBucket).Put([]byte(name), value)
+}
+
+// deletePages deletes the pages of a file from page onwards.
+func deletePages(tx *bolt.Tx, name string, page int64) error {
+	pages := tx.Bucket(boltPagesBucket)
+	prefix := append([]byte(name), 0)
+
+	keys := make([][]byte, 0)
+	c := pages.Cursor()
+	for k, _ := c.Seek(pageKey(name, page)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err := pages.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteFile deletes a file and its pages.
+func deleteFile(tx *bolt.Tx, name string) error {
+	if err := tx.Bucket(boltFilesBucket).Delete([]byte(name)); err != nil {
+		return err
+	}
+	return deletePages(tx, name, 0)
+}
+
+func (s *BoltStorage) ReadFile(name string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		size, ok := fileSize(tx, name)
+		if !ok {
+			return notExist("read", name)
+		}
+
+		data = make([]byte, size)
+		pages := tx.Bucket(boltPagesBucket)
+		for page := int64(0); page*boltPageSize < size; page++ {
+			copy(data[page*boltPageSize:], pages.Get(pageKey(name, page)))
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (s *BoltStorage) WriteFile(name string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteFile(tx, name); err != nil {
+			return err
+		}
+
+		pages := tx.Bucket(boltPagesBucket)
+		for page := int64(0); page*boltPageSize < int64(len(data)); page++ {
+			end := (page + 1) * boltPageSize
+			if end > int64(len(data)) {
+				end = int64(len(data))
+			}
+			if err := pages.Put(pageKey(name, page), data[page*boltPageSize:end]); err != nil {
+				return err
+			}
+		}
+		return putFileSize(tx, name, int64(len(data)))
+	})
+}
+
+func (s *BoltStorage) OpenFile(name string) (File, error) {
+	var size int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var ok bool
+		if size, ok = fileSize(tx, name); ok {
+			return nil
+		}
+		return putFileSize(tx, name, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltFile{db: s.db, name: name, size: size, floor: size, dirty: make(map[int64][]byte)}, nil
+}
+
+func (s *BoltStorage) Rename(oldName string, newName string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		size, ok := fileSize(tx, oldName)
+		if !ok {
+			return notExist("rename", oldName)
+		}
+		if err := deleteFile(tx, newName); err != nil {
+			return err
+		}
+
+		pages := tx.Bucket(boltPagesBucket)
+		for page := int64(0); page*boltPageSize < size; page++ {
+			if data := pages.Get(pageKey(oldName, page)); data != nil {
+				if err := pages.Put(pageKey(newName, page), append([]byte(nil), data...)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := putFileSize(tx, newName, size); err != nil {
+			return err
+		}
+		return deleteFile(tx, oldName)
+	})
+}
+
+func (s *BoltStorage) Remove(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, ok := fileSize(tx, name); !ok {
+			return notExist("remove", name)
+		}
+		return deleteFile(tx, name)
+	})
+}
+
+func (s *BoltStorage) RemoveAll(dir string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		prefix := []byte(dirPrefix(dir))
+		names := make([]string, 0)
+		c := tx.Bucket(boltFilesBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			names = append(names, string(k))
+		}
+
+		for _, name := range names {
+			if err := deleteFile(tx, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) List(dir string) ([]FileInfo, error) {
+	files := make([]FileInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(dirPrefix(dir))
+		c := tx.Bucket(boltFilesBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if inDir(string(k), dir) {
+				files = append(files, FileInfo{Name: string(k[len(prefix):]), Size: int64(binary.BigEndian.Uint64(v))})
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// boltFile is an open file of a BoltStorage.  Written pages are kept in
+// memory until Sync commits them in a single transaction.
+type boltFile struct {
+	db    *bolt.DB
+	name  string
+	mu    sync.Mutex
+	size  int64
+	floor int64 // the smallest size since the last sync, past which stored pages are stale
+	dirty map[int64][]byte
+}
+
+// page returns the contents of a page up to the size of the file, reading it
+// from the database unless it has been written since the last sync.  The
+// caller must hold the lock.
+func (f *boltFile) page(tx *bolt.Tx, page int64) []byte {
+	start := page * boltPageSize
+	length := f.size - start
+	if length > boltPageSize {
+		length = boltPageSize
+	}
+
+	if data, ok := f.dirty[page]; ok {
+		// the file may have grown since the page was written
+		if int64(len(data)) < length {
+			data = append(data, make([]byte, length-int64(len(data)))...)
+			f.dirty[page] = data
+		}
+		return data
+	}
+
+	data := make([]byte, length)
+	stored := tx.Bucket(boltPagesBucket).Get(pageKey(f.name, page))
+	if valid := f.floor - start; valid < int64(len(stored)) {
+		if valid < 0 {
+			valid = 0
+		}
+		stored = stored[:valid]
+	}
+	copy(data, stored)
+	return data
+}
+
+func (f *boltFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	err := f.db.View(func(tx *bolt.Tx) error {
+		for n < len(p) && off+int64(n) < f.size {
+			pos := off + int64(n)
+			data := f.page(tx, pos/boltPageSize)
+			n += copy(p[n:], data[pos%boltPageSize:])
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *boltFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := off + int64(len(p)); end > f.size {
+		f.size = end
+	}
+
+	n := 0
+	err := f.db.View(func(tx *bolt.Tx) error {
+		for n < len(p) {
+			pos := off + int64(n)
+			page := pos / boltPageSize
+			data := f.page(tx, page)
+			n += copy(data[pos%boltPageSize:], p[n:])
+			f.dirty[page] = data
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (f *boltFile) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.size, nil
+}
+
+func (f *boltFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for page, data := range f.dirty {
+		start := page * boltPageSize
+		switch {
+		case start >= size:
+			delete(f.dirty, page)
+		case start+int64(len(data)) > size:
+			f.dirty[page] = data[:size-start]
+		}
+	}
+
+	if size < f.floor {
+		f.floor = size
+	}
+	f.size = size
+	return nil
+}
+
+func (f *boltFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		// pages past the end of the file, or cut short by a truncate, are
+		// rewritten or deleted
+		pages := tx.Bucket(boltPagesBucket)
+		count := (f.size + boltPageSize - 1) / boltPageSize
+		if err := deletePages(tx, f.name, count); err != nil {
+			return err
+		}
+		for page := f.floor / boltPageSize; page < count; page++ {
+			if _, ok := f.dirty[page]; !ok {
+				f.dirty[page] = f.page(tx, page)
+			}
+		}
+
+		for page, data := range f.dirty {
+			if err := pages.Put(pageKey(f.name, page), data); err != nil {
+				return err
+			}
+		}
+		return putFileSize(tx, f.name, f.size)
+	})
+	if err != nil {
+		return err
+	}
+
+	f.dirty = make(map[int64][]byte)
+	f.floor = f.size
+	return nil
+}
+
+func (f *boltFile) Close() error {
+	return nil
+}
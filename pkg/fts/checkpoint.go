@@ -0,0 +1,609 @@
+package fts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var ErrCorruptCheckpoint = errors.New("corrupt checkpoint")
+
+const (
+	walFileName        = "index.wal"
+	checkpointFileName = "index.checkpoint"
+	segmentSuffix      = ".seg"
+)
+
+// checkpoint is a snapshot of an index's documents and inverted index as of
+// the write-ahead log record Lsn.  The documents are the first StoreSize bytes
+// of the document store named Store and the inverted index is stored in the
+// segment files listed in Segments.
+type checkpoint struct {
+	Lsn        uint64         `json:"lsn"`
+	Settings   IndexSettings  `json:"settings"`
+	Documents  []Document     `json:"documents"`
+	Store      string         `json:"store,omitempty"`
+	StoreSize  int64          `json:"storeSize,omitempty"`
+	Segments   []segmentState `json:"segments"`
+	Generation uint64         `json:"generation"`
+
+	// Segment and Postings hold the inverted index of checkpoints written
+	// before there could be more than one segment.
+	Segment  string              `json:"segment,omitempty"`
+	Postings map[string][]string `json:"postings,omitempty"`
+
+	segments []*segment
+}
+
+// segmentState names a segment file and lists its tombstones.  Segment files
+// never change after they are written so tombstones are kept here instead.
+type segmentState struct {
+	Name    string `json:"name"`
+	Deleted bitset `json:"deleted,omitempty"`
+}
+
+// checkpointFile is the on disk envelope of a checkpoint.
+type checkpointFile struct {
+	Checksum   string          `json:"checksum"`
+	Checkpoint json.RawMessage `json:"checkpoint"`
+}
+
+// walPath returns the path of the index's write-ahead log.
+func (i *Index) walPath() string {
+	return joinName(i.dir(), walFileName)
+}
+
+// checkpointPath returns the path of the index's last checkpoint.
+func (i *Index) checkpointPath() string {
+	return joinName(i.dir(), checkpointFileName)
+}
+
+// getWal returns the index's write-ahead log, opening it if needed.  The
+// caller must hold the lock.
+func (i *Index) getWal() (*wal, error) {
+	if i.destroyed {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, i.Id)
+	}
+
+	if i.wal == nil {
+		w, _, err := openWal(i.storage, i.walPath(), i.checkpointLsn)
+		if err != nil {
+			return nil, err
+		}
+		i.wal = w
+	}
+
+	return i.wal, nil
+}
+
+// Load restores the documents and inverted index from the index's last
+// checkpoint and replays the write-ahead log on top of it.  An index without
+// a usable checkpoint is built from its documents first.  Documents still in
+// files of their own are migrated into the document store.
+func (i *Index) Load() error {
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.load(true)
+}
+
+// load restores the index, optionally ignoring the checkpoint.  The caller
+// must hold the checkpoint lock and the lock.
+func (i *Index) load(useCheckpoint bool) error {
+	start := time.Now()
+
+	var cp *checkpoint
+	if useCheckpoint {
+		var err error
+		if cp, err = readCheckpoint(i.storage, i.dir()); err != nil {
+			return err
+		}
+	}
+
+	documents := i.Documents
+	if cp != nil {
+		documents = cp.Documents
+		i.generation = cp.Generation
+		i.checkpointLsn = cp.Lsn
+	}
+	i.setDocuments(documents)
+
+	if err := i.openStore(cp); err != nil {
+		return err
+	}
+	migrated, err := i.migrateDocuments()
+	if err != nil {
+		return err
+	}
+
+	// a checkpoint taken before the settings changed doesn't match the postings
+	if cp != nil && reflect.DeepEqual(cp.Settings, i.Settings()) {
+		i.postings = openSegments(cp.segments)
+	} else if err := i.build(); err != nil {
+		return err
+	}
+
+	w, records, err := openWal(i.storage, i.walPath(), i.checkpointLsn)
+	if err != nil {
+		return err
+	}
+	i.wal = w
+
+	replayed := 0
+	for _, record := range records {
+		if record.Lsn <= i.checkpointLsn {
+			continue
+		}
+		if err := i.apply(record); err != nil {
+			log.Printf("Error replaying %s of document %s in index %s: %s", record.Op, record.Id, i.Id, err)
+		}
+		replayed++
+	}
+
+	if replayed > 0 {
+		log.Printf("Replayed %d write-ahead log records for index %s", replayed, i.Id)
+	}
+	i.maybeMerge()
+
+	i.counters.lastBuildTime = start
+	i.counters.lastBuildDuration = time.Since(start)
+
+	// the document files can only be removed once a checkpoint covers them
+	if migrated > 0 {
+		return i.checkpoint()
+	}
+	return nil
+}
+
+// readCheckpoint reads and verifies the checkpoint in the index directory dir
+// of storage along with its segments.  It returns nil when there is no
+// checkpoint.
+func readCheckpoint(storage Storage, dir string) (*checkpoint, error) {
+	path := joinName(dir, checkpointFileName)
+	bytes, err := storage.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file checkpointFile
+	if err := json.Unmarshal(bytes, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrCorruptCheckpoint, path, err)
+	}
+	if checksum(file.Checkpoint) != file.Checksum {
+		return nil, fmt.Errorf("%w: %s does not match its checksum", ErrCorruptCheckpoint, path)
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(file.Checkpoint, &cp); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrCorruptCheckpoint, path, err)
+	}
+	switch {
+	case cp.Segment != "":
+		cp.Segments = []segmentState{{Name: cp.Segment}}
+	case cp.Postings != nil:
+		cp.segments = []*segment{segmentFromPostings(cp.Postings)}
+	}
+
+	for _, state := range cp.Segments {
+		s, err := readSegment(storage, joinName(dir, state.Name))
+		if err != nil {
+			return nil, err
+		}
+		s.name = state.Name
+		s.deleted = state.Deleted
+		cp.segments = append(cp.segments, s)
+	}
+
+	return &cp, nil
+}
+
+// Checkpoint saves the index's documents and inverted index so the write-ahead
+// log can be emptied.  It does nothing when nothing changed since the last one.
+// The index is only locked while its state is taken and while the new files
+// are swapped in, so searches and writes carry on while the document store is
+// compacted and the files are written.
+func (i *Index) Checkpoint() error {
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+
+	i.mu.Lock()
+	pending, err := i.prepareCheckpoint()
+	i.mu.Unlock()
+	if err != nil || pending == nil {
+		return err
+	}
+
+	err = pending.write(i.storage, i.dir())
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.finishCheckpoint(pending, err)
+}
+
+// checkpoint saves the index without releasing the lock.  The caller must
+// hold the checkpoint lock and the lock.
+func (i *Index) checkpoint() error {
+	pending, err := i.prepareCheckpoint()
+	if err != nil || pending == nil {
+		return err
+	}
+	return i.finishCheckpoint(pending, pending.write(i.storage, i.dir()))
+}
+
+// pendingCheckpoint is the state of an index taken for a checkpoint along
+// with the files still to be written for it.
+type pendingCheckpoint struct {
+	checkpoint checkpoint
+	wal        *wal
+	walSize    int64
+	store      *docStore
+	compacted  *docStore  // the store being compacted into, if any
+	documents  []Document // the documents as they were in store
+	segments   []*segment // flushed segments without files
+	names      []string   // the file names of segments
+	keep       map[string]struct{}
+	legacy     []string
+}
+
+// prepareCheckpoint takes the state of the index for a checkpoint, flushing
+// the buffer and naming the files to be written.  It returns nil when there
+// is nothing to checkpoint.  The caller must hold the checkpoint lock and the
+// lock.
+func (i *Index) prepareCheckpoint() (*pendingCheckpoint, error) {
+	if i.destroyed || !i.stale {
+		return nil, nil
+	}
+
+	w, err := i.getWal()
+	if err != nil {
+		return nil, err
+	}
+
+	// the document store is only durable through the write-ahead log until
+	// the checkpoint is written
+	i.closeRetired()
+	p := &pendingCheckpoint{
+		wal:       w,
+		walSize:   w.length(),
+		store:     i.store,
+		documents: append([]Document(nil), i.Documents...),
+		keep:      make(map[string]struct{}),
+		legacy:    i.legacy,
+	}
+	if i.store != nil {
+		p.checkpoint.Store, p.checkpoint.StoreSize = i.store.name, i.store.size
+		if i.store.garbage >= compactMinGarbage && i.store.garbage*2 >= i.store.size {
+			name := i.nextFileName(docStoreSuffix)
+			if p.compacted, err = openDocStore(i.storage, name, joinName(i.dir(), name)); err != nil {
+				log.Printf("Error compacting the document store of index %s: %s", i.Id, err)
+			}
+		}
+	}
+
+	// segments are written once under a new name so the previous checkpoint
+	// stays intact until the new one replaces it
+	i.postings.flush()
+	states := make([]segmentState, 0, len(i.postings.flushed))
+	for _, s := range i.postings.flushed {
+		name := s.name
+		if name == "" {
+			name = i.nextFileName(segmentSuffix)
+			p.segments = append(p.segments, s)
+			p.names = append(p.names, name)
+		}
+		states = append(states, segmentState{Name: name, Deleted: s.deleted.clone()})
+		p.keep[name] = struct{}{}
+	}
+
+	p.checkpoint.Lsn = w.lsn
+	p.checkpoint.Settings = i.Settings()
+	p.checkpoint.Documents = p.documents
+	p.checkpoint.Segments = states
+	p.checkpoint.Generation = i.generation
+
+	// changes made while the files are written make the index stale again
+	i.stale = false
+	return p, nil
+}
+
+// write compacts the document store and writes the segment files and the
+// checkpoint.  It only reads the parts of the store and segments that were
+// there when the checkpoint was prepared, so it runs without the lock.
+func (p *pendingCheckpoint) write(storage Storage, dir string) error {
+	if p.compacted != nil {
+		documents, err := compactStore(p.store, p.compacted, p.documents)
+		if err != nil {
+			log.Printf("Error compacting the document store %s: %s", p.store.path, err)
+			p.compacted.close()
+			storage.Remove(p.compacted.path)
+			p.compacted = nil
+		} else {
+			p.checkpoint.Documents = documents
+			p.checkpoint.Store, p.checkpoint.StoreSize = p.compacted.name, p.compacted.size
+		}
+	}
+	if p.compacted == nil && p.store != nil {
+		if err := p.store.sync(); err != nil {
+			return err
+		}
+	}
+	if p.checkpoint.Store != "" {
+		p.keep[p.checkpoint.Store] = struct{}{}
+	}
+
+	for j, s := range p.segments {
+		if err := writeSegment(storage, joinName(dir, p.names[j]), s); err != nil {
+			return err
+		}
+	}
+
+	cp, err := json.Marshal(p.checkpoint)
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(checkpointFile{Checksum: checksum(cp), Checkpoint: cp})
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteFile(joinName(dir, checkpointFileName), bytes)
+}
+
+// finishCheckpoint swaps in the compacted document store and the written
+// segments, removes the files the checkpoint replaced and empties the
+// write-ahead log of the records it covers.  err is the error writing the
+// checkpoint, which leaves the index stale.  The caller must hold the
+// checkpoint lock and the lock.
+func (i *Index) finishCheckpoint(p *pendingCheckpoint, err error) error {
+	if err != nil {
+		if p.compacted != nil {
+			p.compacted.close()
+			i.storage.Remove(p.compacted.path)
+		}
+		i.stale = true
+		return err
+	}
+
+	for j, s := range p.segments {
+		s.name = p.names[j]
+	}
+
+	if p.compacted != nil {
+		if err := i.swapStore(p.store, p.compacted, p.documents, p.checkpoint.Documents); err != nil {
+			// the checkpoint refers to the compacted store, so it is kept
+			// until the next checkpoint along with the log that goes with it
+			p.compacted.close()
+			i.stale = true
+			return err
+		}
+	}
+
+	keep := p.keep
+	if i.store != nil {
+		keep[i.store.name] = struct{}{}
+	}
+	// a store replaced now is kept until the next checkpoint
+	for _, retired := range i.retired {
+		keep[retired.name] = struct{}{}
+	}
+	for _, s := range i.postings.flushed {
+		if s.name != "" {
+			keep[s.name] = struct{}{}
+		}
+	}
+	i.removeUnreferenced(keep)
+	for _, path := range p.legacy {
+		if err := i.storage.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing migrated document file %s: %s", path, err)
+		}
+	}
+	i.legacy = nil
+	i.maybeMerge()
+
+	if err := p.wal.discard(p.walSize); err != nil {
+		i.stale = true
+		return err
+	}
+
+	i.checkpointLsn = p.checkpoint.Lsn
+	return nil
+}
+
+// nextFileName returns an unused name for a segment or document store file.
+// Existing files are skipped because an index loaded without its checkpoint
+// restarts the generation while the checkpoint's files are still stored.
+// The caller must hold the lock.
+func (i *Index) nextFileName(suffix string) string {
+	existing := make(map[string]struct{})
+	if files, err := i.storage.List(i.dir()); err == nil {
+		for _, file := range files {
+			existing[file.Name] = struct{}{}
+		}
+	}
+
+	for {
+		i.generation++
+		name := fmt.Sprintf("%016x%s", i.generation, suffix)
+		if _, ok := existing[name]; !ok {
+			return name
+		}
+	}
+}
+
+// removeUnreferenced removes the segment and document store files in the
+// index directory other than those in keep or pinned.  Failures only leave
+// unused files behind so they are logged.
+func (i *Index) removeUnreferenced(keep map[string]struct{}) {
+	files, err := i.storage.List(i.dir())
+	if err != nil {
+		log.Printf("Error listing files of index %s: %s", i.Id, err)
+		return
+	}
+
+	for _, file := range files {
+		name := file.Name
+		if _, ok := keep[name]; ok || !(strings.HasSuffix(name, segmentSuffix) || strings.HasSuffix(name, docStoreSuffix)) {
+			continue
+		}
+		if _, ok := i.pinned[name]; ok {
+			continue
+		}
+		if err := i.storage.Remove(joinName(i.dir(), name)); err != nil {
+			log.Printf("Error removing %s of index %s: %s", name, i.Id, err)
+		}
+	}
+}
+
+// pin keeps files in the index directory from being removed by checkpoints
+// until they are unpinned.  The caller must hold the lock.
+func (i *Index) pin(names ...string) {
+	if i.pinned == nil {
+		i.pinned = make(map[string]int)
+	}
+	for _, name := range names {
+		i.pinned[name]++
+	}
+}
+
+// unpin releases files pinned by pin.  They are removed by the next checkpoint
+// if it doesn't refer to them.  The caller must hold the lock.
+func (i *Index) unpin(names ...string) {
+	for _, name := range names {
+		if i.pinned[name]--; i.pinned[name] <= 0 {
+			delete(i.pinned, name)
+		}
+	}
+}
+
+// recover drops documents that are missing or corrupt, moving corrupt
+// document files aside, and adopts document files that were written but never
+// made it into the catalog.  The documents in the document store come from the
+// checkpoint when it can be read and otherwise from scanning the store.  The
+// inverted index is then rebuilt from the remaining documents and the
+// write-ahead log, ignoring the checkpoint.
+func (i *Index) recover() error {
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	cp, err := readCheckpoint(i.storage, i.dir())
+	if err == nil && cp != nil && cp.Store != "" {
+		catalog := i.Documents
+		i.Documents = cp.Documents
+		if err = i.openStore(cp); err == nil {
+			i.generation = cp.Generation
+			i.checkpointLsn = cp.Lsn
+		} else {
+			i.Documents = catalog
+		}
+	}
+	if err != nil {
+		log.Printf("Recovery: ignoring the checkpoint of index %s: %s", i.Id, err)
+	}
+
+	if i.store == nil {
+		name, err := i.latestStore()
+		if err != nil {
+			return err
+		}
+		if name != "" {
+			store, documents, err := scanStore(i.storage, name, joinName(i.dir(), name))
+			if err != nil {
+				return err
+			}
+
+			// documents still in files of their own are kept for migration
+			scanned := make(map[string]struct{}, len(documents))
+			for _, document := range documents {
+				scanned[document.Id] = struct{}{}
+			}
+			for _, document := range i.Documents {
+				if _, ok := scanned[document.Id]; !ok && !document.stored() {
+					documents = append(documents, document)
+				}
+			}
+
+			log.Printf("Recovery: recovered %d documents of index %s from document store %s", len(documents), i.Id, name)
+			i.setDocuments(documents)
+			i.setStore(store)
+		}
+	}
+
+	known := make(map[string]struct{}, len(i.Documents))
+	kept := make([]Document, 0, len(i.Documents))
+	for _, document := range i.Documents {
+		var err error
+		if document.stored() {
+			_, err = document.Contents()
+		} else if bytes, readErr := i.readLegacy(document); readErr != nil {
+			err = readErr
+		} else if jsonErr := json.Unmarshal(bytes, &map[string]interface{}{}); jsonErr != nil {
+			err = fmt.Errorf("%w: document %s: %s", ErrCorruptDocument, document.Id, jsonErr)
+		}
+		if err != nil {
+			log.Printf("Recovery: dropping document %s from index %s: %s", document.Id, i.Id, err)
+			if name, pathErr := i.legacyPath(document); pathErr == nil && !document.stored() && !os.IsNotExist(err) {
+				if err := i.storage.Rename(name, name+".corrupt"); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			continue
+		}
+		known[document.Id] = struct{}{}
+		kept = append(kept, document)
+	}
+
+	files, err := i.storage.List(i.dir())
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		path := joinName(i.dir(), file.Name)
+		if isTmpFile(file.Name) {
+			log.Printf("Recovery: removing partially written file %s", path)
+			if err := i.storage.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+
+		id := strings.TrimSuffix(file.Name, ".json")
+		if _, ok := known[id]; ok || !strings.HasSuffix(file.Name, ".json") {
+			continue
+		}
+
+		bytes, err := i.storage.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var contents map[string]interface{}
+		if err := json.Unmarshal(bytes, &contents); err != nil {
+			log.Printf("Recovery: ignoring unparseable document file %s: %s", path, err)
+			continue
+		}
+
+		log.Printf("Recovery: adopting document %s into index %s", id, i.Id)
+		kept = append(kept, Document{Id: id, Path: path, Checksum: checksum(bytes)})
+	}
+
+	i.Documents = kept
+	if err := i.load(false); err != nil {
+		return err
+	}
+
+	i.stale = true
+	return i.checkpoint()
+}
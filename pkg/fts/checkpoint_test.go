@@ -0,0 +1,143 @@
+package fts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingStorage is a MemoryStorage whose checkpoint writes wait until
+// released.
+type blockingStorage struct {
+	*MemoryStorage
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) WriteFile(name string, data []byte) error {
+	if strings.HasSuffix(name, checkpointFileName) {
+		s.writing <- struct{}{}
+		<-s.release
+	}
+	return s.MemoryStorage.WriteFile(name, data)
+}
+
+func TestCheckpointDoesNotBlockTheIndex(t *testing.T) {
+	tests := []struct {
+		name    string
+		compact bool
+	}{
+		{"without compaction", false},
+		{"with compaction", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := &blockingStorage{MemoryStorage: NewMemoryStorage(), writing: make(chan struct{}), release: make(chan struct{})}
+			indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index := MakeIndex("books", []string{"title"})
+			if err := indexManager.AddIndex(&index); err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[string]string)
+			write := func(id string, title string, body string) {
+				t.Helper()
+				if _, err := index.AddDocument(id, map[string]interface{}{"title": title, "body": body}); err != nil {
+					t.Fatal(err)
+				}
+				want[id] = title
+			}
+			versions := 1
+			if test.compact {
+				// enough replaced documents for the checkpoint to compact the store
+				versions = 3
+			}
+			for version := 0; version < versions; version++ {
+				for j := 0; j < 12; j++ {
+					write(fmt.Sprint(j), fmt.Sprintf("book %d", j), strings.Repeat("x", 64<<10))
+				}
+			}
+
+			before, _ := index.GetDocument("0")
+			done := make(chan error)
+			go func() { done <- index.Checkpoint() }()
+			<-storage.writing
+
+			// the index is searched and written while the checkpoint is written
+			changed := make(chan struct{})
+			go func() {
+				defer close(changed)
+				if ids := index.Search("book", OperatorOr); len(ids) != 12 {
+					t.Errorf("search during the checkpoint found %d documents, want 12", len(ids))
+				}
+				write("1", "hobbit", "")
+				write("12", "dune", "")
+				if err := index.DeleteDocument("2"); err != nil {
+					t.Error(err)
+				}
+				delete(want, "2")
+			}()
+			select {
+			case <-changed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the index was locked during the checkpoint")
+			}
+
+			close(storage.release)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if after, _ := index.GetDocument("0"); (after.store != before.store) != test.compact {
+				t.Errorf("compacted the document store = %t, want %t", !test.compact, test.compact)
+			}
+
+			// only the changes made during the checkpoint are left in the log
+			_, records, err := openWal(storage, index.walPath(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(records))
+			for _, record := range records {
+				ids = append(ids, string(record.Op)+" "+record.Id)
+			}
+			if got := strings.Join(ids, ", "); got != "add 1, add 12, delete 2" {
+				t.Errorf("log holds %s, want the changes made during the checkpoint", got)
+			}
+
+			check := func(index *Index) {
+				t.Helper()
+				got := make(map[string]string)
+				for _, document := range index.ListDocuments() {
+					contents, err := document.Contents()
+					if err != nil {
+						t.Fatalf("reading %s: %s", document.Id, err)
+					}
+					got[document.Id] = contents["title"].(string)
+				}
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("documents = %v, want %v", got, want)
+				}
+				found := index.Search("hobbit dune", OperatorOr)
+				sort.Strings(found)
+				if fmt.Sprint(found) != "[1 12]" {
+					t.Errorf("search = %v, want [1 12]", found)
+				}
+			}
+			check(&index)
+
+			// the checkpoint and the rest of the log recover the index
+			reopened, err := NewIndexManager(storage.MemoryStorage, "indexes.json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			books, _ := reopened.GetIndex("books")
+			check(books)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package fts
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrSearchFailed = errors.New("search failed")
+
+// searchCall is a search shared by identical concurrent requests.
+type searchCall struct {
+	done     chan struct{}
+	response []byte
+	err      error
+}
+
+// searchCalls are the searches of an index in progress, by key.
+type searchCalls struct {
+	mu    sync.Mutex
+	calls map[string]*searchCall
+}
+
+// CoalesceSearch returns the response of search, unless a search with the
+// same key is already running, in which case it waits for that search and
+// returns its response instead.  The key must identify everything the
+// response depends on, including the cache generation of the index.
+func (i *Index) CoalesceSearch(key string, search func() ([]byte, error)) ([]byte, error) {
+	i.searches.mu.Lock()
+	if call, ok := i.searches.calls[key]; ok {
+		i.searches.mu.Unlock()
+		i.counters.searchesCoalesced.Add(1)
+		<-call.done
+		return call.response, call.err
+	}
+
+	// the error is kept if search panics so the waiting requests still fail
+	call := &searchCall{done: make(chan struct{}), err: ErrSearchFailed}
+	if i.searches.calls == nil {
+		i.searches.calls = make(map[string]*searchCall)
+	}
+	i.searches.calls[key] = call
+	i.searches.mu.Unlock()
+
+	defer func() {
+		i.searches.mu.Lock()
+		delete(i.searches.calls, key)
+		i.searches.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.response, call.err = search()
+	return call.response, call.err
+}
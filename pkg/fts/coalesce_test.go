@@ -0,0 +1,108 @@
+package fts
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForCoalesced waits until n searches of index have joined one in progress.
+func waitForCoalesced(t *testing.T, index *Index, n int64) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); index.counters.searchesCoalesced.Load() < n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d searches joined, want %d", index.counters.searchesCoalesced.Load(), n)
+		}
+	}
+}
+
+func TestCoalesceSearch(t *testing.T) {
+	const waiters = 10
+	index := MakeIndex("books", []string{"title"})
+
+	var runs atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	search := func() ([]byte, error) {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return []byte(`{"results":["1"]}`), nil
+	}
+
+	responses := make(chan string, waiters+1)
+	var wg sync.WaitGroup
+	run := func() {
+		defer wg.Done()
+		response, err := index.CoalesceSearch("hobbit", search)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- string(response)
+	}
+	wg.Add(1)
+	go run()
+	<-started
+	for j := 0; j < waiters; j++ {
+		wg.Add(1)
+		go run()
+	}
+	waitForCoalesced(t, &index, waiters)
+
+	// a search with another key isn't held up
+	other, err := index.CoalesceSearch("dune", func() ([]byte, error) { return []byte(`{"results":[]}`), nil })
+	if err != nil || string(other) != `{"results":[]}` {
+		t.Errorf("other search = %s, %v", other, err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(responses)
+	for response := range responses {
+		if response != `{"results":["1"]}` {
+			t.Errorf("response = %s", response)
+		}
+	}
+	if runs.Load() != 1 {
+		t.Errorf("search ran %d times, want once", runs.Load())
+	}
+	if coalesced := index.Counts().SearchesCoalesced; coalesced != waiters {
+		t.Errorf("coalesced = %d, want %d", coalesced, waiters)
+	}
+
+	// once finished the search runs again
+	if _, err := index.CoalesceSearch("hobbit", search); err != nil || runs.Load() != 2 {
+		t.Errorf("search after the first finished ran %d times, %v", runs.Load(), err)
+	}
+}
+
+func TestCoalesceSearchPanics(t *testing.T) {
+	index := MakeIndex("books", []string{"title"})
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		defer func() { recover() }()
+		index.CoalesceSearch("hobbit", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("search failed")
+		})
+	}()
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, err := index.CoalesceSearch("hobbit", func() ([]byte, error) { return nil, nil })
+		done <- err
+	}()
+	waitForCoalesced(t, &index, 1)
+	close(release)
+
+	if err := <-done; !errors.Is(err, ErrSearchFailed) {
+		t.Errorf("waiting search = %v, want %v", err, ErrSearchFailed)
+	}
+}
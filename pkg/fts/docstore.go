@@ -0,0 +1,634 @@
+package fts
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidCompression = errors.New("invalid compression")
+
+// Compression is how document contents are compressed in the document store.
+type Compression string
+
+const (
+	CompressionNone    Compression = "none"
+	CompressionDeflate Compression = "deflate"
+)
+
+// Validate checks that the compression is known.  Empty means CompressionNone.
+func (c Compression) Validate() error {
+	switch c {
+	case "", CompressionNone, CompressionDeflate:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidCompression, c)
+	}
+}
+
+const (
+	// docStoreMagic identifies a document store file and its format version.
+	docStoreMagic  = "FTSDOC01"
+	docStoreSuffix = ".docs"
+
+	// recordHeaderSize is the size of the length and crc32 preceding each record.
+	recordHeaderSize = 8
+
+	recordDeleted = 1 << 0
+	recordDeflate = 1 << 1
+
+	// compactMinGarbage is the number of bytes of replaced and deleted
+	// records before a document store is worth compacting.
+	compactMinGarbage = 1 << 20
+)
+
+// A document store is a single append-only file holding every version of an
+// index's documents:
+//
+//	magic    "FTSDOC01"
+//	records  each a little endian uint32 payload length, the crc32 of the
+//	         payload and the payload: a flags byte, the document id as a
+//	         uvarint length and bytes, and the document's json, deflated when
+//	         the recordDeflate flag is set
+//
+// Deleting a document appends a record with the recordDeleted flag and no
+// contents.  Documents are read directly from their offset, which is kept in
+// the index's Documents, so reading one never has to scan the file.  Replaced
+// and deleted records are garbage until the store is compacted.
+type docStore struct {
+	name    string
+	path    string
+	file    File
+	size    int64
+	garbage int64
+
+	// mu stops the file being closed during a read of a store that a
+	// compaction replaced, which readers holding older Documents still use
+	mu     sync.RWMutex
+	closed bool
+}
+
+// storeRecord is a record read while scanning a document store.
+type storeRecord struct {
+	id       string
+	offset   int64
+	length   int64
+	deleted  bool
+	contents []byte
+}
+
+// openDocStore opens the document store at path in storage, creating it if it
+// doesn't exist.
+func openDocStore(storage Storage, name string, path string) (*docStore, error) {
+	file, err := storage.OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := file.Size()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	s := &docStore{name: name, path: path, file: file, size: size}
+	if s.size == 0 {
+		if _, err := file.WriteAt([]byte(docStoreMagic), 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		s.size = int64(len(docStoreMagic))
+		return s, nil
+	}
+
+	magic := make([]byte, len(docStoreMagic))
+	if _, err := file.ReadAt(magic, 0); err != nil || string(magic) != docStoreMagic {
+		file.Close()
+		return nil, fmt.Errorf("%w: %s is not a document store", ErrCorruptDocument, path)
+	}
+
+	return s, nil
+}
+
+// truncate discards everything after size, which is where the store ended
+// when it was last known to be complete.
+func (s *docStore) truncate(size int64) error {
+	if size > s.size {
+		return fmt.Errorf("%w: %s is shorter than expected", ErrCorruptDocument, s.path)
+	}
+	if size == s.size {
+		return nil
+	}
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// scan calls fn with every record in the store in order.  The store is
+// truncated at the first incomplete or damaged record, which is where a
+// crash interrupted an append.
+func (s *docStore) scan(fn func(record storeRecord)) error {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, int64(len(docStoreMagic)), s.size))
+	offset := int64(len(docStoreMagic))
+	header := make([]byte, recordHeaderSize)
+
+	for offset < s.size {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(header))
+		if offset+recordHeaderSize+length > s.size {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+
+		record, err := decodeRecord(payload)
+		if err != nil {
+			break
+		}
+		record.offset = offset
+		record.length = recordHeaderSize + length
+		fn(record)
+
+		offset += record.length
+	}
+
+	if offset < s.size {
+		log.Printf("Document store %s has a damaged record at offset %d, discarding the rest of it", s.path, offset)
+		return s.truncate(offset)
+	}
+	return nil
+}
+
+// flateWriters reuses deflate compressors, which are expensive to allocate.
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// append adds a record for a document and returns its offset and length.
+// The record isn't durable until the store is synced.
+func (s *docStore) append(id string, contents []byte, deleted bool, compression Compression) (int64, int64, error) {
+	var flags byte
+	if deleted {
+		flags |= recordDeleted
+	}
+
+	var payload bytes.Buffer
+	payload.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, flags})
+	scratch := make([]byte, binary.MaxVarintLen64)
+	payload.Write(scratch[:binary.PutUvarint(scratch, uint64(len(id)))])
+	payload.WriteString(id)
+
+	if compression == CompressionDeflate && !deleted {
+		payload.Bytes()[recordHeaderSize] |= recordDeflate
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&payload)
+		_, err := w.Write(contents)
+		if err == nil {
+			err = w.Close()
+		}
+		flateWriters.Put(w)
+		if err != nil {
+			return 0, 0, err
+		}
+	} else {
+		payload.Write(contents)
+	}
+
+	record := payload.Bytes()
+	binary.LittleEndian.PutUint32(record, uint32(len(record)-recordHeaderSize))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(record[recordHeaderSize:]))
+
+	return s.appendRaw(record)
+}
+
+// appendRaw adds an encoded record and returns its offset and length.
+func (s *docStore) appendRaw(record []byte) (int64, int64, error) {
+	offset := s.size
+	if _, err := s.file.WriteAt(record, offset); err != nil {
+		// a partial record is overwritten by the next append
+		return 0, 0, err
+	}
+	s.size += int64(len(record))
+	return offset, int64(len(record)), nil
+}
+
+// readRaw reads and verifies the encoded record at offset.
+func (s *docStore) readRaw(offset int64, length int64) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, fmt.Errorf("document store %s was replaced by a compaction and closed", s.path)
+	}
+
+	record := make([]byte, length)
+	if _, err := s.file.ReadAt(record, offset); err != nil {
+		return nil, fmt.Errorf("%w: %s at offset %d: %s", ErrCorruptDocument, s.path, offset, err)
+	}
+	if length < recordHeaderSize ||
+		int64(binary.LittleEndian.Uint32(record)) != length-recordHeaderSize ||
+		crc32.ChecksumIEEE(record[recordHeaderSize:]) != binary.LittleEndian.Uint32(record[4:]) {
+		return nil, fmt.Errorf("%w: %s has a damaged record at offset %d", ErrCorruptDocument, s.path, offset)
+	}
+	return record, nil
+}
+
+// read returns the contents of the document record at offset.
+func (s *docStore) read(id string, offset int64, length int64) ([]byte, error) {
+	raw, err := s.readRaw(offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := decodeRecord(raw[recordHeaderSize:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s at offset %d: %s", ErrCorruptDocument, s.path, offset, err)
+	}
+	if record.id != id || record.deleted {
+		return nil, fmt.Errorf("%w: %s at offset %d isn't document %s", ErrCorruptDocument, s.path, offset, id)
+	}
+	return record.contents, nil
+}
+
+// decodeRecord decodes a record's payload.
+func decodeRecord(payload []byte) (storeRecord, error) {
+	if len(payload) == 0 {
+		return storeRecord{}, errors.New("empty record")
+	}
+	flags := payload[0]
+
+	idLength, n := binary.Uvarint(payload[1:])
+	if n <= 0 || idLength > uint64(len(payload)-1-n) {
+		return storeRecord{}, errors.New("invalid document id")
+	}
+	start := 1 + n
+	record := storeRecord{id: string(payload[start : start+int(idLength)]), deleted: flags&recordDeleted != 0}
+
+	contents := payload[start+int(idLength):]
+	if flags&recordDeflate != 0 {
+		reader := flate.NewReader(bytes.NewReader(contents))
+		defer reader.Close()
+		inflated, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return storeRecord{}, err
+		}
+		contents = inflated
+	}
+	record.contents = contents
+
+	return record, nil
+}
+
+// sync makes the appended records durable.
+func (s *docStore) sync() error {
+	return s.file.Sync()
+}
+
+// close closes the store's file once the reads in progress finish.  Reads
+// after that fail.
+func (s *docStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.file.Close()
+}
+
+// getStore returns the index's document store, creating one if needed.  The
+// caller must hold the lock.
+func (i *Index) getStore() (*docStore, error) {
+	if i.store == nil {
+		name := i.nextFileName(docStoreSuffix)
+		store, err := openDocStore(i.storage, name, joinName(i.dir(), name))
+		if err != nil {
+			return nil, err
+		}
+		i.store = store
+	}
+
+	return i.store, nil
+}
+
+// setStore makes store the index's document store.  Every document in the
+// store is pointed at it and the garbage in it is worked out from the live
+// records.  The caller must hold the lock.
+func (i *Index) setStore(store *docStore) {
+	live := int64(len(docStoreMagic))
+	for j := range i.Documents {
+		if i.Documents[j].stored() {
+			i.Documents[j].store = store
+			live += i.Documents[j].Length
+		}
+	}
+
+	store.garbage = store.size - live
+	i.store = store
+}
+
+// openStore opens the document store when loading the index.  The
+// checkpoint's store is cut back to the size it had at the checkpoint, since
+// the write-ahead log replays everything appended after it.  Without a
+// checkpoint the documents are recovered by scanning the newest store, unless
+// there are document files still to be migrated, in which case the store
+// can't be trusted to be complete and migration starts over in a new one.
+// The caller must hold the lock.
+func (i *Index) openStore(cp *checkpoint) error {
+	if i.store != nil {
+		return nil
+	}
+
+	if cp != nil && cp.Store != "" {
+		store, err := openDocStore(i.storage, cp.Store, joinName(i.dir(), cp.Store))
+		if err != nil {
+			return err
+		}
+		if err := store.truncate(cp.StoreSize); err != nil {
+			store.close()
+			return err
+		}
+		i.setStore(store)
+		return nil
+	}
+
+	for _, document := range i.Documents {
+		if !document.stored() {
+			return nil
+		}
+	}
+
+	name, err := i.latestStore()
+	if err != nil || name == "" {
+		return err
+	}
+
+	store, documents, err := scanStore(i.storage, name, joinName(i.dir(), name))
+	if err != nil {
+		return err
+	}
+	log.Printf("Recovered %d documents of index %s from document store %s", len(documents), i.Id, name)
+
+	i.setDocuments(documents)
+	i.setStore(store)
+	return nil
+}
+
+// latestStore returns the name of the newest document store in the index
+// directory, or an empty string when there isn't one.
+func (i *Index) latestStore() (string, error) {
+	files, err := i.storage.List(i.dir())
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+	for _, file := range files {
+		if strings.HasSuffix(file.Name, docStoreSuffix) && file.Name > latest {
+			latest = file.Name
+		}
+	}
+	return latest, nil
+}
+
+// scanStore opens a document store and reads the latest version of every
+// document that hasn't been deleted.
+func scanStore(storage Storage, name string, path string) (*docStore, []Document, error) {
+	store, err := openDocStore(storage, name, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order := make([]string, 0)
+	latest := make(map[string]Document)
+	err = store.scan(func(record storeRecord) {
+		if record.deleted {
+			delete(latest, record.id)
+			return
+		}
+		if _, ok := latest[record.id]; !ok {
+			order = append(order, record.id)
+		}
+		latest[record.id] = Document{
+			Id:       record.id,
+			Offset:   record.offset,
+			Length:   record.length,
+			Checksum: checksum(record.contents),
+			store:    store,
+		}
+	})
+	if err != nil {
+		store.close()
+		return nil, nil, err
+	}
+
+	documents := make([]Document, 0, len(latest))
+	for _, id := range order {
+		if document, ok := latest[id]; ok {
+			documents = append(documents, document)
+			delete(latest, id)
+		}
+	}
+
+	return store, documents, nil
+}
+
+// migrateDocuments moves documents stored as files of their own into the
+// document store.  The files are removed after the next checkpoint, along
+// with any other document files left in the index directory.
+// Documents whose files can't be read are left for build to report.  The
+// caller must hold the lock.
+func (i *Index) migrateDocuments() (int, error) {
+	migrated := 0
+	for j, document := range i.Documents {
+		if document.stored() {
+			continue
+		}
+
+		bytes, err := i.readLegacy(document)
+		if err != nil {
+			log.Printf("Could not migrate document %s of index %s: %s", document.Id, i.Id, err)
+			continue
+		}
+
+		store, err := i.getStore()
+		if err != nil {
+			return migrated, err
+		}
+		offset, length, err := store.append(document.Id, bytes, false, i.Compression)
+		if err != nil {
+			return migrated, err
+		}
+
+		name, _ := i.legacyPath(document)
+		i.legacy = append(i.legacy, name)
+		i.Documents[j] = Document{Id: document.Id, Offset: offset, Length: length, Checksum: checksum(bytes), store: store}
+		migrated++
+	}
+
+	if migrated == 0 {
+		return 0, nil
+	}
+
+	log.Printf("Migrated %d document files of index %s into its document store", migrated, i.Id)
+	i.stale = true
+
+	// files of documents only in the write-ahead log are replayed into the
+	// store too, so every document file without a document is a leftover
+	files, err := i.storage.List(i.dir())
+	if err != nil {
+		return migrated, err
+	}
+	unmigrated := make(map[string]struct{})
+	for _, document := range i.Documents {
+		if !document.stored() {
+			unmigrated[path.Clean(document.Path)] = struct{}{}
+		}
+	}
+	for _, file := range files {
+		name := joinName(i.dir(), file.Name)
+		if _, ok := unmigrated[name]; !ok && strings.HasSuffix(file.Name, ".json") {
+			i.legacy = append(i.legacy, name)
+		}
+	}
+
+	return migrated, nil
+}
+
+// legacyPath returns the path of a document that is still a file of its own.
+// The path comes from the catalog, so it must name a file in the index
+// directory before the file is read, moved or removed.
+func (i *Index) legacyPath(document Document) (string, error) {
+	name := path.Clean(document.Path)
+	if !inDir(name, i.dir()) {
+		return "", fmt.Errorf("%w: document %s has path %q outside of index %s", ErrCorruptDocument, document.Id, document.Path, i.Id)
+	}
+	return name, nil
+}
+
+// readLegacy returns the json of a document that is still a file of its own,
+// verifying its checksum.
+func (i *Index) readLegacy(document Document) ([]byte, error) {
+	name, err := i.legacyPath(document)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := i.storage.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if document.Checksum != "" && checksum(bytes) != document.Checksum {
+		return nil, fmt.Errorf("%w: document %s does not match its checksum", ErrCorruptDocument, document.Id)
+	}
+
+	return bytes, nil
+}
+
+// compactStore copies the live records of documents from store into
+// compacted, leaving the replaced and deleted records behind, and returns the
+// documents pointed at their copies.  Only records that were in store when
+// documents was taken are read, so it runs without the lock while new
+// records are appended after them.
+func compactStore(store *docStore, compacted *docStore, documents []Document) ([]Document, error) {
+	start := time.Now()
+	documents = append([]Document(nil), documents...)
+	for j, document := range documents {
+		if !document.stored() {
+			continue
+		}
+
+		record, err := store.readRaw(document.Offset, document.Length)
+		if err == nil {
+			documents[j].Offset, documents[j].Length, err = compacted.appendRaw(record)
+		}
+		if err != nil {
+			return nil, err
+		}
+		documents[j].store = compacted
+	}
+
+	if err := compacted.sync(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Compacted document store %s into %s of %d bytes in %s",
+		store.path, compacted.path, compacted.size, time.Since(start))
+	return documents, nil
+}
+
+// swapStore makes compacted, which holds copies of the records of before as
+// after, the index's document store.  Documents written since before was
+// taken are copied over too.  The old store is retired rather than closed so
+// readers holding documents from before the compaction can still read them
+// until the following checkpoint, which closes and removes it.  The caller
+// must hold the lock.
+func (i *Index) swapStore(store *docStore, compacted *docStore, before []Document, after []Document) error {
+	if i.store != store {
+		return fmt.Errorf("document store %s was replaced during its compaction", store.path)
+	}
+
+	moved := make(map[int64]Document, len(before))
+	for j, document := range before {
+		if document.stored() {
+			moved[document.Offset] = after[j]
+		}
+	}
+
+	documents := append([]Document(nil), i.Documents...)
+	for j, document := range documents {
+		if !document.stored() {
+			continue
+		}
+		if copied, ok := moved[document.Offset]; ok && document.store == store {
+			documents[j] = copied
+			continue
+		}
+
+		record, err := store.readRaw(document.Offset, document.Length)
+		if err == nil {
+			documents[j].Offset, documents[j].Length, err = compacted.appendRaw(record)
+		}
+		if err != nil {
+			return err
+		}
+		documents[j].store = compacted
+	}
+
+	i.Documents = documents
+	i.setStore(compacted)
+	i.retired = append(i.retired, store)
+	return nil
+}
+
+// closeRetired closes the document stores replaced by earlier compactions so
+// the next checkpoint removes their files.  The caller must hold the lock.
+func (i *Index) closeRetired() {
+	for _, store := range i.retired {
+		if err := store.close(); err != nil {
+			log.Printf("Error closing document store %s: %s", store.path, err)
+		}
+	}
+	i.retired = nil
+}
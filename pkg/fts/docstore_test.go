@@ -0,0 +1,290 @@
+package fts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLegacyDocumentsOutsideIndexDirectory(t *testing.T) {
+	storage := NewMemoryStorage()
+	victim := []byte(`{"title":"not part of the index"}`)
+	for name, data := range map[string][]byte{
+		"victim.json":          victim,
+		"indexes/books/2.json": []byte(`{"title":"the hobbit"}`),
+		"indexes.json": []byte(`{"indexes":{"books":{"id":"books","searchProperties":["title"],"documents":[
+			{"id":"1","path":"indexes/books/../../victim.json"},
+			{"id":"2","path":"indexes/books/2.json"}]}}}`),
+	} {
+		if err := storage.WriteFile(name, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexManager, err := RecoverIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, _ := indexManager.GetIndex("books")
+	if _, ok := index.GetDocument("1"); ok {
+		t.Error("document outside of the index directory was loaded")
+	}
+	if document, ok := index.GetDocument("2"); !ok {
+		t.Error("document 2 was not migrated")
+	} else if _, err := document.Contents(); err != nil {
+		t.Errorf("reading document 2: %s", err)
+	}
+
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := storage.ReadFile("victim.json"); err != nil || string(data) != string(victim) {
+		t.Errorf("victim.json was changed: %q, %v", data, err)
+	}
+	if _, err := storage.ReadFile("victim.json.corrupt"); err == nil {
+		t.Error("victim.json was moved aside")
+	}
+}
+
+func TestAddIndexDropsDocuments(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.WriteFile("victim.json", []byte(`{"title":"secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := MakeIndex("books", []string{"title"})
+	index.Documents = []Document{{Id: "1", Path: "../victim.json"}}
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	if documents := index.ListDocuments(); len(documents) != 0 {
+		t.Fatalf("documents = %v, want none", documents)
+	}
+	if err := index.DeleteDocument("1"); !errors.Is(err, ErrDocumentNotFound) {
+		t.Fatalf("DeleteDocument = %v, want %v", err, ErrDocumentNotFound)
+	}
+	if _, err := storage.ReadFile("victim.json"); err != nil {
+		t.Fatalf("victim.json: %s", err)
+	}
+}
+
+func TestCompactKeepsLiveDocuments(t *testing.T) {
+	storage := NewMemoryStorage()
+	indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := MakeIndex("books", []string{"title"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]string)
+	write := func(id string, title string) {
+		t.Helper()
+		if _, err := index.AddDocument(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatal(err)
+		}
+		want[id] = title
+	}
+	for j := 0; j < 50; j++ {
+		write(fmt.Sprint(j), fmt.Sprintf("book %d", j))
+	}
+	for j := 0; j < 50; j += 2 {
+		write(fmt.Sprint(j), fmt.Sprintf("second edition of book %d", j))
+	}
+	for j := 0; j < 50; j += 5 {
+		if err := index.DeleteDocument(fmt.Sprint(j)); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, fmt.Sprint(j))
+	}
+	before, ok := index.GetDocument("1")
+	if !ok {
+		t.Fatal("document 1 is missing")
+	}
+
+	index.mu.Lock()
+	old := index.store
+	if old.garbage == 0 {
+		t.Fatal("replacing and deleting documents left no garbage")
+	}
+	live := old.size - old.garbage
+	compacted, err := openDocStore(storage, "compacted.docs", joinName(index.dir(), "compacted.docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	documents := append([]Document(nil), index.Documents...)
+	index.mu.Unlock()
+
+	copies, err := compactStore(old, compacted, documents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compacted.size != live {
+		t.Errorf("compacted store is %d bytes, want %d", compacted.size, live)
+	}
+
+	// documents written during the compaction are copied over when the store is swapped
+	size := old.size
+	write("50", "book 50")
+	write("1", "third edition of book 1")
+	if err := index.DeleteDocument("3"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "3")
+	index.mu.Lock()
+	err = index.swapStore(old, compacted, documents, copies)
+	index.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index.store != compacted {
+		t.Fatal("compaction didn't replace the store")
+	}
+	garbage := int64(0)
+	for _, document := range documents {
+		if document.Id == "1" || document.Id == "3" {
+			garbage += document.Length
+		}
+	}
+	if compacted.garbage != garbage {
+		t.Errorf("compacted store has %d bytes of garbage, want %d", compacted.garbage, garbage)
+	}
+	if caughtUp := compacted.size - live; caughtUp >= old.size-size {
+		t.Errorf("copied %d bytes written during the compaction, want less than the %d written", caughtUp, old.size-size)
+	}
+
+	// the new store holds one record for each document live when the
+	// compaction started and then the versions written since, but no deletions
+	stored := make(map[string]int)
+	if err := compacted.scan(func(record storeRecord) {
+		if record.deleted {
+			t.Errorf("compacted store has the deletion of %s", record.id)
+		}
+		stored[record.id]++
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for id, count := range stored {
+		records := 1
+		if id == "1" {
+			records = 2
+		}
+		if count != records {
+			t.Errorf("compacted store has %d records for %s, want %d", count, id, records)
+		}
+	}
+	if len(stored) != len(want)+1 {
+		t.Errorf("compacted store has records for %d documents, want %d", len(stored), len(want)+1)
+	}
+
+	check := func(index *Index) {
+		t.Helper()
+		got := make(map[string]string)
+		for _, document := range index.ListDocuments() {
+			contents, err := document.Contents()
+			if err != nil {
+				t.Fatalf("reading %s: %s", document.Id, err)
+			}
+			got[document.Id] = contents["title"].(string)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("documents = %v, want %v", got, want)
+		}
+	}
+	check(&index)
+
+	// documents read before the compaction still read from the old store
+	if contents, err := before.Contents(); err != nil || contents["title"] != "book 1" {
+		t.Errorf("document read before compacting = %v, %v", contents, err)
+	}
+
+	// the old store is removed by the next checkpoint and the index reopens from the new one
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.ReadFile(old.path); err == nil {
+		t.Errorf("%s is still there after the checkpoint", old.path)
+	}
+	reopened, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := reopened.GetIndex("books")
+	check(books)
+}
+
+func TestDocumentsReadBeforeCompaction(t *testing.T) {
+	for backend, open := range storageBackends {
+		t.Run(backend, func(t *testing.T) {
+			storage := open(t)
+			defer storage.Close()
+			indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index := MakeIndex("books", []string{"title"})
+			if err := indexManager.AddIndex(&index); err != nil {
+				t.Fatal(err)
+			}
+
+			// enough replaced documents for a checkpoint to compact the store
+			body := strings.Repeat("x", 64<<10)
+			for version := 0; version < 3; version++ {
+				for j := 0; j < 12; j++ {
+					contents := map[string]interface{}{"title": fmt.Sprintf("book %d", j), "body": fmt.Sprint(version, body)}
+					if _, err := index.AddDocument(fmt.Sprint(j), contents); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			before, _ := index.GetDocument("1")
+			old := before.store
+
+			if err := indexManager.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			if current, _ := index.GetDocument("1"); current.store == old {
+				t.Fatal("the checkpoint didn't compact the document store")
+			}
+
+			// the old store stays readable until the following checkpoint
+			if contents, err := before.Contents(); err != nil || contents["title"] != "book 1" {
+				t.Fatalf("document read before compacting = %v, %v", contents["title"], err)
+			}
+			if _, err := storage.ReadFile(old.path); err != nil {
+				t.Fatalf("%s was removed by the compacting checkpoint: %s", old.path, err)
+			}
+
+			if _, err := index.AddDocument("12", map[string]interface{}{"title": "dune"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := indexManager.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			if !old.closed {
+				t.Error("the old store is still open after the following checkpoint")
+			}
+			if _, err := storage.ReadFile(old.path); !os.IsNotExist(err) {
+				t.Errorf("reading %s after the following checkpoint = %v, want a not exist error", old.path, err)
+			}
+			if _, err := before.Contents(); err == nil {
+				t.Error("read a document from a closed store")
+			}
+			if current, _ := index.GetDocument("1"); current.store != index.store {
+				t.Error("current documents don't use the current store")
+			} else if _, err := current.Contents(); err != nil {
+				t.Errorf("reading the current document: %s", err)
+			}
+		})
+	}
+}
@@ -2,50 +2,83 @@ package fts
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"os"
+	"errors"
+	"fmt"
 )
 
+var ErrCorruptDocument = errors.New("corrupt document")
+
 type DocumentJson struct {
 	Id       string      `json:"id"`
 	Document interface{} `json:"document"`
 }
 
+// Document locates a document's contents.  Documents are records in the
+// index's document store at Offset.  Documents written before the store was
+// added are files at Path until they are migrated into the store.
 type Document struct {
-	Id   string `json:"id,omitempty"`
-	Path string `json:"path"`
+	Id       string `json:"id,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Length   int64  `json:"length,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	store    *docStore
 }
 
 // Json returns a json encoded Document
 func (d *Document) Json() (interface{}, error) {
-	if _, err := os.Stat(d.Path); os.IsNotExist(err) {
+	contents, err := d.Contents()
+	if err != nil {
 		return nil, err
 	}
 
-	jsonFile, err := os.Open(d.Path)
+	ret := make(map[string]interface{})
+	ret["id"] = d.Id
+	ret["contents"] = contents
+	return ret, nil
+}
+
+// Contents returns the parsed contents of the persisted document.  A document
+// that doesn't match its checksum returns ErrCorruptDocument.
+func (d *Document) Contents() (map[string]interface{}, error) {
+	bytes, err := d.read()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	var contents map[string]interface{}
+	if err := json.Unmarshal(bytes, &contents); err != nil {
+		return nil, fmt.Errorf("%w: document %s: %s", ErrCorruptDocument, d.Id, err)
 	}
-	defer jsonFile.Close()
 
-	bytes, _ := ioutil.ReadAll(jsonFile)
+	return contents, nil
+}
 
-	var parsedJson interface{}
-	err = json.Unmarshal(bytes, &parsedJson)
+// read returns the persisted json of the document, verifying its checksum.
+// Documents that are still files of their own are read by the index while
+// it migrates them.
+func (d *Document) read() ([]byte, error) {
+	if !d.stored() {
+		return nil, fmt.Errorf("%w: document %s is not in the document store", ErrCorruptDocument, d.Id)
+	}
+	if d.store == nil {
+		return nil, fmt.Errorf("%w: document %s has no document store", ErrCorruptDocument, d.Id)
+	}
+
+	bytes, err := d.store.read(d.Id, d.Offset, d.Length)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make(map[string]interface{})
-	ret["id"] = d.Id
-	ret["contents"] = parsedJson
-	return ret, nil
+	if d.Checksum != "" && checksum(bytes) != d.Checksum {
+		return nil, fmt.Errorf("%w: document %s does not match its checksum", ErrCorruptDocument, d.Id)
+	}
+
+	return bytes, nil
 }
 
-// Destroy deletes the persisted document
-func (d *Document) destroy() error {
-	if err := os.Remove(d.Path); err != nil {
-		return err
-	}
-	return nil
+// stored returns true when the document is in the document store rather
+// than a file of its own.
+func (d *Document) stored() bool {
+	return d.Length > 0
 }
@@ -0,0 +1,95 @@
+package fts
+
+import (
+	"fmt"
+)
+
+// Explanation is a node in the tree describing how a document's score was computed.
+type Explanation struct {
+	Value       float64       `json:"value"`
+	Description string        `json:"description"`
+	Details     []Explanation `json:"details,omitempty"`
+}
+
+// ExplainResult is the explanation of how a document matched a search.
+type ExplainResult struct {
+	Id          string      `json:"id"`
+	Matched     bool        `json:"matched"`
+	Explanation Explanation `json:"explanation"`
+}
+
+// Explain describes which terms of a search value match a document, in which
+// search properties and how each term contributes to the score.  Searches are
+// not ranked yet so every matching term contributes 1.  The document matched
+// when a search with operator would find it.
+func (i *Index) Explain(documentId string, value string, operator Operator) (ExplainResult, error) {
+	document, ok := i.GetDocument(documentId)
+	if !ok {
+		return ExplainResult{}, fmt.Errorf("%w: %s", ErrDocumentNotFound, documentId)
+	}
+
+	contents, err := document.Contents()
+	if err != nil {
+		return ExplainResult{}, err
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	an := i.getAnalyzer()
+
+	// the occurrences of each term in each search property
+	fieldFreqs := make(map[string]map[string]int)
+	for _, property := range i.SearchProperties {
+		text, ok := contents[property].(string)
+		if !ok {
+			continue
+		}
+		freqs := make(map[string]int)
+		for _, term := range an.tokens(text) {
+			freqs[term]++
+		}
+		fieldFreqs[property] = freqs
+	}
+
+	result := ExplainResult{Id: documentId}
+	terms := i.queryTerms(value)
+	details := make([]Explanation, 0, len(terms))
+	for _, term := range terms {
+		if !i.postings.contains(documentId, term) {
+			details = append(details, Explanation{
+				Value:       0,
+				Description: fmt.Sprintf("no match on term \"%s\"", term),
+			})
+			continue
+		}
+
+		fields := make([]Explanation, 0)
+		for _, property := range i.SearchProperties {
+			if freq := fieldFreqs[property][term]; freq > 0 {
+				fields = append(fields, Explanation{
+					Value:       float64(freq),
+					Description: fmt.Sprintf("termFreq in field \"%s\"", property),
+				})
+			}
+		}
+
+		result.Explanation.Value++
+		details = append(details, Explanation{
+			Value:       1,
+			Description: fmt.Sprintf("match on term \"%s\"", term),
+			Details:     fields,
+		})
+	}
+
+	matched := int(result.Explanation.Value)
+	if operator == OperatorAnd {
+		result.Matched = len(terms) > 0 && matched == len(terms)
+	} else {
+		result.Matched = matched > 0
+	}
+	result.Explanation.Description = "sum of matching terms"
+	result.Explanation.Details = details
+
+	return result, nil
+}
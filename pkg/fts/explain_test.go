@@ -0,0 +1,73 @@
+package fts
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	indexManager, err := NewIndexManager(NewMemoryStorage(), "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := MakeIndex("books", []string{"title", "author"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.AddDocument("1", map[string]interface{}{"title": "the ring and the ring", "author": "Tolkien"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ring := Explanation{Value: 1, Description: `match on term "ring"`, Details: []Explanation{
+		{Value: 2, Description: `termFreq in field "title"`},
+	}}
+	tolkien := Explanation{Value: 1, Description: `match on term "tolkien"`, Details: []Explanation{
+		{Value: 1, Description: `termFreq in field "author"`},
+	}}
+	dune := Explanation{Value: 0, Description: `no match on term "dune"`}
+
+	tests := []struct {
+		name     string
+		value    string
+		operator Operator
+		matched  bool
+		details  []Explanation
+	}{
+		{"one term", "ring", OperatorOr, true, []Explanation{ring}},
+		{"terms in different fields", "Ring Tolkien", OperatorAnd, true, []Explanation{ring, tolkien}},
+		{"repeated terms", "ring ring", OperatorAnd, true, []Explanation{ring}},
+		{"some terms with or", "ring dune", OperatorOr, true, []Explanation{ring, dune}},
+		{"some terms with and", "ring dune", OperatorAnd, false, []Explanation{ring, dune}},
+		{"no terms match", "dune", OperatorOr, false, []Explanation{dune}},
+		{"only stopwords", "the and", OperatorAnd, false, []Explanation{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := index.Explain("1", test.value, test.operator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Matched != test.matched {
+				t.Errorf("matched = %t, want %t", result.Matched, test.matched)
+			}
+			// explanations agree with searches
+			if found := len(index.Search(test.value, test.operator)) == 1; found != result.Matched {
+				t.Errorf("search found the document = %t but matched = %t", found, result.Matched)
+			}
+
+			want := Explanation{Description: "sum of matching terms", Details: test.details}
+			for _, detail := range test.details {
+				want.Value += detail.Value
+			}
+			if !reflect.DeepEqual(result.Explanation, want) {
+				t.Errorf("explanation = %+v, want %+v", result.Explanation, want)
+			}
+		})
+	}
+
+	if _, err := index.Explain("2", "ring", OperatorOr); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("explaining a missing document = %v, want %v", err, ErrDocumentNotFound)
+	}
+}
@@ -1,120 +1,447 @@
 package fts
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrRebuildInProgress = errors.New("index rebuild already in progress")
+	ErrInvalidOperator   = errors.New("invalid operator")
+	ErrInvalidDocument   = errors.New("invalid document")
+)
+
+// Operator is how the terms of a search are combined.
+type Operator string
+
+const (
+	// OperatorOr matches documents containing any of the terms.
+	OperatorOr Operator = "or"
+	// OperatorAnd matches documents containing all of the terms.
+	OperatorAnd Operator = "and"
+)
+
+// ParseOperator parses a search operator.  An empty string is OperatorOr.
+func ParseOperator(s string) (Operator, error) {
+	switch Operator(strings.ToLower(s)) {
+	case "", OperatorOr:
+		return OperatorOr, nil
+	case OperatorAnd:
+		return OperatorAnd, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidOperator, s)
+	}
+}
+
+// cacheEpoch distinguishes the cache generations of this process from those of
+// earlier runs sharing the same cache.
+var cacheEpoch = uuid.New().String()
+
+// cacheGenerations is the last cache generation handed out to any index.
+// Generations come from one sequence so an index replacing another with the
+// same id never reuses one of its generations.
+var cacheGenerations atomic.Uint64
+
 // Index struct
 type Index struct {
-	Id               string              `json:"id"`
-	SearchProperties []string            `json:"searchProperties"`
-	Documents        []Document          `json:"documents,omitempty"`
-	InvertedIndex    map[string][]string `json:"-"`
-	mu               sync.Mutex          `json:"-"`
+	Id               string      `json:"id"`
+	SearchProperties []string    `json:"searchProperties"`
+	Analysis         *Analysis   `json:"analysis,omitempty"`
+	Compression      Compression `json:"compression,omitempty"`
+	Documents        []Document  `json:"documents,omitempty"`
+	postings         *segments
+	mu               sync.RWMutex `json:"-"`
+	checkpointMu     sync.Mutex
+	analyzerOnce     sync.Once
+	analyzer         *analyzer
+	rebuild          *rebuild
+	counters         indexCounters
+	cacheGeneration  atomic.Uint64
+	searches         searchCalls
+	wal              *wal
+	checkpointLsn    uint64
+	generation       uint64
+	storage          Storage
+	store            *docStore
+	retired          []*docStore
+	positions        map[string]int
+	legacy           []string
+	pinned           map[string]int
+	stale            bool
+	merging          bool
+	destroyed        bool
+}
+
+// IndexSettings are the properties of an index that can be changed in place.
+type IndexSettings struct {
+	SearchProperties []string  `json:"searchProperties"`
+	Analysis         *Analysis `json:"analysis,omitempty"`
+}
+
+// rebuild tracks the documents changed while an online rebuild is running.
+type rebuild struct {
+	changed map[string]struct{}
 }
 
 // MakeIndex initializes and Index
 func MakeIndex(name string, searchProperties []string) Index {
-	return Index{Id: name, SearchProperties: searchProperties, Documents: make([]Document, 0, 10), InvertedIndex: make(map[string][]string)}
+	return Index{Id: name, SearchProperties: searchProperties, Documents: make([]Document, 0, 10), postings: newSegments()}
 }
 
-func (i *Index) Validate() error {
-	if i.Id == "" {
+// indexIdPattern restricts index ids to ones that are safe as directory names.
+var indexIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// validateIndexId checks that id can name an index.
+func validateIndexId(id string) error {
+	if id == "" {
 		return errors.New("Index must have Id property.")
 	}
+	if !indexIdPattern.MatchString(id) {
+		return fmt.Errorf("Index id %q must start with a letter or digit and contain only letters, digits, '.', '_' and '-'.", id)
+	}
+	return nil
+}
+
+func (i *Index) Validate() error {
+	if err := validateIndexId(i.Id); err != nil {
+		return err
+	}
 
-	if len(i.SearchProperties) == 0 {
-		return errors.New("Index must have searchProperties property.")
+	if err := i.Compression.Validate(); err != nil {
+		return err
 	}
 
-	return nil
+	return i.Settings().Validate()
 }
 
-// AddDocument
-func (i *Index) indexDocument(docId string, doc map[string]interface{}) error {
-	if i.InvertedIndex == nil {
-		i.InvertedIndex = make(map[string][]string)
+// MarshalJSON encodes the index while holding its lock so it can't change
+// part way through.
+func (i *Index) MarshalJSON() ([]byte, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.marshal()
+}
+
+// marshal encodes the index.  The documents are kept by the checkpoint so the
+// catalog doesn't change as documents are written; they are only read from
+// catalogs written before that.  The caller must hold the lock.
+func (i *Index) marshal() ([]byte, error) {
+	return json.Marshal(struct {
+		Id               string      `json:"id"`
+		SearchProperties []string    `json:"searchProperties"`
+		Analysis         *Analysis   `json:"analysis,omitempty"`
+		Compression      Compression `json:"compression,omitempty"`
+	}{i.Id, i.SearchProperties, i.Analysis, i.Compression})
+}
+
+// Validate checks that the settings can be applied to an index.
+func (s IndexSettings) Validate() error {
+	if len(s.SearchProperties) == 0 {
+		return errors.New("Index must have searchProperties property.")
 	}
-	for _, property := range i.SearchProperties {
-		value, ok := doc[property]
-		if !ok {
-			return errors.New(fmt.Sprintf("Document %s does not have search property %s", docId, property))
+
+	return s.Analysis.Validate()
+}
+
+// Settings returns the index's current settings.
+func (i *Index) Settings() IndexSettings {
+	return IndexSettings{SearchProperties: i.SearchProperties, Analysis: i.Analysis}
+}
+
+// getAnalyzer returns the analyzer for the index's current analysis settings.
+func (i *Index) getAnalyzer() *analyzer {
+	i.analyzerOnce.Do(func() {
+		if i.analyzer == nil {
+			i.analyzer = newAnalyzer(i.Analysis)
 		}
+	})
+	return i.analyzer
+}
 
-		stringValue, ok := value.(string)
-		if !ok {
-			return errors.New(fmt.Sprintf("Error generating index.  Document %s could not convert propery %s to string", docId, property))
+// searchPropertyValue returns the value of a search property of doc, which
+// must be a string.
+func searchPropertyValue(docId string, doc map[string]interface{}, property string) (string, error) {
+	value, ok := doc[property]
+	if !ok {
+		return "", fmt.Errorf("%w: document %s does not have search property %s", ErrInvalidDocument, docId, property)
+	}
+
+	stringValue, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: search property %s of document %s is not a string", ErrInvalidDocument, property, docId)
+	}
+	return stringValue, nil
+}
+
+// validateDocument checks that doc has every search property as a string, so
+// it can be indexed once it is written.
+func validateDocument(searchProperties []string, docId string, doc map[string]interface{}) error {
+	for _, property := range searchProperties {
+		if _, err := searchPropertyValue(docId, doc, property); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		for _, token := range getFilteredTokens(stringValue) {
-			ids := i.InvertedIndex[token]
-			found := false
-			for _, id := range ids {
-				if id == docId {
-					found = true
-				}
-			}
-			if !found {
-				i.InvertedIndex[token] = append(ids, docId)
-			}
+// documentTerms returns the terms of doc's search properties.  When a search
+// property is missing or isn't a string the terms of the properties before it
+// are returned along with the error.
+func documentTerms(searchProperties []string, an *analyzer, docId string, doc map[string]interface{}) ([]string, error) {
+	terms := make([]string, 0)
+	for _, property := range searchProperties {
+		value, err := searchPropertyValue(docId, doc, property)
+		if err != nil {
+			return terms, err
 		}
+
+		terms = append(terms, an.tokens(value)...)
 	}
 
-	return nil
+	return terms, nil
 }
 
-// AddDocument adds a document to the index
-func (i *Index) AddDocument(id string, doc map[string]interface{}) (string, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
+// indexDocument adds a document to the inverted index's buffer, replacing any
+// previous version.  The caller must hold the lock.
+func (i *Index) indexDocument(docId string, doc map[string]interface{}) error {
+	if i.postings == nil {
+		i.postings = newSegments()
+	}
+
+	terms, err := documentTerms(i.SearchProperties, i.getAnalyzer(), docId, doc)
+	if i.postings.put(docId, terms) {
+		i.maybeMerge()
+	}
+
+	return err
+}
+
+// CacheGeneration identifies the current contents and settings of the index.
+// It changes whenever either does, so cached search results keyed on it
+// become unreachable as soon as the index changes.  It must be read before
+// searching so results are never cached under a newer generation than the
+// one they were computed from.
+func (i *Index) CacheGeneration() string {
+	return fmt.Sprintf("%s.%d", cacheEpoch, i.cacheGeneration.Load())
+}
+
+// invalidateCache moves the index to a new cache generation.  It is called
+// after a change is made so searches that read the old generation can only
+// cache their results under it.
+func (i *Index) invalidateCache() {
+	i.cacheGeneration.Store(cacheGenerations.Add(1))
+}
 
+// AddDocument adds a document to the index, replacing any document with the
+// same id.  An id is generated when id is empty.
+func (i *Index) AddDocument(id string, doc map[string]interface{}) (string, error) {
 	// create an id
 	if id == "" {
 		id = fmt.Sprintf("%s", uuid.New())
 	}
 
-	// save the contents to a file
-	filePath := fmt.Sprintf("indexes/%s/%s.json", i.Id, id)
+	return id, i.mutate(walRecord{Op: walAdd, Id: id, Document: doc})
+}
+
+// Replace document replaces a document in an index.
+func (i *Index) ReplaceDocument(id string, doc map[string]interface{}) error {
+	if _, ok := i.GetDocument(id); !ok {
+		return fmt.Errorf("%w: %s", ErrDocumentNotFound, id)
+	}
+
+	return i.mutate(walRecord{Op: walReplace, Id: id, Document: doc})
+}
+
+// DeleteDocument deletes a document from the index
+func (i *Index) DeleteDocument(documentId string) error {
+	if _, ok := i.GetDocument(documentId); !ok {
+		return fmt.Errorf("%w: %s", ErrDocumentNotFound, documentId)
+	}
+
+	return i.mutate(walRecord{Op: walDelete, Id: documentId})
+}
+
+// mutate records a mutation in the write-ahead log, applies it and then waits
+// for the log record to be durable.  The log is written and the mutation
+// applied under the lock so replaying the log repeats the same order.  A
+// document that can't be indexed is rejected before anything is written.
+func (i *Index) mutate(record walRecord) error {
+	i.mu.Lock()
+	if record.Op != walDelete {
+		if err := validateDocument(i.SearchProperties, record.Id, record.Document); err != nil {
+			i.mu.Unlock()
+			i.counters.indexingFailures.Add(1)
+			return err
+		}
+	}
+
+	w, err := i.getWal()
+	if err != nil {
+		i.mu.Unlock()
+		return err
+	}
+
+	lsn, err := w.append(record)
+	if err != nil {
+		i.mu.Unlock()
+		return err
+	}
+
+	applyErr := i.apply(record)
+	i.mu.Unlock()
+
+	if err := w.sync(lsn); err != nil {
+		return err
+	}
+
+	return applyErr
+}
+
+// apply applies a mutation to the documents and the inverted index.  It is
+// used both for new mutations and when replaying the write-ahead log, so
+// applying a record more than once has the same effect as applying it once.
+// The caller must hold the lock.
+func (i *Index) apply(record walRecord) error {
+	i.stale = true
+	i.markChanged(record.Id)
+	defer i.invalidateCache()
+
+	switch record.Op {
+	case walAdd, walReplace:
+		return i.putDocument(record.Id, record.Document)
+	case walDelete:
+		return i.removeDocument(record.Id)
+	default:
+		return fmt.Errorf("Unknown write-ahead log operation %s", record.Op)
+	}
+}
 
+// putDocument appends a document to the document store and indexes it.  The caller must hold the lock.
+func (i *Index) putDocument(id string, doc map[string]interface{}) error {
 	bytes, err := json.Marshal(doc)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	jsonFile, err := os.Create(filePath)
+	store, err := i.getStore()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer jsonFile.Close()
 
-	jsonFile.Write(bytes)
+	// the write-ahead log makes the record durable until the next checkpoint
+	offset, length, err := store.append(id, bytes, false, i.Compression)
+	if err != nil {
+		return err
+	}
 
-	// add the document to the index
-	d := Document{id, filePath}
-	i.Documents = append(i.Documents, d)
+	// add the document to the index, replacing the previous version.  Indexing
+	// the new version replaces the old one in the inverted index.
+	d := Document{Id: id, Offset: offset, Length: length, Checksum: checksum(bytes), store: store}
+	if position, ok := i.documentPosition(id); ok {
+		if err := i.discardDocument(i.Documents[position]); err != nil {
+			log.Printf("Error discarding the previous version of document %s: %s", id, err)
+		}
+		i.Documents[position] = d
+	} else {
+		if i.positions == nil {
+			i.positions = make(map[string]int)
+		}
+		i.positions[id] = len(i.Documents)
+		i.Documents = append(i.Documents, d)
+	}
 
 	// index the document
 	if err := i.indexDocument(id, doc); err != nil {
-		return id, err
+		i.counters.indexingFailures.Add(1)
+		return err
 	}
 
-	return id, nil
+	i.counters.documentsIndexed.Add(1)
+	return nil
 }
 
-// Replace document replaces a document in an index.
-func (i *Index) ReplaceDocument(document DocumentJson) {
-	// find the document from the index.  Not cool since it is a slice
-	// and not a map
+// removeDocument records a document's deletion and removes its terms.  The caller must hold the lock.
+func (i *Index) removeDocument(id string) error {
+	position, ok := i.documentPosition(id)
+	if !ok {
+		return nil
+	}
+
+	store, err := i.getStore()
+	if err != nil {
+		return err
+	}
+
+	// the deletion is only read back when the store has to be scanned
+	_, length, err := store.append(id, nil, true, CompressionNone)
+	if err != nil {
+		return err
+	}
+	store.garbage += length
+
+	document := i.Documents[position]
+	if i.postings != nil {
+		i.postings.remove(id)
+		i.maybeMerge()
+	}
+	// the last document takes the place of the removed one
+	last := len(i.Documents) - 1
+	i.Documents[position] = i.Documents[last]
+	i.positions[i.Documents[position].Id] = position
+	i.Documents = i.Documents[:last]
+	delete(i.positions, id)
+	i.counters.documentsDeleted.Add(1)
+
+	return i.discardDocument(document)
+}
+
+// discardDocument releases the storage of a replaced or deleted document.
+// Its record in the document store becomes garbage and a document file that
+// was never migrated into the store is removed.  The caller must hold the lock.
+func (i *Index) discardDocument(document Document) error {
+	if document.stored() {
+		if document.store == i.store {
+			i.store.garbage += document.Length
+		}
+		return nil
+	}
+
+	name, err := i.legacyPath(document)
+	if err != nil {
+		return err
+	}
+	if err := i.storage.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// documentPosition returns the position of a document in Documents.  The caller must hold the lock.
+func (i *Index) documentPosition(documentId string) (int, bool) {
+	position, ok := i.positions[documentId]
+	return position, ok
+}
 
-	// re-write out the file
+// setDocuments replaces the index's documents and works out their positions.
+// The caller must hold the lock.
+func (i *Index) setDocuments(documents []Document) {
+	i.Documents = documents
+	i.positions = make(map[string]int, len(documents))
+	for j, document := range documents {
+		i.positions[document.Id] = j
+	}
 }
 
 // Build builds the index
@@ -122,89 +449,245 @@ func (i *Index) Build() error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	for _, document := range i.Documents {
-		if _, err := os.Stat(document.Path); os.IsNotExist(err) {
-			log.Printf("Error during index generation.  File not found: %s", document.Path)
-		}
+	return i.build()
+}
+
+// build regenerates the inverted index from the persisted documents.  The
+// caller must hold the lock.  Documents that are missing or corrupt are left
+// out of the inverted index and reported in the returned error.
+func (i *Index) build() error {
+	start := time.Now()
+	postings := newSegments()
+	an := i.getAnalyzer()
+	unreadable := make([]string, 0)
 
-		jsonFile, err := os.Open(document.Path)
+	for _, document := range i.Documents {
+		jsonMap, err := document.Contents()
 		if err != nil {
-			panic(err)
+			log.Printf("Error during index generation.  Could not read %s: %s", document.Path, err)
+			unreadable = append(unreadable, document.Id)
+			continue
 		}
 
-		bytes, _ := ioutil.ReadAll(jsonFile)
-		var jsonData interface{}
-		json.Unmarshal(bytes, &jsonData)
-
-		jsonMap := jsonData.(map[string]interface{})
-
-		err = i.indexDocument(document.Id, jsonMap)
+		terms, err := documentTerms(i.SearchProperties, an, document.Id, jsonMap)
 		if err != nil {
 			log.Printf("Error indexing document %s, Error: %s", document.Id, err)
 		}
-		jsonFile.Close()
+		postings.put(document.Id, terms)
 	}
 
+	i.postings = postings
+	i.invalidateCache()
+	i.maybeMerge()
+	i.counters.lastBuildTime = start
+	i.counters.lastBuildDuration = time.Since(start)
+
+	if len(unreadable) > 0 {
+		return fmt.Errorf("%w: index %s has %d missing or corrupt documents: %s",
+			ErrCorruptDocument, i.Id, len(unreadable), strings.Join(unreadable, ", "))
+	}
 	return nil
 }
 
-// Destroy destroys the data assoicated with the index
-func (i *Index) Destroy() {
-	os.RemoveAll(fmt.Sprintf("indexes/%s", i.Id))
+// BeginRebuild starts tracking changes for an online rebuild.  Only one
+// rebuild can run at a time.
+func (i *Index) BeginRebuild() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.rebuild != nil {
+		return fmt.Errorf("%w: %s", ErrRebuildInProgress, i.Id)
+	}
+
+	i.rebuild = &rebuild{changed: make(map[string]struct{})}
+	return nil
 }
 
-// GetDocument gets a document from the index.
-func (i *Index) GetDocument(documentId string) (Document, bool) {
-	for _, document := range i.Documents {
-		if document.Id == documentId {
-			return document, true
+// Rebuild regenerates the inverted index with new settings.  The existing
+// inverted index keeps serving searches until the new one is complete and is
+// then swapped in.  BeginRebuild must have been called first.
+func (i *Index) Rebuild(ctx context.Context, task *Task, settings IndexSettings) error {
+	start := time.Now()
+	documents := i.documents()
+	an := newAnalyzer(settings.Analysis)
+	postings := newSegments()
+
+	task.SetTotal(len(documents))
+	for _, document := range documents {
+		if ctx.Err() != nil {
+			i.mu.Lock()
+			i.rebuild = nil
+			i.mu.Unlock()
+			return ctx.Err()
+		}
+
+		contents, err := document.Contents()
+		if err == nil {
+			var terms []string
+			terms, err = documentTerms(settings.SearchProperties, an, document.Id, contents)
+			postings.put(document.Id, terms)
+		}
+		if err != nil {
+			task.Fail(err)
+			continue
 		}
+		task.Progress()
 	}
-	return Document{}, false
-}
 
-// DeleteDocument deletes a document from the index
-func (i *Index) DeleteDocument(documentId string) {
-	// TODO this is probably not going to scale.
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	found := false
-	foundIndex := 0
-	for j, document := range i.Documents {
-		if document.Id == documentId {
-			found = true
-			foundIndex = j
+	// catch up with the documents added or deleted during the rebuild
+	for id := range i.rebuild.changed {
+		postings.remove(id)
+
+		document, ok := i.getDocument(id)
+		if !ok {
+			continue
 		}
 
-		if found {
-			break
+		contents, err := document.Contents()
+		if err == nil {
+			var terms []string
+			terms, err = documentTerms(settings.SearchProperties, an, id, contents)
+			postings.put(id, terms)
 		}
+		if err != nil {
+			log.Printf("Error indexing document %s, Error: %s", id, err)
+		}
+	}
+
+	i.SearchProperties = settings.SearchProperties
+	i.Analysis = settings.Analysis
+	i.analyzer = an
+	i.postings = postings
+	i.rebuild = nil
+	i.stale = true
+	i.invalidateCache()
+	i.maybeMerge()
+	i.counters.lastBuildTime = start
+	i.counters.lastBuildDuration = time.Since(start)
+
+	return nil
+}
+
+// markChanged records a changed document for a running rebuild.  The caller
+// must hold the lock.
+func (i *Index) markChanged(documentId string) {
+	if i.rebuild != nil {
+		i.rebuild.changed[documentId] = struct{}{}
+	}
+}
+
+// dir returns the directory holding the index's documents.
+func (i *Index) dir() string {
+	return indexDir(i.Id)
+}
+
+// indexDir returns the directory holding the documents of the index with id.
+func indexDir(id string) string {
+	return fmt.Sprintf("indexes/%s", id)
+}
+
+// Destroy destroys the data assoicated with the index
+func (i *Index) Destroy() error {
+	i.checkpointMu.Lock()
+	defer i.checkpointMu.Unlock()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.wal != nil {
+		i.wal.close()
+		i.wal = nil
+	}
+	if i.store != nil {
+		i.store.close()
+		i.store = nil
+	}
+	i.closeRetired()
+	i.destroyed = true
+	if err := i.storage.RemoveAll(i.dir()); err != nil {
+		return fmt.Errorf("removing files of index %s: %w", i.Id, err)
+	}
+	return nil
+}
+
+// GetDocument gets a document from the index.
+func (i *Index) GetDocument(documentId string) (Document, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.getDocument(documentId)
+}
+
+// getDocument gets a document from the index.  The caller must hold the lock.
+func (i *Index) getDocument(documentId string) (Document, bool) {
+	if position, ok := i.documentPosition(documentId); ok {
+		return i.Documents[position], true
 	}
-	ret := make([]Document, 0)
+	return Document{}, false
+}
+
+// ListDocuments returns a copy of the index's documents.  Their contents can
+// be read without holding the index's lock.
+func (i *Index) ListDocuments() []Document {
+	return i.documents()
+}
 
-	ret = append(ret, i.Documents[:foundIndex]...)
-	ret = append(ret, i.Documents[foundIndex+1:]...)
-	i.Documents = ret
+// documents returns a copy of the index's documents.
+func (i *Index) documents() []Document {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 
-	i.Build()
+	return append([]Document(nil), i.Documents...)
 }
 
+// SearchValue returns the ids of the documents matching any of the terms of value.
 func (i *Index) SearchValue(value string) []string {
-	set := make(map[string]struct{})
+	return i.Search(value, OperatorOr)
+}
+
+// QueryTerms returns the terms searched for value.  Values with the same terms
+// have the same results.
+func (i *Index) QueryTerms(value string) []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
 
-	for _, token := range getFilteredTokens(value) {
-		if ids, ok := i.InvertedIndex[token]; ok {
-			for _, id := range ids {
-				set[id] = struct{}{}
-			}
+	return i.queryTerms(value)
+}
+
+// queryTerms returns the terms searched for value.  The caller must hold the
+// lock.
+func (i *Index) queryTerms(value string) []string {
+	// repeated terms don't change the result
+	seen := make(map[string]struct{})
+	terms := make([]string, 0)
+	for _, token := range i.getAnalyzer().tokens(value) {
+		if _, ok := seen[token]; !ok {
+			seen[token] = struct{}{}
+			terms = append(terms, token)
 		}
 	}
+	return terms
+}
 
+// Search returns the ids of the documents matching the terms of value,
+// combined with operator.
+func (i *Index) Search(value string, operator Operator) []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.counters.searches.Add(1)
+
+	terms := i.queryTerms(value)
 	r := []string{}
-	for k := range set {
-		r = append(r, k)
+	if len(terms) == 0 {
+		return r
 	}
 
+	i.postings.search(terms, operator == OperatorAnd, func(id string) {
+		r = append(r, id)
+	})
+
 	return r
 }
@@ -0,0 +1,445 @@
+package fts
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/calebpalmer/simpleftsservice/internal/cache"
+)
+
+func TestDocumentPositions(t *testing.T) {
+	index := MakeIndex("books", []string{"title"})
+	index.storage = NewMemoryStorage()
+
+	random := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+	for j := 0; j < 2000; j++ {
+		id := fmt.Sprintf("doc-%d", random.Intn(200))
+		if random.Intn(3) == 0 {
+			if err := index.DeleteDocument(id); err != nil && len(want[id]) > 0 {
+				t.Fatalf("deleting %s: %s", id, err)
+			}
+			delete(want, id)
+			continue
+		}
+
+		title := fmt.Sprintf("title %d", j)
+		if _, err := index.AddDocument(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatalf("writing %s: %s", id, err)
+		}
+		want[id] = title
+	}
+
+	documents := index.ListDocuments()
+	if len(documents) != len(want) {
+		t.Fatalf("index has %d documents, want %d", len(documents), len(want))
+	}
+	for id, title := range want {
+		document, ok := index.GetDocument(id)
+		if !ok {
+			t.Fatalf("document %s is missing", id)
+		}
+		contents, err := document.Contents()
+		if err != nil {
+			t.Fatalf("reading %s: %s", id, err)
+		}
+		if contents["title"] != title {
+			t.Errorf("document %s has title %v, want %q", id, contents["title"], title)
+		}
+	}
+}
+
+func TestCatalogDoesNotChangeWithDocuments(t *testing.T) {
+	storage := NewMemoryStorage()
+	indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := MakeIndex("books", []string{"title"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := storage.ReadFile("indexes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for j := 0; j < 10; j++ {
+		if _, err := index.AddDocument(fmt.Sprint(j), map[string]interface{}{"title": fmt.Sprint("book ", j)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.DeleteDocument("3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after, err := storage.ReadFile("indexes.json"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(after, catalog) {
+		t.Errorf("catalog changed from %s to %s", catalog, after)
+	}
+
+	// the documents come back from the checkpoint
+	reopened, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := reopened.GetIndex("books")
+	ids := make([]string, 0)
+	for _, document := range books.ListDocuments() {
+		ids = append(ids, document.Id)
+	}
+	sort.Strings(ids)
+	if fmt.Sprint(ids) != "[0 1 2 4 5 6 7 8 9]" {
+		t.Errorf("reopened index has documents %v", ids)
+	}
+	if _, ok := books.GetDocument("3"); ok {
+		t.Error("deleted document 3 was reopened")
+	}
+}
+
+func TestCountsMatchStats(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	index, _ := indexManager.GetIndex("books")
+	for j := 0; j < 20; j++ {
+		if _, err := index.AddDocument(fmt.Sprint(j%15), map[string]interface{}{"title": fmt.Sprintf("book %d", j)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.DeleteDocument("3"); err != nil {
+		t.Fatal(err)
+	}
+	index.Search("book", OperatorOr)
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := index.Counts()
+	stats, err := index.Stats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := IndexCounts{
+		Id:                stats.Id,
+		DocumentCount:     stats.DocumentCount,
+		Segments:          stats.Segments,
+		StoreSizeBytes:    stats.StoreSizeBytes,
+		StoreGarbageBytes: stats.StoreGarbageBytes,
+		Searches:          stats.Searches,
+		SearchesCoalesced: stats.SearchesCoalesced,
+		DocumentsIndexed:  stats.DocumentsIndexed,
+		IndexingFailures:  stats.IndexingFailures,
+		DocumentsDeleted:  stats.DocumentsDeleted,
+		// terms held by the replaced and deleted versions are counted until
+		// they are merged away, see TestUniqueTermsCount
+		UniqueTerms: counts.UniqueTerms,
+	}
+	if counts != want {
+		t.Errorf("counts = %+v, want %+v", counts, want)
+	}
+	if counts.DocumentCount != 14 || counts.StoreSizeBytes == 0 || counts.Searches != 1 {
+		t.Errorf("counts = %+v, want 14 documents, a document store and 1 search", counts)
+	}
+}
+
+func TestUniqueTermsCount(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	index, _ := indexManager.GetIndex("books")
+	wantTerms := func(counted int, live int) {
+		t.Helper()
+		stats, err := index.Stats(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := index.Counts().UniqueTerms; got != counted || stats.UniqueTerms != live {
+			t.Errorf("counted %d terms and stats has %d, want %d and %d", got, stats.UniqueTerms, counted, live)
+		}
+	}
+
+	for id, title := range map[string]string{"2": "dune", "3": "dune messiah", "4": "the hobbit"} {
+		if _, err := index.AddDocument(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantTerms(3, 3)
+
+	// the replaced and deleted versions keep their postings
+	if err := index.ReplaceDocument("3", map[string]interface{}{"title": "dune heretics"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "4"} {
+		if err := index.DeleteDocument(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantTerms(4, 2)
+
+	// until merging all the segments drops them
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	waitForMerges(t, index)
+	postings := index.postings
+	candidates := append([]*segment(nil), postings.flushed...)
+	deleted := make([]bitset, len(candidates))
+	for c, s := range candidates {
+		deleted[c] = s.deleted.clone()
+	}
+	index.mu.Unlock()
+	index.merge(postings, candidates, deleted)
+	waitForMerges(t, index)
+	index.mu.Unlock()
+	wantTerms(2, 2)
+
+	// rebuilding counts the terms afresh
+	if err := index.Build(); err != nil {
+		t.Fatal(err)
+	}
+	wantTerms(2, 2)
+}
+
+func TestSearchAfterChangeMissesCache(t *testing.T) {
+	tests := []struct {
+		name string
+		// change changes the index and returns the index then searched
+		change func(indexManager *IndexManager, index *Index) (*Index, error)
+		want   string
+	}{
+		{"add", func(indexManager *IndexManager, index *Index) (*Index, error) {
+			_, err := index.AddDocument("2", map[string]interface{}{"title": "the hobbit returns"})
+			return index, err
+		}, "[1 2]"},
+		{"replace", func(indexManager *IndexManager, index *Index) (*Index, error) {
+			return index, index.ReplaceDocument("1", map[string]interface{}{"title": "dune"})
+		}, "[]"},
+		{"delete", func(indexManager *IndexManager, index *Index) (*Index, error) {
+			return index, index.DeleteDocument("1")
+		}, "[]"},
+		{"delete index", func(indexManager *IndexManager, index *Index) (*Index, error) {
+			if err := indexManager.DeleteIndex("books"); err != nil {
+				return nil, err
+			}
+			books := MakeIndex("books", []string{"title"})
+			if err := indexManager.AddIndex(&books); err != nil {
+				return nil, err
+			}
+			_, err := books.AddDocument("3", map[string]interface{}{"title": "hobbit"})
+			return &books, err
+		}, "[3]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lru := cache.NewLRU(1<<20, cache.Options{KeyPrefix: cache.DefaultKeyPrefix, MaxItemBytes: cache.DefaultMaxItemBytes})
+			indexManager, err := NewIndexManager(NewMemoryStorage(), "indexes.json", lru)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index := MakeIndex("books", []string{"title"})
+			if err := indexManager.AddIndex(&index); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := index.AddDocument("1", map[string]interface{}{"title": "the hobbit"}); err != nil {
+				t.Fatal(err)
+			}
+
+			// search caches its results the way the search handler does
+			search := func(index *Index) (string, bool) {
+				generation := index.CacheGeneration()
+				query := strings.Join(index.QueryTerms("hobbit"), " ")
+				if cached, _ := lru.Get(index.Id, generation, query, ""); cached != nil {
+					return string(cached), true
+				}
+				ids := index.Search("hobbit", OperatorOr)
+				sort.Strings(ids)
+				lru.Add(index.Id, generation, query, "", []byte(fmt.Sprint(ids)))
+				return fmt.Sprint(ids), false
+			}
+			if ids, hit := search(&index); ids != "[1]" || hit {
+				t.Fatalf("first search = %s, hit %t", ids, hit)
+			}
+			if ids, hit := search(&index); ids != "[1]" || !hit {
+				t.Fatalf("repeated search = %s, hit %t, want a hit", ids, hit)
+			}
+
+			changed, err := test.change(indexManager, &index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids, hit := search(changed); ids != test.want || hit {
+				t.Errorf("search after the change = %s, hit %t, want %s from a miss", ids, hit, test.want)
+			}
+		})
+	}
+}
+
+// readBlockingStorage is a MemoryStorage where the first read of a file once
+// block is set waits until released.
+type readBlockingStorage struct {
+	*MemoryStorage
+	block   atomic.Bool
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *readBlockingStorage) OpenFile(name string) (File, error) {
+	file, err := s.MemoryStorage.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readBlockingFile{File: file, storage: s}, nil
+}
+
+// readBlockingFile is a file of a readBlockingStorage.
+type readBlockingFile struct {
+	File
+	storage *readBlockingStorage
+}
+
+func (f *readBlockingFile) ReadAt(p []byte, offset int64) (int, error) {
+	if f.storage.block.CompareAndSwap(true, false) {
+		f.storage.reading <- struct{}{}
+		<-f.storage.release
+	}
+	return f.File.ReadAt(p, offset)
+}
+
+func TestRebuild(t *testing.T) {
+	storage := &readBlockingStorage{MemoryStorage: NewMemoryStorage(), reading: make(chan struct{}), release: make(chan struct{})}
+	indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := MakeIndex("books", []string{"title"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	write := func(id string, title string, author string) {
+		t.Helper()
+		if _, err := index.AddDocument(id, map[string]interface{}{"title": title, "author": author}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("1", "the hobbit", "tolkien")
+	write("2", "dune", "herbert")
+	write("3", "the silmarillion", "tolkien")
+
+	search := func(index *Index, value string, want string) {
+		t.Helper()
+		ids := index.Search(value, OperatorOr)
+		sort.Strings(ids)
+		if fmt.Sprint(ids) != want {
+			t.Errorf("search %q = %v, want %s", value, ids, want)
+		}
+	}
+
+	// the rebuild waits on reading its first document
+	storage.block.Store(true)
+	settings := IndexSettings{SearchProperties: []string{"title", "author"}, Analysis: &Analysis{Filters: []string{LowercaseFilter}}}
+	task, err := indexManager.UpdateIndex("books", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-storage.reading
+
+	if _, err := indexManager.UpdateIndex("books", settings); !errors.Is(err, ErrRebuildInProgress) {
+		t.Errorf("second UpdateIndex = %v, want %v", err, ErrRebuildInProgress)
+	}
+
+	// searches are served with the old settings while documents change
+	search(&index, "tolkien", "[]")
+	search(&index, "hobbit", "[1]")
+	write("4", "dune messiah", "herbert")
+	write("2", "Dune", "frank herbert")
+	if err := index.DeleteDocument("3"); err != nil {
+		t.Fatal(err)
+	}
+	search(&index, "dune", "[2 4]")
+	search(&index, "silmarillion", "[]")
+
+	close(storage.release)
+	if info := waitForTask(t, task); info.Status != TaskCompleted || info.Failed != 0 {
+		t.Fatalf("rebuild finished %+v", info)
+	}
+
+	// the changes made during the rebuild are caught up with
+	wantSearches := func(index *Index) {
+		t.Helper()
+		search(index, "tolkien", "[1]")
+		search(index, "herbert", "[2 4]")
+		search(index, "frank", "[2]")
+		search(index, "silmarillion", "[]")
+		search(index, "the", "[1]")
+	}
+	wantSearches(&index)
+
+	// the new settings are saved
+	reopened, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := reopened.GetIndex("books")
+	if got := books.Settings(); !reflect.DeepEqual(got, settings) {
+		t.Errorf("settings after reopening = %+v, want %+v", got, settings)
+	}
+	wantSearches(books)
+}
+
+func TestRebuildCancelled(t *testing.T) {
+	storage := &readBlockingStorage{MemoryStorage: NewMemoryStorage(), reading: make(chan struct{}), release: make(chan struct{})}
+	indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := MakeIndex("books", []string{"title"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 10; j++ {
+		if _, err := index.AddDocument(fmt.Sprint(j), map[string]interface{}{"title": fmt.Sprintf("book %d", j), "author": "tolkien"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage.block.Store(true)
+	settings := IndexSettings{SearchProperties: []string{"author"}}
+	task, err := indexManager.UpdateIndex("books", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-storage.reading
+	indexManager.Tasks.Cancel(task.Info().Id)
+	close(storage.release)
+
+	if info := waitForTask(t, task); info.Status != TaskCancelled {
+		t.Fatalf("rebuild finished %+v", info)
+	}
+	if ids := index.Search("book", OperatorOr); len(ids) != 10 {
+		t.Errorf("search after a cancelled rebuild found %d documents, want 10", len(ids))
+	}
+	if got := index.Settings(); !reflect.DeepEqual(got.SearchProperties, []string{"title"}) {
+		t.Errorf("settings after a cancelled rebuild = %+v", got)
+	}
+
+	// the index can be rebuilt again
+	task, err = indexManager.UpdateIndex("books", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := waitForTask(t, task); info.Status != TaskCompleted {
+		t.Fatalf("rebuild finished %+v", info)
+	}
+	if ids := index.Search("tolkien", OperatorOr); len(ids) != 10 {
+		t.Errorf("search after rebuilding found %d documents, want 10", len(ids))
+	}
+}
@@ -1,104 +1,568 @@
 package fts
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/calebpalmer/simpleftsservice/internal/cache"
 )
 
+var (
+	ErrIndexNotFound = errors.New("index not found")
+	ErrAliasNotFound = errors.New("alias not found")
+	ErrAliasConflict = errors.New("alias conflicts with an existing index")
+	ErrInvalidAlias  = errors.New("invalid alias action")
+	ErrInvalidIndex  = errors.New("invalid index")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrIndexIsAlias  = errors.New("id is an alias, not an index")
+
+	ErrCorruptCatalog = errors.New("corrupt catalog")
+)
+
 type IndexManager struct {
-	mu      sync.Mutex        `json:"-"`
-	Path    string            `json:"-"`
-	Indexes map[string]*Index `json:"indexes"`
-	Cache   *cache.Cache      `json:"-"`
+	mu           sync.Mutex          `json:"-"`
+	Path         string              `json:"-"`
+	Storage      Storage             `json:"-"`
+	Indexes      map[string]*Index   `json:"indexes"`
+	Aliases      map[string]string   `json:"aliases,omitempty"`
+	Cache        cache.Cache         `json:"-"`
+	CacheMetrics *cache.Metrics      `json:"-"`
+	Tasks        *TaskManager        `json:"-"`
+	Snapshots    *SnapshotRepository `json:"-"`
+
+	// restoring holds the ids of indexes being restored from snapshots.
+	restoring map[string]struct{}
+
+	// stopCheckpointing stops the background checkpoints, which have finished
+	// once checkpointing is done.
+	stopCheckpointing chan struct{}
+	checkpointing     sync.WaitGroup
+}
+
+// AliasSpec names an alias and the index it points at.
+type AliasSpec struct {
+	Index string `json:"index"`
+	Alias string `json:"alias"`
+}
+
+// AliasAction is a single step of an alias update.  Exactly one of Add or
+// Remove must be set.
+type AliasAction struct {
+	Add    *AliasSpec `json:"add,omitempty"`
+	Remove *AliasSpec `json:"remove,omitempty"`
 }
 
-// NewIndexManager creates a new index manager object
-func NewIndexManager(path string, cache *cache.Cache) *IndexManager {
+// catalogVersion is the version of the on disk catalog format.
+const catalogVersion = 1
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return &IndexManager{Path: path, Indexes: make(map[string]*Index), Cache: cache}
+// catalogFile is the on disk envelope of the catalog.  The checksum is the sha256
+// of the catalog bytes so truncated or damaged catalogs are detected on load.
+type catalogFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Catalog  json.RawMessage `json:"catalog"`
+}
+
+// NewIndexManager creates a new index manager object from the catalog at path
+// in storage and loads its indexes.  A catalog that can't be parsed or doesn't
+// match its checksum returns ErrCorruptCatalog.
+func NewIndexManager(storage Storage, path string, cache cache.Cache) (*IndexManager, error) {
+	indexManager, err := openCatalog(storage, path, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, index := range indexManager.Indexes {
+		if err := index.Load(); err != nil {
+			return nil, err
+		}
 	}
 
-	jsonFile, err := os.Open(path)
+	return indexManager, nil
+}
+
+// RecoverIndexManager creates a new index manager object like NewIndexManager
+// but falls back to the backup catalog when the catalog is corrupt, and drops
+// documents whose files are missing or corrupt.  The repaired catalog is saved.
+func RecoverIndexManager(storage Storage, path string, cache cache.Cache) (*IndexManager, error) {
+	indexManager, err := openCatalog(storage, path, cache)
+	if errors.Is(err, ErrCorruptCatalog) {
+		log.Printf("Recovery: %s, restoring from %s", err, backupPath(path))
+		indexManager, err = loadCatalog(storage, backupPath(path))
+		if err != nil {
+			return nil, fmt.Errorf("backup catalog is unusable: %w", err)
+		}
+		indexManager.Path = path
+		indexManager.Cache = cache
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer jsonFile.Close()
 
-	byteValue, _ := ioutil.ReadAll(jsonFile)
+	for _, index := range indexManager.Indexes {
+		if err := index.recover(); err != nil {
+			return nil, err
+		}
+	}
 
-	var indexManager IndexManager
-	json.Unmarshal(byteValue, &indexManager)
-	indexManager.Cache = cache
+	if err := indexManager.Save(); err != nil {
+		return nil, err
+	}
+
+	return indexManager, nil
+}
+
+// openCatalog reads the catalog at path without loading the indexes.
+func openCatalog(storage Storage, path string, cache cache.Cache) (*IndexManager, error) {
+	indexManager, err := loadCatalog(storage, path)
+	if os.IsNotExist(err) {
+		return &IndexManager{Path: path, Storage: storage, Indexes: make(map[string]*Index), Aliases: make(map[string]string), Cache: cache, Tasks: NewTaskManager()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	indexManager.Path = path
+	indexManager.Cache = cache
+	return indexManager, nil
+}
+
+// loadCatalog reads and verifies the catalog at path in storage.
+func loadCatalog(storage Storage, path string) (*IndexManager, error) {
+	bytes, err := storage.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file catalogFile
+	if err := json.Unmarshal(bytes, &file); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrCorruptCatalog, path, err)
+	}
+
+	// catalogs written before checksums were added are the bare catalog
+	catalog := []byte(file.Catalog)
+	if file.Catalog == nil {
+		catalog = bytes
+	} else if checksum(catalog) != file.Checksum {
+		return nil, fmt.Errorf("%w: %s does not match its checksum", ErrCorruptCatalog, path)
+	}
+
+	var indexManager IndexManager
+	if err := json.Unmarshal(catalog, &indexManager); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrCorruptCatalog, path, err)
+	}
+
+	indexManager.Storage = storage
+	indexManager.Tasks = NewTaskManager()
+	if indexManager.Indexes == nil {
+		indexManager.Indexes = make(map[string]*Index)
+	}
+	for _, index := range indexManager.Indexes {
+		index.storage = storage
+	}
+	if indexManager.Aliases == nil {
+		indexManager.Aliases = make(map[string]string)
+	}
 
-	return &indexManager
+	return &indexManager, nil
+}
+
+// backupPath returns the path of the previous version of the catalog.
+func backupPath(path string) string {
+	return path + ".bak"
 }
 
 // Save saves the indexes to persistent storage
 func (indexManager *IndexManager) Save() error {
-	bytes, err := json.Marshal(indexManager)
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	return indexManager.save()
+}
+
+// indexCatalog is the part of the index manager that is saved in the catalog.
+type indexCatalog struct {
+	Indexes map[string]*Index `json:"indexes"`
+	Aliases map[string]string `json:"aliases,omitempty"`
+}
+
+// catalog returns a copy of the indexes and aliases.  The caller must hold the
+// lock.
+func (indexManager *IndexManager) catalog() indexCatalog {
+	catalog := indexCatalog{Indexes: make(map[string]*Index, len(indexManager.Indexes))}
+	for id, index := range indexManager.Indexes {
+		catalog.Indexes[id] = index
+	}
+	if len(indexManager.Aliases) > 0 {
+		catalog.Aliases = make(map[string]string, len(indexManager.Aliases))
+		for alias, target := range indexManager.Aliases {
+			catalog.Aliases[alias] = target
+		}
+	}
+	return catalog
+}
+
+// MarshalJSON encodes the indexes and aliases.  They are copied while holding
+// the lock so they can't change while they are encoded.
+func (indexManager *IndexManager) MarshalJSON() ([]byte, error) {
+	indexManager.mu.Lock()
+	catalog := indexManager.catalog()
+	indexManager.mu.Unlock()
+
+	return json.Marshal(catalog)
+}
+
+// save writes the indexes to persistent storage.  The caller must hold the lock.
+func (indexManager *IndexManager) save() error {
+	catalog, err := json.Marshal(indexManager.catalog())
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	jsonFile, err := os.Create(indexManager.Path)
+	bytes, err := json.Marshal(catalogFile{Version: catalogVersion, Checksum: checksum(catalog), Catalog: catalog})
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	defer jsonFile.Close()
 
-	jsonFile.Write(bytes)
+	// keep the previous catalog around for recovery.  It is copied so the
+	// catalog itself is never missing, even briefly.
+	if previous, err := indexManager.Storage.ReadFile(indexManager.Path); err == nil {
+		if err := indexManager.Storage.WriteFile(backupPath(indexManager.Path), previous); err != nil {
+			log.Printf("Could not back up catalog: %s", err)
+		}
+	}
+
+	if err := indexManager.Storage.WriteFile(indexManager.Path, bytes); err != nil {
+		log.Println(err)
+		return err
+	}
 
 	return nil
 }
 
-// AddIndex adds an index
+// AddIndex adds an index.  ErrInvalidIndex is returned when the index isn't
+// valid and ErrIndexExists when an index or an alias already has its id.
 func (indexManager *IndexManager) AddIndex(index *Index) error {
+	if err := index.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidIndex, err)
+	}
+
 	indexManager.mu.Lock()
 	defer indexManager.mu.Unlock()
 
-	indexManager.Indexes[index.Id] = index
-	if err := indexManager.Save(); err != nil {
+	_, isIndex := indexManager.Indexes[index.Id]
+	_, isAlias := indexManager.Aliases[index.Id]
+	_, isRestoring := indexManager.restoring[index.Id]
+	if isIndex || isAlias || isRestoring {
+		return fmt.Errorf("%w: %s", ErrIndexExists, index.Id)
+	}
+
+	if index.postings == nil {
+		index.postings = newSegments()
+	}
+	// documents are only added through the index, so any given with it
+	// are dropped rather than trusted to point at the index's files
+	index.setDocuments(nil)
+	index.storage = indexManager.Storage
+	index.invalidateCache()
+
+	// files left behind by an index that could not be fully destroyed must not
+	// be loaded into the new one
+	if err := index.storage.RemoveAll(index.dir()); err != nil {
 		return err
 	}
 
-	// Create parent folder for the index
-	if _, err := os.Stat("indexes/" + index.Id); os.IsNotExist(err) {
-		os.MkdirAll("indexes/"+index.Id, os.ModePerm)
+	indexManager.Indexes[index.Id] = index
+	if err := indexManager.save(); err != nil {
+		delete(indexManager.Indexes, index.Id)
+		return err
 	}
 
 	return nil
 }
 
-// GetIndex returns an index
+// GetIndex returns an index by its id or by an alias pointing at it.
 func (indexManager *IndexManager) GetIndex(indexId string) (*Index, bool) {
-	index, ok := indexManager.Indexes[indexId]
-	return index, ok
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	return indexManager.getIndex(indexId)
+}
+
+// getIndex returns an index by its id or by an alias pointing at it.  The
+// caller must hold the lock.
+func (indexManager *IndexManager) getIndex(indexId string) (*Index, bool) {
+	if index, ok := indexManager.Indexes[indexId]; ok {
+		return index, true
+	}
+
+	if target, ok := indexManager.Aliases[indexId]; ok {
+		index, ok := indexManager.Indexes[target]
+		return index, ok
+	}
+
+	return nil, false
+}
+
+// UpdateIndex changes the settings of an index.  The index is rebuilt by a
+// background task and keeps serving searches with its old settings until the
+// rebuild completes.
+func (indexManager *IndexManager) UpdateIndex(indexId string, settings IndexSettings) (*Task, error) {
+	index, ok := indexManager.GetIndex(indexId)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, indexId)
+	}
+
+	if err := settings.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidIndex, err)
+	}
+
+	if err := index.BeginRebuild(); err != nil {
+		return nil, err
+	}
+
+	description := fmt.Sprintf("rebuild [%s]", index.Id)
+	task := indexManager.Tasks.Start("rebuild", description, func(ctx context.Context, task *Task) error {
+		if err := index.Rebuild(ctx, task, settings); err != nil {
+			return err
+		}
+		if err := index.Checkpoint(); err != nil {
+			return err
+		}
+		return indexManager.Save()
+	})
+
+	return task, nil
+}
+
+// ListIndexes returns the indexes ordered by id.
+func (indexManager *IndexManager) ListIndexes() []*Index {
+	indexManager.mu.Lock()
+	indexes := make([]*Index, 0, len(indexManager.Indexes))
+	for _, index := range indexManager.Indexes {
+		indexes = append(indexes, index)
+	}
+	indexManager.mu.Unlock()
+
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a].Id < indexes[b].Id })
+	return indexes
+}
+
+// Checkpoint checkpoints every index with changes since its last checkpoint
+// and saves the catalog.
+func (indexManager *IndexManager) Checkpoint() error {
+	indexManager.mu.Lock()
+	indexes := make([]*Index, 0, len(indexManager.Indexes))
+	for _, index := range indexManager.Indexes {
+		indexes = append(indexes, index)
+	}
+	indexManager.mu.Unlock()
+
+	for _, index := range indexes {
+		if err := index.Checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	return indexManager.Save()
+}
+
+// StartCheckpointing checkpoints the indexes in the background every interval
+// until the index manager is closed.
+func (indexManager *IndexManager) StartCheckpointing(interval time.Duration) {
+	indexManager.mu.Lock()
+	if indexManager.stopCheckpointing == nil {
+		indexManager.stopCheckpointing = make(chan struct{})
+	}
+	stop := indexManager.stopCheckpointing
+	indexManager.mu.Unlock()
+
+	indexManager.checkpointing.Add(1)
+	go func() {
+		defer indexManager.checkpointing.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := indexManager.Checkpoint(); err != nil {
+					log.Printf("Error checkpointing indexes: %s", err)
+				}
+			}
+		}
+	}()
 }
 
-// DeleteIndex deletes an index
+// Close cancels the background tasks such as reindexes and rebuilds and
+// waits for them to return, or for ctx to be done.  It then stops the
+// background checkpoints, waiting for one in progress, and checkpoints the
+// indexes and saves the catalog a final time so nothing is left to replay
+// from the write-ahead logs on the next start.  The storage is closed last.
+//
+// If the tasks don't stop in time the indexes are neither checkpointed nor
+// closed under them; the write-ahead logs hold their writes for the next
+// start to replay.
+func (indexManager *IndexManager) Close(ctx context.Context) error {
+	indexManager.mu.Lock()
+	if indexManager.stopCheckpointing != nil {
+		close(indexManager.stopCheckpointing)
+		indexManager.stopCheckpointing = nil
+	}
+	indexManager.mu.Unlock()
+
+	if err := indexManager.Tasks.Close(ctx); err != nil {
+		return fmt.Errorf("background tasks did not stop, leaving the indexes to be recovered from their write-ahead logs: %w", err)
+	}
+	indexManager.checkpointing.Wait()
+
+	if err := indexManager.Checkpoint(); err != nil {
+		indexManager.Storage.Close()
+		return err
+	}
+	return indexManager.Storage.Close()
+}
+
+// GetAliases returns a copy of the alias to index mapping.
+func (indexManager *IndexManager) GetAliases() map[string]string {
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	aliases := make(map[string]string, len(indexManager.Aliases))
+	for alias, target := range indexManager.Aliases {
+		aliases[alias] = target
+	}
+	return aliases
+}
+
+// UpdateAliases applies the alias actions as a single atomic operation.  Either
+// all of the actions are applied and persisted or none of them are.
+func (indexManager *IndexManager) UpdateAliases(actions []AliasAction) error {
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	aliases := make(map[string]string, len(indexManager.Aliases))
+	for alias, target := range indexManager.Aliases {
+		aliases[alias] = target
+	}
+
+	for _, action := range actions {
+		switch {
+		case action.Add != nil && action.Remove == nil:
+			if action.Add.Alias == "" || action.Add.Index == "" {
+				return fmt.Errorf("%w: add must have index and alias properties", ErrInvalidAlias)
+			}
+			if _, ok := indexManager.Indexes[action.Add.Index]; !ok {
+				return fmt.Errorf("%w: %s", ErrIndexNotFound, action.Add.Index)
+			}
+			if _, ok := indexManager.Indexes[action.Add.Alias]; ok {
+				return fmt.Errorf("%w: %s", ErrAliasConflict, action.Add.Alias)
+			}
+			aliases[action.Add.Alias] = action.Add.Index
+		case action.Remove != nil && action.Add == nil:
+			target, ok := aliases[action.Remove.Alias]
+			if !ok || (action.Remove.Index != "" && target != action.Remove.Index) {
+				return fmt.Errorf("%w: %s", ErrAliasNotFound, action.Remove.Alias)
+			}
+			delete(aliases, action.Remove.Alias)
+		default:
+			return fmt.Errorf("%w: must have exactly one of add or remove", ErrInvalidAlias)
+		}
+	}
+
+	previous := indexManager.Aliases
+	indexManager.Aliases = aliases
+	if err := indexManager.save(); err != nil {
+		indexManager.Aliases = previous
+		return err
+	}
+
+	return nil
+}
+
+// FlushCache drops the cached search results of an index, or of every index
+// when indexId is empty.  The indexes move to a new cache generation, so
+// results cached anywhere are never found again, and the cache frees those it
+// can find.
+func (indexManager *IndexManager) FlushCache(indexId string) error {
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	if indexId == "" {
+		for _, index := range indexManager.Indexes {
+			index.invalidateCache()
+		}
+	} else {
+		index, ok := indexManager.getIndex(indexId)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrIndexNotFound, indexId)
+		}
+		index.invalidateCache()
+		indexId = index.Id
+	}
+
+	if indexManager.Cache == nil {
+		return nil
+	}
+	return indexManager.Cache.Flush(indexId)
+}
+
+// forgetCache frees the cached search results and the cache metrics of a
+// deleted index.  The caller must hold the lock.
+func (indexManager *IndexManager) forgetCache(indexId string) {
+	if indexManager.Cache != nil {
+		if err := indexManager.Cache.Flush(indexId); err != nil {
+			log.Printf("Error flushing cache of deleted index %s: %s", indexId, err)
+		}
+	}
+	if indexManager.CacheMetrics != nil {
+		indexManager.CacheMetrics.Forget(indexId)
+	}
+}
+
+// DeleteIndex deletes an index.  An alias is rejected rather than deleting
+// the index it points at, which other aliases may point at too.
 func (indexManager *IndexManager) DeleteIndex(indexId string) error {
 	indexManager.mu.Lock()
 	defer indexManager.mu.Unlock()
 
+	if target, ok := indexManager.Aliases[indexId]; ok {
+		return fmt.Errorf("%w: %s points at index %s; remove the alias through the aliases API or delete %s", ErrIndexIsAlias, indexId, target, target)
+	}
 	index, ok := indexManager.Indexes[indexId]
-	if ok {
-		index.Destroy()
-		delete(indexManager.Indexes, indexId)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, indexId)
 	}
 
-	if err := indexManager.Save(); err != nil {
+	// the index is dropped from the catalog before its files are removed so a
+	// catalog that can't be saved leaves the index untouched
+	previous := indexManager.Aliases
+	aliases := make(map[string]string, len(previous))
+	for alias, target := range previous {
+		// aliases can't outlive the index they point at
+		if target != indexId {
+			aliases[alias] = target
+		}
+	}
+	delete(indexManager.Indexes, indexId)
+	indexManager.Aliases = aliases
+	if err := indexManager.save(); err != nil {
+		indexManager.Indexes[indexId] = index
+		indexManager.Aliases = previous
 		return err
 	}
 
-	return nil
+	indexManager.forgetCache(indexId)
+	return index.Destroy()
 }
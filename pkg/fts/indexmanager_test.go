@@ -0,0 +1,260 @@
+package fts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// documentIds returns the sorted ids of the documents of an index.
+func documentIds(index *Index) []string {
+	ids := make([]string, 0)
+	for _, document := range index.ListDocuments() {
+		ids = append(ids, document.Id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// writeCatalog writes a catalog of the books index in the envelope save uses.
+func writeCatalog(t *testing.T, storage Storage, name string) {
+	t.Helper()
+	catalog := []byte(`{"indexes":{"books":{"id":"books","searchProperties":["title"]}}}`)
+	bytes, err := json.Marshal(catalogFile{Version: catalogVersion, Checksum: checksum(catalog), Catalog: catalog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, storage, name, string(bytes))
+}
+
+func TestLoadCatalog(t *testing.T) {
+	tests := []struct {
+		name string
+		// write stores the catalog, if any, at indexes.json
+		write func(t *testing.T, storage Storage)
+		// want is the ids of the indexes, or nil when loading fails with err
+		want []string
+		err  error
+	}{
+		{"checksummed", func(t *testing.T, storage Storage) {
+			writeCatalog(t, storage, "indexes.json")
+		}, []string{"books"}, nil},
+		{"written before checksums", func(t *testing.T, storage Storage) {
+			mustWrite(t, storage, "indexes.json", `{"indexes":{"books":{"id":"books","searchProperties":["title"]}}}`)
+		}, []string{"books"}, nil},
+		{"checksum mismatch", func(t *testing.T, storage Storage) {
+			writeCatalog(t, storage, "indexes.json")
+			bytes, _ := storage.ReadFile("indexes.json")
+			mustWrite(t, storage, "indexes.json", strings.Replace(string(bytes), `"title"`, `"name"`, 1))
+		}, nil, ErrCorruptCatalog},
+		{"truncated", func(t *testing.T, storage Storage) {
+			writeCatalog(t, storage, "indexes.json")
+			bytes, _ := storage.ReadFile("indexes.json")
+			mustWrite(t, storage, "indexes.json", string(bytes[:len(bytes)/2]))
+		}, nil, ErrCorruptCatalog},
+		{"catalog isn't an object", func(t *testing.T, storage Storage) {
+			mustWrite(t, storage, "indexes.json", `["books"]`)
+		}, nil, ErrCorruptCatalog},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			test.write(t, storage)
+
+			indexManager, err := loadCatalog(storage, "indexes.json")
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("loadCatalog = %v, want %v", err, test.err)
+				}
+				if _, err := NewIndexManager(storage, "indexes.json", nil); !errors.Is(err, test.err) {
+					t.Errorf("NewIndexManager = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0)
+			for id, index := range indexManager.Indexes {
+				ids = append(ids, id)
+				if index.storage != storage {
+					t.Errorf("index %s doesn't use the catalog's storage", id)
+				}
+			}
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("indexes = %v, want %v", ids, test.want)
+			}
+			if indexManager.Aliases == nil || indexManager.Tasks == nil {
+				t.Error("aliases or tasks weren't made")
+			}
+		})
+	}
+
+	if _, err := loadCatalog(NewMemoryStorage(), "indexes.json"); !os.IsNotExist(err) {
+		t.Errorf("loading a missing catalog = %v, want a not exist error", err)
+	}
+}
+
+func TestRecoverFromBackupCatalog(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	storage := indexManager.Storage
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// adding films saves the catalog holding only books as the backup
+	films := MakeIndex("films", []string{"title"})
+	if err := indexManager.AddIndex(&films); err != nil {
+		t.Fatal(err)
+	}
+	mustWrite(t, storage, "indexes.json", `{"version":1,"checksum":"0000","catalog":{"indexes":{}}}`)
+
+	if _, err := NewIndexManager(storage, "indexes.json", nil); !errors.Is(err, ErrCorruptCatalog) {
+		t.Fatalf("NewIndexManager = %v, want %v", err, ErrCorruptCatalog)
+	}
+	recovered, err := RecoverIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.Path != "indexes.json" {
+		t.Errorf("recovered catalog has path %s", recovered.Path)
+	}
+	books, ok := recovered.GetIndex("books")
+	if !ok {
+		t.Fatal("books wasn't restored from the backup")
+	}
+	if _, ok := recovered.GetIndex("films"); ok {
+		t.Error("films is in the recovered catalog but not the backup")
+	}
+	if ids := books.Search("hobbit", OperatorOr); fmt.Sprint(ids) != "[1]" {
+		t.Errorf("search hobbit = %v, want [1]", ids)
+	}
+
+	// the repaired catalog is saved
+	reopened, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.GetIndex("books"); !ok {
+		t.Error("repaired catalog wasn't saved")
+	}
+}
+
+func TestRecoverWithCorruptBackup(t *testing.T) {
+	storage := NewMemoryStorage()
+	mustWrite(t, storage, "indexes.json", `{"version":1,"checksum":"0000","catalog":{}}`)
+
+	tests := []struct {
+		name   string
+		backup func(t *testing.T)
+		want   func(err error) bool
+	}{
+		{"missing", func(t *testing.T) {}, func(err error) bool { return errors.Is(err, os.ErrNotExist) }},
+		{"corrupt", func(t *testing.T) {
+			mustWrite(t, storage, "indexes.json.bak", `{"version":1,`)
+		}, func(err error) bool { return errors.Is(err, ErrCorruptCatalog) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.backup(t)
+			if _, err := RecoverIndexManager(storage, "indexes.json", nil); !test.want(err) {
+				t.Errorf("RecoverIndexManager = %v", err)
+			}
+		})
+	}
+}
+
+func TestRecoverLegacyDocuments(t *testing.T) {
+	storage := NewMemoryStorage()
+	hobbit := `{"title":"the hobbit"}`
+	for name, data := range map[string]string{
+		"indexes/books/1.json": hobbit,
+		"indexes/books/2.json": `{"title":"dune"}`,
+		// 4 isn't in the catalog and 5 can't be parsed
+		"indexes/books/4.json":            `{"title":"the silmarillion"}`,
+		"indexes/books/5.json":            `{"title":`,
+		"indexes/books/6.json.tmp1234":    `{"title":"the two`,
+		"indexes/books/checkpoint.tmp999": `{`,
+		"indexes.json": `{"indexes":{"books":{"id":"books","searchProperties":["title"],"documents":[
+			{"id":"1","path":"indexes/books/1.json","checksum":"` + checksum([]byte(hobbit)) + `"},
+			{"id":"2","path":"indexes/books/2.json","checksum":"0000"},
+			{"id":"3","path":"indexes/books/3.json"}]}}}`,
+	} {
+		mustWrite(t, storage, name, data)
+	}
+
+	indexManager, err := RecoverIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := indexManager.GetIndex("books")
+	if ids := documentIds(books); fmt.Sprint(ids) != "[1 4]" {
+		t.Errorf("documents = %v, want [1 4]", ids)
+	}
+	for term, want := range map[string]string{"hobbit": "[1]", "silmarillion": "[4]", "dune": "[]"} {
+		if ids := books.Search(term, OperatorOr); fmt.Sprint(ids) != want {
+			t.Errorf("search %s = %v, want %s", term, ids, want)
+		}
+	}
+
+	// the corrupt document is moved aside and the partial files are removed
+	wantContents(t, storage, "indexes/books/2.json.corrupt", `{"title":"dune"}`)
+	wantMissing(t, storage, "indexes/books/6.json.tmp1234")
+	wantMissing(t, storage, "indexes/books/checkpoint.tmp999")
+	wantMissing(t, storage, "indexes/books/3.json.corrupt")
+
+	reopened, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ = reopened.GetIndex("books")
+	if ids := documentIds(books); fmt.Sprint(ids) != "[1 4]" {
+		t.Errorf("documents after reopening = %v, want [1 4]", ids)
+	}
+}
+
+func TestRecoverDropsCorruptStoredDocuments(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	storage := indexManager.Storage
+	index, _ := indexManager.GetIndex("books")
+	for id, title := range map[string]string{"2": "dune", "3": "the silmarillion"} {
+		if _, err := index.AddDocument(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip the last byte of document 2's record
+	dune, _ := index.GetDocument("2")
+	bytes, err := storage.ReadFile(dune.store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes[dune.Offset+dune.Length-2] ^= 0xff
+	mustWrite(t, storage, dune.store.path, string(bytes))
+
+	recovered, err := RecoverIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := recovered.GetIndex("books")
+	if ids := documentIds(books); fmt.Sprint(ids) != "[1 3]" {
+		t.Errorf("documents = %v, want [1 3]", ids)
+	}
+	if ids := books.Search("dune", OperatorOr); len(ids) != 0 {
+		t.Errorf("search dune = %v, want none", ids)
+	}
+	for _, document := range books.ListDocuments() {
+		if _, err := document.Contents(); err != nil {
+			t.Errorf("reading %s: %s", document.Id, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package fts
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// MemoryStorage keeps files in memory.  Nothing survives the process, which
+// suits tests and ephemeral indexes.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+// NewMemoryStorage returns an empty in-memory Storage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]*memFile)}
+}
+
+func (s *MemoryStorage) ReadFile(name string) ([]byte, error) {
+	s.mu.Lock()
+	file, ok := s.files[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, notExist("read", name)
+	}
+
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	return append([]byte(nil), file.data...), nil
+}
+
+func (s *MemoryStorage) WriteFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// open files keep the contents they had, like a file replaced by a rename
+	s.files[name] = &memFile{data: append([]byte(nil), data...)}
+	return nil
+}
+
+func (s *MemoryStorage) OpenFile(name string) (File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[name]
+	if !ok {
+		file = &memFile{}
+		s.files[name] = file
+	}
+	return file, nil
+}
+
+func (s *MemoryStorage) Rename(oldName string, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[oldName]
+	if !ok {
+		return notExist("rename", oldName)
+	}
+	delete(s.files, oldName)
+	s.files[newName] = file
+	return nil
+}
+
+func (s *MemoryStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[name]; !ok {
+		return notExist("remove", name)
+	}
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemoryStorage) RemoveAll(dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := dirPrefix(dir)
+	for name := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.files, name)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) List(dir string) ([]FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := make([]FileInfo, 0)
+	for name, file := range s.files {
+		if inDir(name, dir) {
+			size, _ := file.Size()
+			files = append(files, FileInfo{Name: name[strings.LastIndex(name, "/")+1:], Size: size})
+		}
+	}
+	return files, nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// memFile is a file of a MemoryStorage.
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.grow(end)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return int64(len(f.data)), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size > int64(len(f.data)) {
+		f.grow(size)
+	} else {
+		f.data = f.data[:size]
+	}
+	return nil
+}
+
+// grow extends the file with zeros to size.  The caller must hold the lock.
+func (f *memFile) grow(size int64) {
+	if size <= int64(cap(f.data)) {
+		tail := f.data[len(f.data):size]
+		for j := range tail {
+			tail[j] = 0
+		}
+		f.data = f.data[:size]
+		return
+	}
+	data := make([]byte, size, size+size/4)
+	copy(data, f.data)
+	f.data = data
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
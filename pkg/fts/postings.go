@@ -0,0 +1,169 @@
+package fts
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// postingsSkipInterval is the number of postings between skip entries.
+const postingsSkipInterval = 128
+
+// postingsList is a compressed list of ascending document numbers.  The
+// numbers are stored as uvarint deltas, most of which fit in a byte, with a
+// skip entry every postingsSkipInterval postings so intersections can jump
+// ahead without decoding everything in between.
+type postingsList struct {
+	data  []byte
+	skips []postingsSkip
+	count uint32
+	last  uint32
+}
+
+// postingsSkip records where decoding can resume: the document number
+// preceding a block of postings and the offset of the block in data.
+type postingsSkip struct {
+	doc    uint32
+	offset uint32
+}
+
+// add appends a document number, which must be greater than the last one.
+func (l *postingsList) add(doc uint32) {
+	if l.count > 0 && l.count%postingsSkipInterval == 0 {
+		l.skips = append(l.skips, postingsSkip{l.last, uint32(len(l.data))})
+	}
+
+	var scratch [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(scratch[:], uint64(doc-l.last))
+	l.data = append(l.data, scratch[:n]...)
+	l.count++
+	l.last = doc
+}
+
+// size returns the number of bytes used by the list's data.
+func (l *postingsList) size() int {
+	return cap(l.data) + cap(l.skips)*8
+}
+
+// iterator returns an iterator positioned before the first posting.
+func (l *postingsList) iterator() *postingsIterator {
+	return &postingsIterator{list: l}
+}
+
+// postingsIterator decodes a postings list in order.
+type postingsIterator struct {
+	list   *postingsList
+	offset int
+	read   uint32
+	doc    uint32
+}
+
+// next advances to the next posting and returns false at the end of the list.
+func (it *postingsIterator) next() bool {
+	if it.read >= it.list.count {
+		return false
+	}
+
+	delta, n := binary.Uvarint(it.list.data[it.offset:])
+	it.offset += n
+	it.doc += uint32(delta)
+	it.read++
+	return true
+}
+
+// advance moves to the first posting at or after target and returns false if
+// there is none.  The iterator never moves backwards.
+func (it *postingsIterator) advance(target uint32) bool {
+	if it.read > 0 && it.doc >= target {
+		return true
+	}
+
+	// jump to the last block starting before target
+	skips := it.list.skips
+	j := sort.Search(len(skips), func(k int) bool { return skips[k].doc >= target }) - 1
+	if j >= 0 && uint32(j+1)*postingsSkipInterval > it.read {
+		it.offset = int(skips[j].offset)
+		it.read = uint32(j+1) * postingsSkipInterval
+		it.doc = skips[j].doc
+	}
+
+	for it.next() {
+		if it.doc >= target {
+			return true
+		}
+	}
+	return false
+}
+
+// decodePostings decodes count postings from the start of data, returning
+// the list and the number of bytes used.  It returns false if data is
+// malformed or holds document numbers that aren't ascending and below limit.
+func decodePostings(data []byte, count uint32, limit uint32) (postingsList, int, bool) {
+	var l postingsList
+	offset := 0
+	for p := uint32(0); p < count; p++ {
+		delta, n := binary.Uvarint(data[offset:])
+		if n <= 0 || (p > 0 && delta == 0) || uint64(l.last)+delta >= uint64(limit) {
+			return l, 0, false
+		}
+		offset += n
+		l.add(l.last + uint32(delta))
+	}
+	return l, offset, true
+}
+
+// intersectPostings calls fn with every document number in all of lists.
+// The lists are walked from the shortest so the others are only probed.
+func intersectPostings(lists []*postingsList, fn func(doc uint32)) {
+	if len(lists) == 0 {
+		return
+	}
+
+	sorted := append([]*postingsList(nil), lists...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].count < sorted[b].count })
+
+	iterators := make([]*postingsIterator, len(sorted))
+	for j, l := range sorted {
+		iterators[j] = l.iterator()
+	}
+
+	lead := iterators[0]
+	for lead.next() {
+		doc := lead.doc
+		matched := true
+		for _, it := range iterators[1:] {
+			if !it.advance(doc) {
+				return
+			}
+			if it.doc != doc {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			fn(doc)
+		}
+	}
+}
+
+// unionPostings calls fn once, in ascending order, with every document
+// number in any of lists.  size is the number of documents in the segment.
+func unionPostings(lists []*postingsList, size int, fn func(doc uint32)) {
+	if len(lists) == 1 {
+		for it := lists[0].iterator(); it.next(); {
+			fn(it.doc)
+		}
+		return
+	}
+
+	matches := make(bitset, (size+63)/64)
+	for _, l := range lists {
+		for it := l.iterator(); it.next(); {
+			matches.set(it.doc)
+		}
+	}
+	for doc := 0; doc < size; doc++ {
+		if matches.test(uint32(doc)) {
+			fn(uint32(doc))
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package fts
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// randomPostings returns count ascending document numbers below limit.
+func randomPostings(r *rand.Rand, count int, limit int) []uint32 {
+	docs := make([]uint32, 0, count)
+	for _, doc := range r.Perm(limit)[:count] {
+		docs = append(docs, uint32(doc))
+	}
+	sort.Slice(docs, func(a, b int) bool { return docs[a] < docs[b] })
+	return docs
+}
+
+// makePostings returns a postings list of docs.
+func makePostings(docs []uint32) *postingsList {
+	list := &postingsList{}
+	for _, doc := range docs {
+		list.add(doc)
+	}
+	return list
+}
+
+func TestPostingsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name string
+		docs []uint32
+	}{
+		{"empty", []uint32{}},
+		{"first document", []uint32{0}},
+		{"large gaps", []uint32{3, 200, 70000, 1 << 24, 1<<32 - 2}},
+		{"one block", randomPostings(r, postingsSkipInterval, 1000)},
+		{"just past a block", randomPostings(r, postingsSkipInterval+1, 1000)},
+		{"dense", randomPostings(r, 5000, 5000)},
+		{"sparse", randomPostings(r, 1000, 1<<20)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list := makePostings(test.docs)
+			if got := postingsOf(list); !reflect.DeepEqual(got, test.docs) {
+				t.Fatalf("iterated %v, want %v", got, test.docs)
+			}
+			if want := (len(test.docs) - 1) / postingsSkipInterval; len(test.docs) > 0 && len(list.skips) != want {
+				t.Errorf("%d skips, want %d", len(list.skips), want)
+			}
+
+			// trailing bytes belong to whatever follows the postings
+			data := append(append([]byte(nil), list.data...), 0x01, 0x02)
+			decoded, n, ok := decodePostings(data, list.count, 1<<32-1)
+			if !ok {
+				t.Fatal("decoding failed")
+			}
+			if n != len(list.data) {
+				t.Errorf("decoding used %d bytes, want %d", n, len(list.data))
+			}
+			if got := postingsOf(&decoded); !reflect.DeepEqual(got, test.docs) {
+				t.Errorf("decoded %v, want %v", got, test.docs)
+			}
+			if !reflect.DeepEqual(decoded.skips, list.skips) {
+				t.Errorf("decoded skips %v, want %v", decoded.skips, list.skips)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidPostings(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		count uint32
+		limit uint32
+	}{
+		{"truncated", []byte{0x05}, 2, 100},
+		{"unterminated number", []byte{0x80}, 1, 100},
+		{"repeated document", []byte{0x05, 0x00}, 2, 100},
+		{"beyond the limit", []byte{0x05, 0x05}, 2, 10},
+		{"at the limit", []byte{0x0a}, 1, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, ok := decodePostings(test.data, test.count, test.limit); ok {
+				t.Error("decoded invalid postings")
+			}
+		})
+	}
+}
+
+func TestPostingsAdvance(t *testing.T) {
+	docs := make([]uint32, 0, 1000)
+	for doc := uint32(1); len(docs) < cap(docs); doc += 3 {
+		docs = append(docs, doc)
+	}
+	list := makePostings(docs)
+
+	tests := []struct {
+		name    string
+		targets []uint32
+		want    []uint32 // 0 when there is no posting at or after the target
+	}{
+		{"exact", []uint32{1, 4, 1000}, []uint32{1, 4, 1000}},
+		{"between", []uint32{2, 3, 999}, []uint32{4, 4, 1000}},
+		{"across skips", []uint32{5, 2000, 2001}, []uint32{7, 2002, 2002}},
+		{"backwards", []uint32{1500, 10}, []uint32{1501, 1501}},
+		{"past the end", []uint32{100, 2998, 2999}, []uint32{100, 2998, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			it := list.iterator()
+			for j, target := range test.targets {
+				ok := it.advance(target)
+				if got := it.doc; ok != (test.want[j] != 0) || (ok && got != test.want[j]) {
+					t.Fatalf("advance(%d) = %d, %t, want %d", target, got, ok, test.want[j])
+				}
+			}
+		})
+	}
+}
+
+func TestIntersectPostings(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	tests := []struct {
+		name  string
+		lists [][]uint32
+	}{
+		{"one list", [][]uint32{randomPostings(r, 300, 1000)}},
+		{"disjoint", [][]uint32{{1, 3, 5}, {2, 4, 6}}},
+		{"empty list", [][]uint32{{}, {1, 2, 3}}},
+		{"short and long", [][]uint32{{5, 900, 4000, 9999}, randomPostings(r, 8000, 10000)}},
+		{"dense", [][]uint32{randomPostings(r, 3000, 4000), randomPostings(r, 3000, 4000)}},
+		{"many", [][]uint32{
+			randomPostings(r, 700, 2000),
+			randomPostings(r, 1500, 2000),
+			randomPostings(r, 1800, 2000),
+			randomPostings(r, 1000, 2000),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// brute force: count the lists each document is in
+			counts := make(map[uint32]int)
+			for _, docs := range test.lists {
+				for _, doc := range docs {
+					counts[doc]++
+				}
+			}
+			want := make([]uint32, 0)
+			for doc, count := range counts {
+				if count == len(test.lists) {
+					want = append(want, doc)
+				}
+			}
+			sort.Slice(want, func(a, b int) bool { return want[a] < want[b] })
+
+			lists := make([]*postingsList, 0, len(test.lists))
+			for _, docs := range test.lists {
+				lists = append(lists, makePostings(docs))
+			}
+			got := make([]uint32, 0)
+			intersectPostings(lists, func(doc uint32) { got = append(got, doc) })
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("intersection = %v, want %v", got, want)
+			}
+
+			union := make([]uint32, 0)
+			unionPostings(lists, 10000, func(doc uint32) { union = append(union, doc) })
+			if len(union) != len(counts) || !sort.SliceIsSorted(union, func(a, b int) bool { return union[a] < union[b] }) {
+				t.Errorf("union has %d documents, want %d in order", len(union), len(counts))
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package fts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidReindex = errors.New("invalid reindex request")
+
+// ReindexSource selects the documents to copy.  When Query is empty every
+// document in the index is copied.
+type ReindexSource struct {
+	Index string `json:"index"`
+	Query string `json:"query,omitempty"`
+}
+
+// ReindexDest names the index documents are copied into.
+type ReindexDest struct {
+	Index string `json:"index"`
+}
+
+// ReindexRequest describes a copy of documents from one index to another.
+type ReindexRequest struct {
+	Source ReindexSource `json:"source"`
+	Dest   ReindexDest   `json:"dest"`
+}
+
+// Reindex starts a background task that copies documents from the source index
+// to the destination index.  Documents are re-analyzed using the destination's
+// search properties.  Documents whose ids are already in the destination are
+// skipped, so a cancelled reindex can be run again to copy the rest.
+func (indexManager *IndexManager) Reindex(request ReindexRequest) (*Task, error) {
+	if request.Source.Index == "" || request.Dest.Index == "" {
+		return nil, fmt.Errorf("%w: source and dest indexes are required", ErrInvalidReindex)
+	}
+
+	source, ok := indexManager.GetIndex(request.Source.Index)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, request.Source.Index)
+	}
+
+	dest, ok := indexManager.GetIndex(request.Dest.Index)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, request.Dest.Index)
+	}
+
+	if source == dest {
+		return nil, fmt.Errorf("%w: source and dest must be different indexes", ErrInvalidReindex)
+	}
+
+	description := fmt.Sprintf("reindex from [%s] to [%s]", source.Id, dest.Id)
+	task := indexManager.Tasks.Start("reindex", description, func(ctx context.Context, task *Task) error {
+		return indexManager.reindex(ctx, task, source, dest, request.Source.Query)
+	})
+
+	return task, nil
+}
+
+// reindex copies the documents, reporting progress on the task.
+func (indexManager *IndexManager) reindex(ctx context.Context, task *Task, source *Index, dest *Index, query string) error {
+	var documents []Document
+	if query == "" {
+		documents = source.documents()
+	} else {
+		for _, id := range source.SearchValue(query) {
+			if document, ok := source.GetDocument(id); ok {
+				documents = append(documents, document)
+			}
+		}
+	}
+	task.SetTotal(len(documents))
+
+	for _, document := range documents {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if _, exists := dest.GetDocument(document.Id); exists {
+			task.Skip()
+			continue
+		}
+
+		contents, err := document.Contents()
+		if err != nil {
+			task.Fail(fmt.Errorf("Error reading document %s: %w", document.Id, err))
+			continue
+		}
+
+		if _, err := dest.AddDocument(document.Id, contents); err != nil {
+			task.Fail(err)
+			continue
+		}
+
+		task.Progress()
+	}
+
+	// documents copied before a cancellation are kept
+	return nil
+}
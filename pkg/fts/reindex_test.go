@@ -0,0 +1,186 @@
+package fts
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitForTask waits for a task to finish and returns its final state.
+func waitForTask(t *testing.T, task *Task) TaskInfo {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if info := task.Info(); info.Status != TaskRunning {
+			return info
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("task didn't finish")
+		}
+	}
+}
+
+// newReindexManager returns an index manager with a books index holding
+// titles and an empty copy index.
+func newReindexManager(t *testing.T, titles map[string]string) (*IndexManager, *Index, *Index) {
+	t.Helper()
+	indexManager, err := NewIndexManager(NewMemoryStorage(), "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books := MakeIndex("books", []string{"title"})
+	copied := MakeIndex("copy", []string{"title"})
+	for _, index := range []*Index{&books, &copied} {
+		if err := indexManager.AddIndex(index); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, title := range titles {
+		if _, err := books.AddDocument(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return indexManager, &books, &copied
+}
+
+// titleOf returns the title of a document, or "" when it is missing.
+func titleOf(t *testing.T, index *Index, id string) string {
+	t.Helper()
+	document, ok := index.GetDocument(id)
+	if !ok {
+		return ""
+	}
+	contents, err := document.Contents()
+	if err != nil {
+		t.Fatalf("reading %s: %s", id, err)
+	}
+	return contents["title"].(string)
+}
+
+func TestReindex(t *testing.T) {
+	titles := map[string]string{"1": "the hobbit", "2": "dune", "3": "the fellowship of the ring", "4": "the return of the king"}
+
+	tests := []struct {
+		name  string
+		query string
+		// existing are the documents already in the destination
+		existing map[string]string
+		want     map[string]string
+		skipped  int
+	}{
+		{"everything", "", nil, titles, 0},
+		{"query", "ring king", nil, map[string]string{"3": titles["3"], "4": titles["4"]}, 0},
+		{"query without matches", "silmarillion", nil, map[string]string{}, 0},
+		{
+			"existing ids are skipped", "",
+			map[string]string{"2": "dune messiah", "9": "the silmarillion"},
+			map[string]string{"1": titles["1"], "2": "dune messiah", "3": titles["3"], "4": titles["4"], "9": "the silmarillion"},
+			1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indexManager, _, copied := newReindexManager(t, titles)
+			for id, title := range test.existing {
+				if _, err := copied.AddDocument(id, map[string]interface{}{"title": title}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			request := ReindexRequest{Source: ReindexSource{Index: "books", Query: test.query}, Dest: ReindexDest{Index: "copy"}}
+			info := waitForTask(t, mustReindex(t, indexManager, request))
+			if info.Status != TaskCompleted || info.Failed != 0 {
+				t.Fatalf("task finished %+v", info)
+			}
+			if total := len(test.want) - len(test.existing) + test.skipped; info.Total != total || info.Processed != total || info.Skipped != test.skipped {
+				t.Errorf("total %d, processed %d, skipped %d, want %d, %d, %d", info.Total, info.Processed, info.Skipped, total, total, test.skipped)
+			}
+
+			if ids := documentIds(copied); len(ids) != len(test.want) {
+				t.Errorf("copied %v, want %v", ids, test.want)
+			}
+			for id, title := range test.want {
+				if got := titleOf(t, copied, id); got != title {
+					t.Errorf("document %s has title %q, want %q", id, got, title)
+				}
+			}
+			// copies are analyzed by the destination
+			if _, ok := test.want["3"]; ok {
+				if ids := copied.Search("fellowship", OperatorOr); fmt.Sprint(ids) != "[3]" {
+					t.Errorf("search fellowship = %v, want [3]", ids)
+				}
+			}
+		})
+	}
+}
+
+func TestReindexInvalid(t *testing.T) {
+	indexManager, _, _ := newReindexManager(t, nil)
+	tests := []struct {
+		name    string
+		request ReindexRequest
+		err     error
+	}{
+		{"missing dest", ReindexRequest{Source: ReindexSource{Index: "books"}}, ErrInvalidReindex},
+		{"same index", ReindexRequest{Source: ReindexSource{Index: "books"}, Dest: ReindexDest{Index: "books"}}, ErrInvalidReindex},
+		{"unknown source", ReindexRequest{Source: ReindexSource{Index: "films"}, Dest: ReindexDest{Index: "copy"}}, ErrIndexNotFound},
+		{"unknown dest", ReindexRequest{Source: ReindexSource{Index: "books"}, Dest: ReindexDest{Index: "films"}}, ErrIndexNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := indexManager.Reindex(test.request); !errors.Is(err, test.err) {
+				t.Errorf("Reindex = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReindexCancelAndRerun(t *testing.T) {
+	titles := make(map[string]string)
+	for j := 0; j < 50; j++ {
+		titles[fmt.Sprint(j)] = fmt.Sprintf("book %d", j)
+	}
+	indexManager, _, copied := newReindexManager(t, titles)
+	request := ReindexRequest{Source: ReindexSource{Index: "books"}, Dest: ReindexDest{Index: "copy"}}
+
+	// the copy blocks on the destination until the task is cancelled
+	copied.mu.Lock()
+	task := mustReindex(t, indexManager, request)
+	indexManager.Tasks.Cancel(task.Info().Id)
+	copied.mu.Unlock()
+
+	info := waitForTask(t, task)
+	if info.Status != TaskCancelled {
+		t.Fatalf("cancelled task is %s", info.Status)
+	}
+	first := len(copied.ListDocuments())
+	if first == len(titles) || info.Processed != first {
+		t.Fatalf("cancelled task copied %d of %d documents and processed %d", first, len(titles), info.Processed)
+	}
+
+	// running it again copies the rest
+	info = waitForTask(t, mustReindex(t, indexManager, request))
+	if info.Status != TaskCompleted || info.Failed != 0 {
+		t.Fatalf("task finished %+v", info)
+	}
+	if info.Processed != len(titles) || info.Skipped != first {
+		t.Errorf("processed %d and skipped %d, want %d and %d", info.Processed, info.Skipped, len(titles), first)
+	}
+	for id, title := range titles {
+		if got := titleOf(t, copied, id); got != title {
+			t.Errorf("document %s has title %q, want %q", id, got, title)
+		}
+	}
+}
+
+// mustReindex starts a reindex, failing the test when it can't.
+func mustReindex(t *testing.T, indexManager *IndexManager, request ReindexRequest) *Task {
+	t.Helper()
+	task, err := indexManager.Reindex(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
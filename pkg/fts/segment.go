@@ -0,0 +1,336 @@
+package fts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"sort"
+)
+
+var ErrCorruptSegment = errors.New("corrupt segment")
+
+// segmentMagic identifies a segment file and its format version.
+const segmentMagic = "FTSSEG01"
+
+// A segment file stores an inverted index compactly:
+//
+//	magic      "FTSSEG01"
+//	docCount   uvarint, followed by each document id as a uvarint length and bytes
+//	termCount  uvarint, followed by each term in sorted order as
+//	             a uvarint length and bytes
+//	             a uvarint postings count
+//	             the postings as uvarint deltas between ascending document numbers
+//	crc32      little endian crc32 of everything before it
+//
+// Document numbers are positions in the document table so each id is stored
+// once.  The postings use the same encoding in memory, see postingsList.
+
+// segment is an inverted index over a fixed set of documents.  Documents are
+// numbered in the order they were added.  Only the in-memory buffer of an
+// index has documents added to it; once flushed a segment's documents and
+// postings never change and deletes are recorded as tombstones.
+type segment struct {
+	name     string                   // file name, empty until the segment is written
+	ids      []string                 // external document ids by document number
+	postings map[string]*postingsList // document numbers by term
+	deleted  bitset                   // tombstones by document number
+}
+
+// newSegment returns an empty segment.
+func newSegment() *segment {
+	return &segment{ids: make([]string, 0), postings: make(map[string]*postingsList)}
+}
+
+// add adds a document with terms to the segment and returns its document number.
+func (s *segment) add(id string, terms []string) uint32 {
+	doc := uint32(len(s.ids))
+	s.ids = append(s.ids, id)
+	for _, term := range terms {
+		s.addPosting(term, doc)
+	}
+	return doc
+}
+
+// addPosting adds doc to the postings of term unless it is already the last
+// one.  It returns true when term is new to the segment.
+func (s *segment) addPosting(term string, doc uint32) bool {
+	list, ok := s.postings[term]
+	if !ok {
+		list = &postingsList{}
+		s.postings[term] = list
+	}
+	if list.count == 0 || list.last != doc {
+		list.add(doc)
+	}
+	return !ok
+}
+
+// delete adds a tombstone for a document.
+func (s *segment) delete(doc uint32) {
+	s.deleted.set(doc)
+}
+
+// size returns the number of documents in the segment including deleted ones.
+func (s *segment) size() int {
+	return len(s.ids)
+}
+
+// live returns the number of documents in the segment that aren't deleted.
+func (s *segment) live() int {
+	return len(s.ids) - s.deleted.count()
+}
+
+// docFreq returns the number of live documents containing term.
+func (s *segment) docFreq(term string) int {
+	list, ok := s.postings[term]
+	if !ok {
+		return 0
+	}
+	if len(s.deleted) == 0 {
+		return int(list.count)
+	}
+
+	count := 0
+	for it := list.iterator(); it.next(); {
+		if !s.deleted.test(it.doc) {
+			count++
+		}
+	}
+	return count
+}
+
+// contains returns true when the document contains term.
+func (s *segment) contains(term string, doc uint32) bool {
+	list, ok := s.postings[term]
+	if !ok {
+		return false
+	}
+	it := list.iterator()
+	return it.advance(doc) && it.doc == doc
+}
+
+// match calls fn with every live document containing all of terms when all is
+// true, or any of them otherwise.
+func (s *segment) match(terms []string, all bool, fn func(doc uint32)) {
+	lists := make([]*postingsList, 0, len(terms))
+	for _, term := range terms {
+		list, ok := s.postings[term]
+		if !ok {
+			if all {
+				return
+			}
+			continue
+		}
+		lists = append(lists, list)
+	}
+	if len(lists) == 0 {
+		return
+	}
+
+	live := func(doc uint32) {
+		if !s.deleted.test(doc) {
+			fn(doc)
+		}
+	}
+	if all {
+		intersectPostings(lists, live)
+	} else {
+		unionPostings(lists, s.size(), live)
+	}
+}
+
+// bitset is a set of document numbers.
+type bitset []uint64
+
+// set adds n to the set.
+func (b *bitset) set(n uint32) {
+	for int(n/64) >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[n/64] |= 1 << (n % 64)
+}
+
+// test returns true when n is in the set.
+func (b bitset) test(n uint32) bool {
+	word := int(n / 64)
+	return word < len(b) && b[word]&(1<<(n%64)) != 0
+}
+
+// count returns the number of members of the set.
+func (b bitset) count() int {
+	count := 0
+	for _, word := range b {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// clone returns a copy of the set.
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+// segmentFromPostings converts postings keyed by document id, as stored in
+// checkpoints before segments were added, into a segment.
+func segmentFromPostings(postings map[string][]string) *segment {
+	s := newSegment()
+	terms := make(map[string][]string)
+	for term, ids := range postings {
+		for _, id := range ids {
+			terms[id] = append(terms[id], term)
+		}
+	}
+
+	ids := make([]string, 0, len(terms))
+	for id := range terms {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		s.add(id, terms[id])
+	}
+
+	return s
+}
+
+// writeSegment encodes a segment and writes it to path in storage.
+// Tombstones aren't part of the segment file.
+func writeSegment(storage Storage, path string, s *segment) error {
+	terms := make([]string, 0, len(s.postings))
+	for term := range s.postings {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	var buf bytes.Buffer
+	scratch := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(scratch, v)
+		buf.Write(scratch[:n])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		buf.WriteString(s)
+	}
+
+	buf.WriteString(segmentMagic)
+	putUvarint(uint64(len(s.ids)))
+	for _, id := range s.ids {
+		putString(id)
+	}
+
+	putUvarint(uint64(len(terms)))
+	for _, term := range terms {
+		putString(term)
+
+		list := s.postings[term]
+		putUvarint(uint64(list.count))
+		buf.Write(list.data)
+	}
+
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum)
+
+	return storage.WriteFile(path, buf.Bytes())
+}
+
+// readSegment reads and verifies the segment at path in storage.
+func readSegment(storage Storage, path string) (*segment, error) {
+	data, err := storage.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(segmentMagic)+4 || string(data[:len(segmentMagic)]) != segmentMagic {
+		return nil, fmt.Errorf("%w: %s is not a segment", ErrCorruptSegment, path)
+	}
+
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("%w: %s does not match its checksum", ErrCorruptSegment, path)
+	}
+
+	s, err := decodeSegment(body[len(segmentMagic):])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrCorruptSegment, path, err)
+	}
+
+	return s, nil
+}
+
+// decodeSegment decodes the document table and term dictionary of a segment.
+func decodeSegment(data []byte) (*segment, error) {
+	offset := 0
+	readUvarint := func() (uint64, error) {
+		v, n := binary.Uvarint(data[offset:])
+		if n <= 0 {
+			return 0, errors.New("truncated or invalid number")
+		}
+		offset += n
+		return v, nil
+	}
+	readString := func() (string, error) {
+		length, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if length > uint64(len(data)-offset) {
+			return "", errors.New("truncated string")
+		}
+		s := string(data[offset : offset+int(length)])
+		offset += int(length)
+		return s, nil
+	}
+
+	docCount, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if docCount > 1<<32 || docCount > uint64(len(data)) {
+		return nil, fmt.Errorf("%d documents is too many for a segment", docCount)
+	}
+
+	s := newSegment()
+	s.ids = make([]string, docCount)
+	for j := range s.ids {
+		if s.ids[j], err = readString(); err != nil {
+			return nil, err
+		}
+	}
+
+	termCount, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	for t := uint64(0); t < termCount; t++ {
+		term, err := readString()
+		if err != nil {
+			return nil, err
+		}
+
+		count, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if count > docCount {
+			return nil, fmt.Errorf("term %s has more postings than documents", term)
+		}
+
+		list, n, ok := decodePostings(data[offset:], uint32(count), uint32(docCount))
+		if !ok {
+			return nil, fmt.Errorf("term %s has invalid postings", term)
+		}
+		offset += n
+		s.postings[term] = &list
+	}
+
+	if offset != len(data) {
+		return nil, errors.New("unexpected data after the term dictionary")
+	}
+
+	return s, nil
+}
@@ -0,0 +1,163 @@
+package fts
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// postingsOf returns the document numbers of a postings list.
+func postingsOf(list *postingsList) []uint32 {
+	docs := make([]uint32, 0, list.count)
+	for it := list.iterator(); it.next(); {
+		docs = append(docs, it.doc)
+	}
+	return docs
+}
+
+// segmentTerms returns the postings of every term in a segment.
+func segmentTerms(s *segment) map[string][]uint32 {
+	terms := make(map[string][]uint32, len(s.postings))
+	for term, list := range s.postings {
+		terms[term] = postingsOf(list)
+	}
+	return terms
+}
+
+// newTestSegment returns a segment with documents that have many terms in
+// common and a term whose postings cross skip entries.
+func newTestSegment() *segment {
+	s := newSegment()
+	s.add("hobbit", []string{"hobbit", "bilbo", "ring"})
+	s.add("fellowship", []string{"ring", "frodo", "ring"})
+	s.add("", []string{})
+	s.add("dune", []string{"arrakis", "spice", "ünïcödé"})
+	for j := 0; j < 3*postingsSkipInterval; j++ {
+		terms := []string{"common"}
+		if j%7 == 0 {
+			terms = append(terms, "sevens")
+		}
+		s.add(fmt.Sprintf("doc-%d", j), terms)
+	}
+	return s
+}
+
+func TestSegmentRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		segment func() *segment
+	}{
+		{"empty", newSegment},
+		{"one document without terms", func() *segment {
+			s := newSegment()
+			s.add("1", nil)
+			return s
+		}},
+		{"many documents", newTestSegment},
+		{"from postings", func() *segment {
+			return segmentFromPostings(map[string][]string{"ring": {"2", "1"}, "dune": {"3"}})
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := NewMemoryStorage()
+			s := test.segment()
+			if err := writeSegment(storage, "indexes/books/0000000000000001.seg", s); err != nil {
+				t.Fatal(err)
+			}
+
+			read, err := readSegment(storage, "indexes/books/0000000000000001.seg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(read.ids, s.ids) {
+				t.Errorf("ids = %v, want %v", read.ids, s.ids)
+			}
+			if got, want := segmentTerms(read), segmentTerms(s); !reflect.DeepEqual(got, want) {
+				t.Errorf("postings = %v, want %v", got, want)
+			}
+			for term, list := range s.postings {
+				if got := read.postings[term]; !reflect.DeepEqual(got.skips, list.skips) || got.last != list.last {
+					t.Errorf("postings of %s decoded with skips %v and last %d, want %v and %d", term, got.skips, got.last, list.skips, list.last)
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentTombstones(t *testing.T) {
+	s := newTestSegment()
+	s.delete(0)
+	s.delete(4 + 7)
+
+	if live := s.live(); live != s.size()-2 {
+		t.Errorf("live = %d, want %d", live, s.size()-2)
+	}
+	if freq := s.docFreq("ring"); freq != 1 {
+		t.Errorf("docFreq(ring) = %d, want 1", freq)
+	}
+	if freq := s.docFreq("sevens"); freq != (3*postingsSkipInterval+6)/7-1 {
+		t.Errorf("docFreq(sevens) = %d", freq)
+	}
+
+	var matched []uint32
+	s.match([]string{"ring", "hobbit"}, false, func(doc uint32) { matched = append(matched, doc) })
+	if fmt.Sprint(matched) != "[1]" {
+		t.Errorf("matched %v, want [1]", matched)
+	}
+
+	// tombstones are kept by the checkpoint, not the segment file
+	storage := NewMemoryStorage()
+	if err := writeSegment(storage, "0000000000000001.seg", s); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readSegment(storage, "0000000000000001.seg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.live() != read.size() {
+		t.Errorf("read segment has tombstones %v", read.deleted)
+	}
+}
+
+func TestReadCorruptSegment(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := writeSegment(storage, "good.seg", newTestSegment()); err != nil {
+		t.Fatal(err)
+	}
+	good, err := storage.ReadFile("good.seg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data func() []byte
+	}{
+		{"empty", func() []byte { return nil }},
+		{"wrong magic", func() []byte {
+			data := append([]byte(nil), good...)
+			data[len(segmentMagic)-1] = '2'
+			return data
+		}},
+		{"truncated", func() []byte { return good[:len(good)/2] }},
+		{"flipped bit", func() []byte {
+			data := append([]byte(nil), good...)
+			data[len(data)/2] ^= 0x10
+			return data
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := storage.WriteFile("bad.seg", test.data()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readSegment(storage, "bad.seg"); !errors.Is(err, ErrCorruptSegment) {
+				t.Errorf("err = %v, want ErrCorruptSegment", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package fts
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// maxBufferDocuments is the number of documents the in-memory buffer
+	// holds before it is flushed to a segment.
+	maxBufferDocuments = 10000
+
+	// mergeFactor is the number of segments of similar size that are merged
+	// together, and the growth in size from one merge level to the next.
+	mergeFactor = 10
+
+	// maxDeletedRatio is the fraction of deleted documents at which a segment
+	// is rewritten on its own to drop them.
+	maxDeletedRatio = 0.5
+)
+
+// docRef locates the live version of a document.
+type docRef struct {
+	segment *segment
+	doc     uint32
+}
+
+// segments is an inverted index made of flushed segments and an in-memory
+// buffer.  Adding a document appends it to the buffer and replacing or
+// deleting one adds a tombstone to the segment holding the old version, so no
+// segment's postings are ever modified once flushed.
+//
+// terms counts the segments holding postings for each term so the number of
+// distinct terms is known without walking the postings.  A deleted document
+// keeps its postings until a merge drops them, so terms only deleted documents
+// hold are counted until then.
+type segments struct {
+	flushed []*segment
+	buffer  *segment
+	refs    map[string]docRef
+	terms   map[string]int
+}
+
+// newSegments returns an empty inverted index.
+func newSegments() *segments {
+	return &segments{flushed: make([]*segment, 0), buffer: newSegment(), refs: make(map[string]docRef), terms: make(map[string]int)}
+}
+
+// openSegments returns an inverted index over flushed segments whose
+// tombstones have already been applied.
+func openSegments(flushed []*segment) *segments {
+	p := &segments{flushed: flushed, buffer: newSegment(), refs: make(map[string]docRef), terms: make(map[string]int)}
+	for _, s := range flushed {
+		p.addTerms(s)
+		for doc, id := range s.ids {
+			if !s.deleted.test(uint32(doc)) {
+				p.refs[id] = docRef{s, uint32(doc)}
+			}
+		}
+	}
+	return p
+}
+
+// put adds a document's terms, replacing any previous version of it.  It
+// returns true when the buffer was flushed to make room.
+func (p *segments) put(id string, terms []string) bool {
+	p.remove(id)
+	doc := p.buffer.add(id, nil)
+	for _, term := range terms {
+		if p.buffer.addPosting(term, doc) {
+			p.terms[term]++
+		}
+	}
+	p.refs[id] = docRef{p.buffer, doc}
+
+	if p.buffer.size() >= maxBufferDocuments {
+		return p.flush()
+	}
+	return false
+}
+
+// remove deletes a document and returns true if it was present.
+func (p *segments) remove(id string) bool {
+	ref, ok := p.refs[id]
+	if !ok {
+		return false
+	}
+
+	ref.segment.delete(ref.doc)
+	delete(p.refs, id)
+	return true
+}
+
+// flush turns the buffer into a segment.  It returns false when the buffer is empty.
+func (p *segments) flush() bool {
+	if p.buffer.size() == 0 {
+		return false
+	}
+
+	p.flushed = append(p.flushed, p.buffer)
+	p.buffer = newSegment()
+	return true
+}
+
+// addTerms counts the terms of a segment added to the index.
+func (p *segments) addTerms(s *segment) {
+	for term := range s.postings {
+		p.terms[term]++
+	}
+}
+
+// removeTerms stops counting the terms of a segment removed from the index.
+func (p *segments) removeTerms(s *segment) {
+	for term := range s.postings {
+		if p.terms[term]--; p.terms[term] <= 0 {
+			delete(p.terms, term)
+		}
+	}
+}
+
+// uniqueTerms returns the number of distinct terms with postings in the index.
+func (p *segments) uniqueTerms() int {
+	return len(p.terms)
+}
+
+// all returns the flushed segments followed by the buffer.
+func (p *segments) all() []*segment {
+	return append(append(make([]*segment, 0, len(p.flushed)+1), p.flushed...), p.buffer)
+}
+
+// search calls fn with the id of every live document containing all of terms
+// when all is true, or any of them otherwise.  A document is only live in one
+// segment so each id is passed once.
+func (p *segments) search(terms []string, all bool, fn func(id string)) {
+	for _, s := range p.all() {
+		s.match(terms, all, func(doc uint32) {
+			fn(s.ids[doc])
+		})
+	}
+}
+
+// docFreq returns the number of live documents containing term.
+func (p *segments) docFreq(term string) int {
+	count := 0
+	for _, s := range p.all() {
+		count += s.docFreq(term)
+	}
+	return count
+}
+
+// contains returns true when the live version of a document contains term.
+func (p *segments) contains(id string, term string) bool {
+	ref, ok := p.refs[id]
+	return ok && ref.segment.contains(term, ref.doc)
+}
+
+// docFreqs returns the number of live documents containing each term.
+func (p *segments) docFreqs() map[string]int {
+	freqs := make(map[string]int)
+	for _, s := range p.all() {
+		for term := range s.postings {
+			if freq := s.docFreq(term); freq > 0 {
+				freqs[term] += freq
+			}
+		}
+	}
+	return freqs
+}
+
+// mergeCandidates returns the segments that the merge policy wants merged,
+// or nil.  Segments are grouped into levels by size, each level holding
+// segments mergeFactor times bigger than the one below, and a level with
+// mergeFactor segments is merged into a single segment of the next level.
+// A segment that is mostly tombstones is rewritten on its own.
+func (p *segments) mergeCandidates() []*segment {
+	levels := make(map[int][]*segment)
+	for _, s := range p.flushed {
+		if s.size() > 0 && float64(s.size()-s.live()) >= maxDeletedRatio*float64(s.size()) {
+			return []*segment{s}
+		}
+
+		level := 0
+		for size := s.live() / maxBufferDocuments; size >= mergeFactor; size /= mergeFactor {
+			level++
+		}
+		levels[level] = append(levels[level], s)
+	}
+
+	lowest := -1
+	for level, candidates := range levels {
+		if len(candidates) >= mergeFactor && (lowest < 0 || level < lowest) {
+			lowest = level
+		}
+	}
+	if lowest < 0 {
+		return nil
+	}
+
+	return levels[lowest][:mergeFactor]
+}
+
+// mergeSegments merges the live documents of segments into a new segment.
+// deleted holds each segment's tombstones when the merge started; the
+// segments themselves aren't modified so this can run without the index
+// lock.  It returns the new document number of each old document, -1 for
+// deleted ones.
+func mergeSegments(candidates []*segment, deleted []bitset) (*segment, [][]int64) {
+	merged := newSegment()
+	remaps := make([][]int64, len(candidates))
+
+	for c, s := range candidates {
+		remaps[c] = make([]int64, s.size())
+		for doc, id := range s.ids {
+			if deleted[c].test(uint32(doc)) {
+				remaps[c][doc] = -1
+				continue
+			}
+			remaps[c][doc] = int64(len(merged.ids))
+			merged.ids = append(merged.ids, id)
+		}
+	}
+
+	// documents are renumbered in segment order so the postings stay ascending
+	for c, s := range candidates {
+		for term, list := range s.postings {
+			for it := list.iterator(); it.next(); {
+				if remaps[c][it.doc] >= 0 {
+					merged.addPosting(term, uint32(remaps[c][it.doc]))
+				}
+			}
+		}
+	}
+
+	return merged, remaps
+}
+
+// maybeMerge starts a background merge if the merge policy finds segments to
+// merge and no merge is running.  The caller must hold the lock.
+func (i *Index) maybeMerge() {
+	if i.merging || i.destroyed || i.postings == nil {
+		return
+	}
+
+	candidates := i.postings.mergeCandidates()
+	if candidates == nil {
+		return
+	}
+
+	deleted := make([]bitset, len(candidates))
+	for c, s := range candidates {
+		deleted[c] = s.deleted.clone()
+	}
+
+	i.merging = true
+	go i.merge(i.postings, candidates, deleted)
+}
+
+// merge merges segments in the background and swaps the merged segment in.
+// Deletes made while the merge ran are carried over to the merged segment.
+// The merge is abandoned if the segments were replaced in the meantime, by a
+// rebuild or another load.
+func (i *Index) merge(postings *segments, candidates []*segment, deleted []bitset) {
+	start := time.Now()
+	merged, remaps := mergeSegments(candidates, deleted)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.merging = false
+	if i.destroyed || i.postings != postings {
+		return
+	}
+
+	replaced := make(map[*segment]struct{}, len(candidates))
+	for _, s := range candidates {
+		replaced[s] = struct{}{}
+	}
+
+	flushed := make([]*segment, 0, len(postings.flushed))
+	for _, s := range postings.flushed {
+		if _, ok := replaced[s]; !ok {
+			flushed = append(flushed, s)
+		}
+	}
+	if len(flushed)+len(candidates) != len(postings.flushed) {
+		return
+	}
+
+	for c, s := range candidates {
+		for doc := range s.ids {
+			if remaps[c][doc] >= 0 && s.deleted.test(uint32(doc)) {
+				merged.delete(uint32(remaps[c][doc]))
+			}
+		}
+	}
+	for doc, id := range merged.ids {
+		if !merged.deleted.test(uint32(doc)) {
+			postings.refs[id] = docRef{merged, uint32(doc)}
+		}
+	}
+
+	for _, s := range candidates {
+		postings.removeTerms(s)
+	}
+	if merged.size() > 0 {
+		flushed = append(flushed, merged)
+		postings.addTerms(merged)
+	}
+	postings.flushed = flushed
+	i.stale = true
+
+	log.Printf("Merged %d segments of index %s into one with %d documents in %s",
+		len(candidates), i.Id, merged.live(), time.Since(start))
+
+	i.maybeMerge()
+}
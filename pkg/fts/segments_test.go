@@ -0,0 +1,205 @@
+package fts
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// searchIds returns the sorted ids of the live documents matching terms.
+func searchIds(p *segments, terms []string, all bool) []string {
+	ids := make([]string, 0)
+	p.search(terms, all, func(id string) { ids = append(ids, id) })
+	sort.Strings(ids)
+	return ids
+}
+
+// waitForMerges waits for the background merges of an index to finish and
+// returns with the index locked.
+func waitForMerges(t *testing.T, index *Index) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		index.mu.Lock()
+		if !index.merging {
+			return
+		}
+		index.mu.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatal("merges didn't finish")
+		}
+	}
+}
+
+// newTestSegments returns an inverted index of three flushed segments and
+// the terms each live document has.
+func newTestSegments() (*segments, map[string][]string) {
+	p := newSegments()
+	live := make(map[string][]string)
+	put := func(id string, terms ...string) {
+		p.put(id, terms)
+		live[id] = terms
+	}
+	remove := func(id string) {
+		p.remove(id)
+		delete(live, id)
+	}
+
+	put("1", "hobbit", "ring")
+	put("2", "dune", "spice")
+	put("3", "silmarillion")
+	p.flush()
+	put("4", "fellowship", "ring")
+	put("2", "dune", "messiah")
+	remove("3")
+	p.flush()
+	put("5", "towers", "ring")
+	remove("1")
+	put("6", "spice")
+	p.flush()
+	return p, live
+}
+
+func TestMergeSegmentsAppliesTombstones(t *testing.T) {
+	p, live := newTestSegments()
+	candidates := p.flushed
+	deleted := make([]bitset, len(candidates))
+	for c, s := range candidates {
+		deleted[c] = s.deleted.clone()
+	}
+
+	merged, remaps := mergeSegments(candidates, deleted)
+
+	ids := append([]string(nil), merged.ids...)
+	sort.Strings(ids)
+	if fmt.Sprint(ids) != "[2 4 5 6]" {
+		t.Errorf("merged ids = %v, want [2 4 5 6]", ids)
+	}
+	if merged.live() != merged.size() {
+		t.Errorf("merged segment has tombstones %v", merged.deleted)
+	}
+
+	// every live document keeps its terms under its new number
+	for c, s := range candidates {
+		for doc, id := range s.ids {
+			remapped := remaps[c][doc]
+			if deleted[c].test(uint32(doc)) {
+				if remapped != -1 {
+					t.Errorf("deleted %s in segment %d remapped to %d", id, c, remapped)
+				}
+				continue
+			}
+			if merged.ids[remapped] != id {
+				t.Errorf("%s remapped to %s", id, merged.ids[remapped])
+			}
+			for _, term := range live[id] {
+				if !merged.contains(term, uint32(remapped)) {
+					t.Errorf("merged %s doesn't contain %s", id, term)
+				}
+			}
+		}
+	}
+
+	// terms only held by deleted documents are dropped
+	for _, term := range []string{"hobbit", "silmarillion"} {
+		if _, ok := merged.postings[term]; ok {
+			t.Errorf("merged segment has postings for %s", term)
+		}
+	}
+	for term, list := range merged.postings {
+		docs := postingsOf(list)
+		if !sort.SliceIsSorted(docs, func(a, b int) bool { return docs[a] < docs[b] }) {
+			t.Errorf("postings of %s aren't ascending: %v", term, docs)
+		}
+	}
+}
+
+func TestIndexMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		// during changes the index while the segments are being merged
+		during func(p *segments)
+		want   map[string][]string
+	}{
+		{
+			name:   "nothing changes",
+			during: func(p *segments) {},
+			want: map[string][]string{
+				"ring":    {"4", "5"},
+				"spice":   {"6"},
+				"dune":    {"2"},
+				"messiah": {"2"},
+			},
+		},
+		{
+			name: "deletes and replaces during the merge",
+			during: func(p *segments) {
+				p.remove("4")
+				p.put("6", []string{"ring"})
+			},
+			want: map[string][]string{
+				"ring":       {"5", "6"},
+				"spice":      nil,
+				"fellowship": nil,
+				"dune":       {"2"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, _ := newTestSegments()
+			index := &Index{Id: "books", postings: p}
+			candidates := append([]*segment(nil), p.flushed...)
+			deleted := make([]bitset, len(candidates))
+			for c, s := range candidates {
+				deleted[c] = s.deleted.clone()
+			}
+
+			test.during(p)
+			index.merge(p, candidates, deleted)
+			// the merged segment may be rewritten again to drop tombstones
+			waitForMerges(t, index)
+			defer index.mu.Unlock()
+
+			if len(p.flushed) != 1 {
+				t.Fatalf("%d segments after merging, want 1", len(p.flushed))
+			}
+			for term, want := range test.want {
+				if want == nil {
+					want = []string{}
+				}
+				if got := searchIds(p, []string{term}, false); !reflect.DeepEqual(got, want) {
+					t.Errorf("search %s = %v, want %v", term, got, want)
+				}
+			}
+			for id, ref := range p.refs {
+				if ref.segment.deleted.test(ref.doc) || ref.segment.ids[ref.doc] != id {
+					t.Errorf("%s refers to a dead or different document", id)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexMergeAbandonedAfterRebuild(t *testing.T) {
+	p, _ := newTestSegments()
+	index := &Index{Id: "books", postings: p}
+	candidates := append([]*segment(nil), p.flushed...)
+	deleted := make([]bitset, len(candidates))
+	for c, s := range candidates {
+		deleted[c] = s.deleted.clone()
+	}
+
+	// a rebuild replaces the segments while the merge runs
+	index.postings = newSegments()
+	index.merge(p, candidates, deleted)
+
+	if len(p.flushed) != len(candidates) {
+		t.Errorf("%d segments after an abandoned merge, want %d", len(p.flushed), len(candidates))
+	}
+	if index.stale {
+		t.Error("abandoned merge marked the index stale")
+	}
+}
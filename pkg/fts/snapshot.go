@@ -0,0 +1,633 @@
+package fts
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+	ErrInvalidSnapshot  = errors.New("invalid snapshot request")
+	ErrCorruptSnapshot  = errors.New("corrupt snapshot")
+)
+
+const (
+	snapshotVersion      = 1
+	snapshotSuffix       = ".tar"
+	snapshotManifestName = "snapshot.json"
+	snapshotCatalogName  = "catalog.json"
+	snapshotIndexPrefix  = "indexes/"
+)
+
+// snapshotNamePattern restricts snapshot names to ones that are safe as file names.
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// A snapshot is a tar archive of:
+//
+//	snapshot.json   the snapshotManifest
+//	catalog.json    the catalog entries of the indexes and the aliases pointing at them
+//	indexes/<id>/   each index's checkpoint, segments and document store
+//
+// The document store is cut at the size recorded in the checkpoint so the
+// files are exactly what the index loads from after a checkpoint.
+
+// SnapshotRequest selects the indexes to snapshot.  Every index is included
+// when Indexes is empty.
+type SnapshotRequest struct {
+	Indexes []string `json:"indexes,omitempty"`
+}
+
+// RestoreRequest selects the indexes to restore from a snapshot.  Every index
+// in the snapshot is restored when Indexes is empty.  Renames maps the ids of
+// indexes in the snapshot to the ids they are restored as.
+type RestoreRequest struct {
+	Indexes []string          `json:"indexes,omitempty"`
+	Renames map[string]string `json:"renames,omitempty"`
+}
+
+// SnapshotInfo describes a snapshot.
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	Created   time.Time `json:"created"`
+	Indexes   []string  `json:"indexes"`
+	SizeBytes int64     `json:"sizeBytes,omitempty"`
+}
+
+// snapshotManifest is the first entry of a snapshot archive.
+type snapshotManifest struct {
+	Version int `json:"version"`
+	SnapshotInfo
+}
+
+// snapshotCatalog is the part of the catalog in a snapshot.
+type snapshotCatalog struct {
+	Indexes map[string]json.RawMessage `json:"indexes"`
+	Aliases map[string]string          `json:"aliases,omitempty"`
+}
+
+// SnapshotRepository is a directory holding snapshot archives.
+type SnapshotRepository struct {
+	dir  string
+	perm os.FileMode
+}
+
+// NewSnapshotRepository returns a repository keeping snapshots in dir.
+// Archives are created with perm, or 0644 when it is zero, like the files of
+// a DirStorage.
+func NewSnapshotRepository(dir string, perm os.FileMode) *SnapshotRepository {
+	if perm == 0 {
+		perm = filePerm
+	}
+	return &SnapshotRepository{dir: dir, perm: perm}
+}
+
+// path returns the path of a snapshot's archive.
+func (r *SnapshotRepository) path(name string) string {
+	return filepath.Join(r.dir, name+snapshotSuffix)
+}
+
+// Snapshot archives the selected indexes into the snapshot repository.  The
+// indexes are checkpointed and then locked together while they are archived
+// so the snapshot is a single point in time across all of them.
+func (indexManager *IndexManager) Snapshot(name string, request SnapshotRequest) (SnapshotInfo, error) {
+	repository := indexManager.Snapshots
+	if repository == nil {
+		return SnapshotInfo{}, fmt.Errorf("%w: no snapshot repository is configured", ErrInvalidSnapshot)
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		return SnapshotInfo{}, fmt.Errorf("%w: invalid name %q", ErrInvalidSnapshot, name)
+	}
+	if _, err := os.Stat(repository.path(name)); err == nil {
+		return SnapshotInfo{}, fmt.Errorf("%w: %s", ErrSnapshotExists, name)
+	}
+
+	if err := os.MkdirAll(repository.dir, dirPerm(repository.perm)); err != nil {
+		return SnapshotInfo{}, err
+	}
+	tmp, err := ioutil.TempFile(repository.dir, name+snapshotSuffix+tmpSuffix)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(repository.perm); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	start := time.Now()
+	info, err := indexManager.writeSnapshot(tmp, name, request)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	// linking fails rather than replacing a snapshot taken concurrently
+	if err := os.Link(tmp.Name(), repository.path(name)); os.IsExist(err) {
+		return SnapshotInfo{}, fmt.Errorf("%w: %s", ErrSnapshotExists, name)
+	} else if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := syncDir(repository.dir); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if stat, err := tmp.Stat(); err == nil {
+		info.SizeBytes = stat.Size()
+	}
+	log.Printf("Created snapshot %s of %d indexes in %s", name, len(info.Indexes), time.Since(start))
+	return info, nil
+}
+
+// writeSnapshot writes the snapshot archive to w.  The indexes are only
+// locked while they are checkpointed and their files pinned, and the files are
+// copied afterwards, so the indexes keep serving while the archive is written.
+func (indexManager *IndexManager) writeSnapshot(w io.Writer, name string, request SnapshotRequest) (SnapshotInfo, error) {
+	indexManager.mu.Lock()
+	indexes := make([]*Index, 0)
+	if len(request.Indexes) == 0 {
+		for _, index := range indexManager.Indexes {
+			indexes = append(indexes, index)
+		}
+	} else {
+		selected := make(map[string]struct{})
+		for _, id := range request.Indexes {
+			if target, ok := indexManager.Aliases[id]; ok {
+				id = target
+			}
+			index, ok := indexManager.Indexes[id]
+			if !ok {
+				indexManager.mu.Unlock()
+				return SnapshotInfo{}, fmt.Errorf("%w: %s", ErrIndexNotFound, id)
+			}
+			if _, ok := selected[id]; !ok {
+				selected[id] = struct{}{}
+				indexes = append(indexes, index)
+			}
+		}
+	}
+	aliases := make(map[string]string, len(indexManager.Aliases))
+	for alias, target := range indexManager.Aliases {
+		aliases[alias] = target
+	}
+	indexManager.mu.Unlock()
+	sort.Slice(indexes, func(a, b int) bool { return indexes[a].Id < indexes[b].Id })
+
+	snapshots, err := snapshotIndexes(indexes)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer func() {
+		for _, snapshot := range snapshots {
+			snapshot.release()
+		}
+	}()
+
+	info := SnapshotInfo{Name: name, Created: time.Now().UTC(), Indexes: make([]string, 0, len(indexes))}
+	catalog := snapshotCatalog{Indexes: make(map[string]json.RawMessage), Aliases: make(map[string]string)}
+	for _, snapshot := range snapshots {
+		info.Indexes = append(info.Indexes, snapshot.index.Id)
+		catalog.Indexes[snapshot.index.Id] = snapshot.entry
+	}
+	for alias, target := range aliases {
+		if _, ok := catalog.Indexes[target]; ok {
+			catalog.Aliases[alias] = target
+		}
+	}
+
+	archive := tar.NewWriter(w)
+	if err := writeTarJson(archive, snapshotManifestName, snapshotManifest{Version: snapshotVersion, SnapshotInfo: info}); err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := writeTarJson(archive, snapshotCatalogName, catalog); err != nil {
+		return SnapshotInfo{}, err
+	}
+	for _, snapshot := range snapshots {
+		if err := snapshot.archive(archive); err != nil {
+			return SnapshotInfo{}, err
+		}
+	}
+
+	return info, archive.Close()
+}
+
+// indexSnapshot is an index's checkpoint and the files it refers to, which
+// are pinned until the snapshot is released.  Segment files are never changed
+// once written and the document store is only appended to, so the files can
+// be copied without holding the index's lock.
+type indexSnapshot struct {
+	index      *Index
+	entry      json.RawMessage
+	checkpoint []byte
+	segments   []string
+	store      *docStore
+	storeSize  int64
+}
+
+// snapshotIndexes checkpoints the indexes and pins the files of their
+// checkpoints.  The indexes are locked together so the snapshot is a single
+// point in time across all of them.
+func snapshotIndexes(indexes []*Index) ([]*indexSnapshot, error) {
+	for _, index := range indexes {
+		index.checkpointMu.Lock()
+		defer index.checkpointMu.Unlock()
+	}
+	for _, index := range indexes {
+		index.mu.Lock()
+		defer index.mu.Unlock()
+	}
+
+	snapshots := make([]*indexSnapshot, 0, len(indexes))
+	for _, index := range indexes {
+		snapshot, err := index.snapshot()
+		if err != nil {
+			for _, snapshot := range snapshots {
+				snapshot.index.unpin(snapshot.files()...)
+			}
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// snapshot checkpoints the index and pins the checkpoint's files.  The caller
+// must hold the checkpoint lock and the lock.
+func (i *Index) snapshot() (*indexSnapshot, error) {
+	if i.destroyed {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, i.Id)
+	}
+
+	// the checkpoint is forced so the index's files hold all of it
+	i.stale = true
+	if err := i.checkpoint(); err != nil {
+		return nil, err
+	}
+
+	entry, err := i.marshal()
+	if err != nil {
+		return nil, err
+	}
+	cp, err := i.storage.ReadFile(i.checkpointPath())
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &indexSnapshot{index: i, entry: entry, checkpoint: cp, store: i.store}
+	for _, s := range i.postings.flushed {
+		snapshot.segments = append(snapshot.segments, s.name)
+	}
+	if i.store != nil {
+		snapshot.storeSize = i.store.size
+	}
+	i.pin(snapshot.files()...)
+	return snapshot, nil
+}
+
+// files returns the names of the files pinned by the snapshot.
+func (s *indexSnapshot) files() []string {
+	files := append([]string(nil), s.segments...)
+	if s.store != nil {
+		files = append(files, s.store.name)
+	}
+	return files
+}
+
+// release unpins the snapshot's files.
+func (s *indexSnapshot) release() {
+	s.index.mu.Lock()
+	defer s.index.mu.Unlock()
+
+	s.index.unpin(s.files()...)
+}
+
+// archive writes the index's files as of the snapshot to a snapshot archive.
+func (s *indexSnapshot) archive(archive *tar.Writer) error {
+	i := s.index
+	prefix := snapshotIndexPrefix + i.Id + "/"
+
+	if err := writeTarFile(archive, prefix+checkpointFileName, s.checkpoint); err != nil {
+		return err
+	}
+
+	for _, name := range s.segments {
+		data, err := i.storage.ReadFile(joinName(i.dir(), name))
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(archive, prefix+name, data); err != nil {
+			return err
+		}
+	}
+
+	if s.store != nil {
+		header := &tar.Header{Name: prefix + s.store.name, Mode: filePerm, Size: s.storeSize, ModTime: time.Now()}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(archive, io.NewSectionReader(s.store.file, 0, s.storeSize)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeTarFile adds a file to an archive.
+func writeTarFile(archive *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{Name: name, Mode: filePerm, Size: int64(len(data)), ModTime: time.Now()}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(data)
+	return err
+}
+
+// writeTarJson adds a json encoded value to an archive.
+func writeTarJson(archive *tar.Writer, name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return writeTarFile(archive, name, data)
+}
+
+// readTarJson reads the next entry of an archive, which must be called name,
+// into value.
+func readTarJson(archive *tar.Reader, name string, value interface{}) error {
+	header, err := archive.Next()
+	if err != nil {
+		return fmt.Errorf("%w: reading %s: %s", ErrCorruptSnapshot, name, err)
+	}
+	if header.Name != name {
+		return fmt.Errorf("%w: expected %s but found %s", ErrCorruptSnapshot, name, header.Name)
+	}
+	if err := json.NewDecoder(archive).Decode(value); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrCorruptSnapshot, name, err)
+	}
+	return nil
+}
+
+// Restore restores indexes from a snapshot in the snapshot repository and
+// returns their ids.  Restored indexes must not replace existing indexes or
+// aliases.  Aliases in the snapshot pointing at restored indexes are restored
+// too unless the name is already taken.
+func (indexManager *IndexManager) Restore(name string, request RestoreRequest) ([]string, error) {
+	repository := indexManager.Snapshots
+	if repository == nil {
+		return nil, fmt.Errorf("%w: no snapshot repository is configured", ErrInvalidSnapshot)
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+
+	file, err := os.Open(repository.path(name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	start := time.Now()
+	archive := tar.NewReader(file)
+	var manifest snapshotManifest
+	if err := readTarJson(archive, snapshotManifestName, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCorruptSnapshot, manifest.Version)
+	}
+	var catalog snapshotCatalog
+	if err := readTarJson(archive, snapshotCatalogName, &catalog); err != nil {
+		return nil, err
+	}
+
+	// targets maps the ids in the snapshot to the ids they are restored as
+	targets := make(map[string]string)
+	selected := request.Indexes
+	if len(selected) == 0 {
+		selected = manifest.Indexes
+	}
+	for _, id := range selected {
+		if _, ok := catalog.Indexes[id]; !ok {
+			return nil, fmt.Errorf("%w: %s is not in snapshot %s", ErrIndexNotFound, id, name)
+		}
+		targets[id] = id
+	}
+	for from, to := range request.Renames {
+		if _, ok := targets[from]; !ok {
+			return nil, fmt.Errorf("%w: renamed index %s is not being restored", ErrInvalidSnapshot, from)
+		}
+		targets[from] = to
+	}
+
+	// the ids name the directories that are replaced by the restored files
+	for from, to := range targets {
+		if err := validateIndexId(to); err != nil {
+			return nil, fmt.Errorf("%w: %s can't be restored as %q: %s", ErrInvalidSnapshot, from, to, err)
+		}
+	}
+
+	// the ids are reserved while the files are restored and loaded without
+	// holding the lock, so nothing else can take them in the meantime
+	if err := indexManager.reserve(targets); err != nil {
+		return nil, err
+	}
+	defer indexManager.unreserve(targets)
+
+	indexes, err := indexManager.restoreIndexes(archive, catalog, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	// aliases can be added while the indexes are restored
+	for _, index := range indexes {
+		if _, ok := indexManager.Aliases[index.Id]; ok {
+			indexManager.discardRestored(indexes)
+			return nil, fmt.Errorf("%w: %s", ErrIndexExists, index.Id)
+		}
+	}
+
+	ids := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		indexManager.Indexes[index.Id] = index
+		ids = append(ids, index.Id)
+	}
+	for alias, target := range catalog.Aliases {
+		to, ok := targets[target]
+		if !ok {
+			continue
+		}
+		_, isIndex := indexManager.Indexes[alias]
+		_, isAlias := indexManager.Aliases[alias]
+		if isIndex || isAlias {
+			log.Printf("Not restoring alias %s of snapshot %s, the name is taken", alias, name)
+			continue
+		}
+		indexManager.Aliases[alias] = to
+	}
+	sort.Strings(ids)
+
+	if err := indexManager.save(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Restored %d indexes from snapshot %s in %s", len(ids), name, time.Since(start))
+	return ids, nil
+}
+
+// reserve reserves the ids the indexes of a snapshot are restored as.  The ids
+// must not be used by indexes, aliases or other restores.
+func (indexManager *IndexManager) reserve(targets map[string]string) error {
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	reserved := make(map[string]struct{})
+	for _, to := range targets {
+		_, isIndex := indexManager.Indexes[to]
+		_, isAlias := indexManager.Aliases[to]
+		_, isRestoring := indexManager.restoring[to]
+		if isIndex || isAlias || isRestoring {
+			return fmt.Errorf("%w: %s", ErrIndexExists, to)
+		}
+		if _, ok := reserved[to]; ok {
+			return fmt.Errorf("%w: more than one index would be restored as %s", ErrInvalidSnapshot, to)
+		}
+		reserved[to] = struct{}{}
+	}
+
+	if indexManager.restoring == nil {
+		indexManager.restoring = make(map[string]struct{})
+	}
+	for to := range reserved {
+		indexManager.restoring[to] = struct{}{}
+	}
+	return nil
+}
+
+// unreserve releases the ids reserved by reserve.
+func (indexManager *IndexManager) unreserve(targets map[string]string) {
+	indexManager.mu.Lock()
+	defer indexManager.mu.Unlock()
+
+	for _, to := range targets {
+		delete(indexManager.restoring, to)
+	}
+}
+
+// restoreIndexes restores the files of the indexes from the rest of a snapshot
+// archive into the directories of the ids they are restored as, which must be
+// reserved, and loads the indexes.
+func (indexManager *IndexManager) restoreIndexes(archive *tar.Reader, catalog snapshotCatalog, targets map[string]string) ([]*Index, error) {
+	cleanup := func() {
+		for _, to := range targets {
+			indexManager.Storage.RemoveAll(indexDir(to))
+		}
+	}
+	for _, to := range targets {
+		if err := indexManager.Storage.RemoveAll(indexDir(to)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := indexManager.restoreFiles(archive, targets); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	indexes := make([]*Index, 0, len(targets))
+	for from, to := range targets {
+		index := &Index{}
+		if err := json.Unmarshal(catalog.Indexes[from], index); err != nil {
+			indexManager.discardRestored(indexes)
+			cleanup()
+			return nil, fmt.Errorf("%w: index %s: %s", ErrCorruptSnapshot, from, err)
+		}
+		index.Id = to
+		index.storage = indexManager.Storage
+		if err := index.Load(); err != nil {
+			indexManager.discardRestored(indexes)
+			cleanup()
+			return nil, err
+		}
+		index.invalidateCache()
+		indexes = append(indexes, index)
+	}
+
+	return indexes, nil
+}
+
+// discardRestored destroys indexes that were restored but not added.
+func (indexManager *IndexManager) discardRestored(indexes []*Index) {
+	for _, index := range indexes {
+		if err := index.Destroy(); err != nil {
+			log.Printf("Error discarding restored index %s: %s", index.Id, err)
+		}
+	}
+}
+
+// restoreFiles writes the files of the indexes being restored from the rest
+// of a snapshot archive into storage.
+func (indexManager *IndexManager) restoreFiles(archive *tar.Reader, targets map[string]string) error {
+	buf := make([]byte, 1<<20)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCorruptSnapshot, err)
+		}
+
+		rest := strings.TrimPrefix(header.Name, snapshotIndexPrefix)
+		slash := strings.LastIndex(rest, "/")
+		if rest == header.Name || slash <= 0 || slash == len(rest)-1 {
+			return fmt.Errorf("%w: unexpected file %s", ErrCorruptSnapshot, header.Name)
+		}
+		to, ok := targets[rest[:slash]]
+		if !ok {
+			continue
+		}
+
+		file, err := indexManager.Storage.OpenFile(joinName(indexDir(to), rest[slash+1:]))
+		if err != nil {
+			return err
+		}
+		var offset int64
+		for err == nil {
+			var n int
+			n, err = archive.Read(buf)
+			if n > 0 {
+				if _, writeErr := file.WriteAt(buf[:n], offset); writeErr != nil {
+					err = writeErr
+				}
+				offset += int64(n)
+			}
+		}
+		if err == io.EOF {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
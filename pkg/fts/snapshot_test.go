@@ -0,0 +1,187 @@
+package fts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestIndexManager returns an index manager over memory storage with an
+// index called books holding one document.
+func newTestIndexManager(t *testing.T) *IndexManager {
+	t.Helper()
+
+	indexManager, err := NewIndexManager(NewMemoryStorage(), "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexManager.Snapshots = NewSnapshotRepository(t.TempDir(), 0)
+
+	index := MakeIndex("books", []string{"title"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.AddDocument("1", map[string]interface{}{"title": "the hobbit"}); err != nil {
+		t.Fatal(err)
+	}
+	return indexManager
+}
+
+func TestAddIndexRejectsUnsafeIds(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	for _, id := range []string{"", ".", "..", "../books", "a/b", "/abs", ".hidden", "a\\b"} {
+		index := MakeIndex(id, []string{"title"})
+		if err := indexManager.AddIndex(&index); !errors.Is(err, ErrInvalidIndex) {
+			t.Errorf("AddIndex(%q) = %v, want %v", id, err, ErrInvalidIndex)
+		}
+	}
+}
+
+func TestRestoreRejectsUnsafeIds(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	if _, err := indexManager.Snapshot("backup", SnapshotRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, to := range []string{"", ".", "..", "../books", "a/b", "books/.."} {
+		_, err := indexManager.Restore("backup", RestoreRequest{Renames: map[string]string{"books": to}})
+		if !errors.Is(err, ErrInvalidSnapshot) {
+			t.Errorf("restoring books as %q = %v, want %v", to, err, ErrInvalidSnapshot)
+		}
+	}
+
+	// nothing outside the restored directories was removed
+	if _, err := indexManager.Storage.ReadFile("indexes.json"); err != nil {
+		t.Fatalf("catalog: %s", err)
+	}
+	index, _ := indexManager.GetIndex("books")
+	if document, ok := index.GetDocument("1"); !ok {
+		t.Fatal("document 1 is missing")
+	} else if _, err := document.Json(); err != nil {
+		t.Fatalf("reading document 1: %s", err)
+	}
+}
+
+func TestRestoreRenamed(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	if _, err := indexManager.Snapshot("backup", SnapshotRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := indexManager.Restore("backup", RestoreRequest{Renames: map[string]string{"books": "books-restored"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "books-restored" {
+		t.Fatalf("restored %v, want [books-restored]", ids)
+	}
+
+	index, ok := indexManager.GetIndex("books-restored")
+	if !ok {
+		t.Fatal("restored index is missing")
+	}
+	if got := index.Search("hobbit", OperatorOr); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("search of restored index = %v, want [1]", got)
+	}
+}
+
+func TestSnapshotWhileWriting(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	index, _ := indexManager.GetIndex("books")
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for j := 0; ; j++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			id := fmt.Sprintf("doc-%d", j)
+			if _, err := index.AddDocument(id, map[string]interface{}{"title": "book " + id}); err != nil {
+				errs <- err
+				return
+			}
+			if j%50 == 0 {
+				if err := index.DeleteDocument(fmt.Sprintf("doc-%d", j/2)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if j%100 == 0 {
+				if err := index.Checkpoint(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+
+	names := make([]string, 0)
+	for j := 0; j < 5; j++ {
+		name := fmt.Sprintf("backup-%d", j)
+		info, err := indexManager.Snapshot(name, SnapshotRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Indexes) != 1 {
+			t.Fatalf("snapshot %s has indexes %v", name, info.Indexes)
+		}
+		names = append(names, name)
+	}
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		to := "restored-" + name
+		if _, err := indexManager.Restore(name, RestoreRequest{Renames: map[string]string{"books": to}}); err != nil {
+			t.Fatalf("restoring %s: %s", name, err)
+		}
+		restored, _ := indexManager.GetIndex(to)
+		for _, document := range restored.documents() {
+			if _, err := document.Json(); err != nil {
+				t.Fatalf("snapshot %s: reading document %s: %s", name, document.Id, err)
+			}
+		}
+	}
+}
+
+func TestSnapshotFileModes(t *testing.T) {
+	tests := []struct {
+		name string
+		perm os.FileMode
+		file os.FileMode
+		dir  os.FileMode
+	}{
+		{"default", 0, 0644, 0755},
+		{"private", 0600, 0600, 0700},
+		{"group", 0640, 0640, 0750},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			indexManager := newTestIndexManager(t)
+			dir := filepath.Join(t.TempDir(), "snapshots")
+			indexManager.Snapshots = NewSnapshotRepository(dir, test.perm)
+			if _, err := indexManager.Snapshot("backup", SnapshotRequest{}); err != nil {
+				t.Fatal(err)
+			}
+
+			for path, want := range map[string]os.FileMode{dir: test.dir, indexManager.Snapshots.path("backup"): test.file} {
+				stat, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mode := stat.Mode().Perm(); mode != want {
+					t.Errorf("%s has mode %o, want %o", path, mode, want)
+				}
+			}
+		})
+	}
+}
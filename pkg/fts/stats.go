@@ -0,0 +1,171 @@
+package fts
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// rough per entry overheads used when estimating the size of an inverted index
+const (
+	stringHeaderSize = 16
+	sliceHeaderSize  = 24
+	mapEntrySize     = 8
+	postingsListSize = 2*sliceHeaderSize + 8
+)
+
+// indexCounters count the operations performed on an index since the process started.
+type indexCounters struct {
+	searches          atomic.Int64
+	searchesCoalesced atomic.Int64
+	documentsIndexed  atomic.Int64
+	indexingFailures  atomic.Int64
+	documentsDeleted  atomic.Int64
+	lastBuildTime     time.Time
+	lastBuildDuration time.Duration
+}
+
+// TermStats is the number of documents containing a term.
+type TermStats struct {
+	Term    string `json:"term"`
+	DocFreq int    `json:"docFreq"`
+}
+
+// IndexStats describes the size and usage of an index.
+type IndexStats struct {
+	Id                  string      `json:"id"`
+	DocumentCount       int         `json:"documentCount"`
+	Segments            int         `json:"segments"`
+	BufferedDocuments   int         `json:"bufferedDocuments"`
+	DeletedDocuments    int         `json:"deletedDocuments"`
+	UniqueTerms         int         `json:"uniqueTerms"`
+	TotalPostings       int         `json:"totalPostings"`
+	DiskSizeBytes       int64       `json:"diskSizeBytes"`
+	StoreSizeBytes      int64       `json:"storeSizeBytes"`
+	StoreGarbageBytes   int64       `json:"storeGarbageBytes"`
+	MemorySizeBytes     int64       `json:"memorySizeBytes"`
+	TopTerms            []TermStats `json:"topTerms"`
+	LastBuildTime       *time.Time  `json:"lastBuildTime,omitempty"`
+	LastBuildDurationMs int64       `json:"lastBuildDurationMs"`
+	Searches            int64       `json:"searches"`
+	SearchesCoalesced   int64       `json:"searchesCoalesced"`
+	DocumentsIndexed    int64       `json:"documentsIndexed"`
+	IndexingFailures    int64       `json:"indexingFailures"`
+	DocumentsDeleted    int64       `json:"documentsDeleted"`
+}
+
+// IndexCounts are the sizes and counters of an index that are maintained as
+// it changes, so reading them is cheap however big the index is.  Unlike
+// IndexStats, UniqueTerms includes terms only deleted documents hold until
+// merges drop them.
+type IndexCounts struct {
+	Id                string
+	DocumentCount     int
+	UniqueTerms       int
+	Segments          int
+	StoreSizeBytes    int64
+	StoreGarbageBytes int64
+	Searches          int64
+	SearchesCoalesced int64
+	DocumentsIndexed  int64
+	IndexingFailures  int64
+	DocumentsDeleted  int64
+}
+
+// Counts returns the index's counts.  Unlike Stats it doesn't walk the
+// inverted index or list the index's files.
+func (i *Index) Counts() IndexCounts {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	counts := IndexCounts{
+		Id:                i.Id,
+		DocumentCount:     len(i.Documents),
+		Searches:          i.counters.searches.Load(),
+		SearchesCoalesced: i.counters.searchesCoalesced.Load(),
+		DocumentsIndexed:  i.counters.documentsIndexed.Load(),
+		IndexingFailures:  i.counters.indexingFailures.Load(),
+		DocumentsDeleted:  i.counters.documentsDeleted.Load(),
+	}
+	if i.postings != nil {
+		counts.UniqueTerms = i.postings.uniqueTerms()
+		counts.Segments = len(i.postings.flushed)
+	}
+	if i.store != nil {
+		counts.StoreSizeBytes = i.store.size
+		counts.StoreGarbageBytes = i.store.garbage
+	}
+	return counts
+}
+
+// Stats returns statistics for the index including the topN terms by document
+// frequency.  The memory size is an estimate of the inverted index only.
+// Deleted documents are those still taking up space in segments until they
+// are merged away.
+func (i *Index) Stats(topN int) (IndexStats, error) {
+	i.mu.RLock()
+	stats := IndexStats{
+		Id:                  i.Id,
+		DocumentCount:       len(i.Documents),
+		Segments:            len(i.postings.flushed),
+		BufferedDocuments:   i.postings.buffer.live(),
+		LastBuildDurationMs: i.counters.lastBuildDuration.Milliseconds(),
+		Searches:            i.counters.searches.Load(),
+		SearchesCoalesced:   i.counters.searchesCoalesced.Load(),
+		DocumentsIndexed:    i.counters.documentsIndexed.Load(),
+		IndexingFailures:    i.counters.indexingFailures.Load(),
+		DocumentsDeleted:    i.counters.documentsDeleted.Load(),
+	}
+	if i.store != nil {
+		stats.StoreSizeBytes = i.store.size
+		stats.StoreGarbageBytes = i.store.garbage
+	}
+	if !i.counters.lastBuildTime.IsZero() {
+		lastBuildTime := i.counters.lastBuildTime
+		stats.LastBuildTime = &lastBuildTime
+	}
+
+	for _, s := range i.postings.all() {
+		stats.DeletedDocuments += s.size() - s.live()
+		for _, id := range s.ids {
+			stats.MemorySizeBytes += int64(len(id) + stringHeaderSize)
+		}
+		for term, list := range s.postings {
+			stats.MemorySizeBytes += int64(len(term) + stringHeaderSize + mapEntrySize + postingsListSize + list.size())
+		}
+		stats.MemorySizeBytes += int64(len(s.deleted) * 8)
+	}
+
+	freqs := i.postings.docFreqs()
+	stats.UniqueTerms = len(freqs)
+	terms := make([]TermStats, 0)
+	for term, freq := range freqs {
+		stats.TotalPostings += freq
+		// the terms are only sorted when some are wanted
+		if topN > 0 {
+			terms = append(terms, TermStats{term, freq})
+		}
+	}
+	i.mu.RUnlock()
+
+	sort.Slice(terms, func(a, b int) bool {
+		if terms[a].DocFreq != terms[b].DocFreq {
+			return terms[a].DocFreq > terms[b].DocFreq
+		}
+		return terms[a].Term < terms[b].Term
+	})
+	if len(terms) > topN {
+		terms = terms[:topN]
+	}
+	stats.TopTerms = terms
+
+	files, err := i.storage.List(i.dir())
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range files {
+		stats.DiskSizeBytes += file.Size
+	}
+
+	return stats, nil
+}
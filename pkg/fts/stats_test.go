@@ -0,0 +1,74 @@
+package fts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	index, _ := indexManager.GetIndex("books")
+	for _, document := range []struct{ id, title string }{
+		{"2", "the fellowship of the ring"},
+		{"3", "the return of the king"},
+		{"4", "dune"},
+		{"5", "ringworld"},
+		{"6", "the ring of power"},
+	} {
+		if _, err := index.AddDocument(document.id, map[string]interface{}{"title": document.title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.ReplaceDocument("4", map[string]interface{}{"title": "dune messiah"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.DeleteDocument("5"); err != nil {
+		t.Fatal(err)
+	}
+	index.Search("ring", OperatorOr)
+	index.Search("dune", OperatorAnd)
+
+	stats, err := index.Stats(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DocumentCount != 5 {
+		t.Errorf("documentCount = %d, want 5", stats.DocumentCount)
+	}
+	// terms held only by replaced or deleted documents aren't counted
+	if stats.UniqueTerms != 8 || stats.TotalPostings != 9 {
+		t.Errorf("uniqueTerms = %d and totalPostings = %d, want 8 and 9", stats.UniqueTerms, stats.TotalPostings)
+	}
+	wantTop := []TermStats{{"ring", 2}, {"dune", 1}, {"fellowship", 1}}
+	if !reflect.DeepEqual(stats.TopTerms, wantTop) {
+		t.Errorf("topTerms = %v, want %v", stats.TopTerms, wantTop)
+	}
+	if stats.Searches != 2 || stats.DocumentsIndexed != 7 || stats.DocumentsDeleted != 1 {
+		t.Errorf("searches = %d, documentsIndexed = %d, documentsDeleted = %d, want 2, 7 and 1", stats.Searches, stats.DocumentsIndexed, stats.DocumentsDeleted)
+	}
+	if stats.StoreSizeBytes == 0 || stats.MemorySizeBytes == 0 || stats.DiskSizeBytes < stats.StoreSizeBytes {
+		t.Errorf("store %d bytes, memory %d bytes, disk %d bytes", stats.StoreSizeBytes, stats.MemorySizeBytes, stats.DiskSizeBytes)
+	}
+	if stats.LastBuildTime != nil {
+		t.Errorf("lastBuildTime = %v before building", stats.LastBuildTime)
+	}
+
+	if err := index.Build(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = index.Stats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.TopTerms) != 0 {
+		t.Errorf("topTerms = %v, want none", stats.TopTerms)
+	}
+	if stats.LastBuildTime == nil || stats.DeletedDocuments != 0 {
+		t.Errorf("lastBuildTime = %v and deletedDocuments = %d after building", stats.LastBuildTime, stats.DeletedDocuments)
+	}
+
+	// asking for more terms than there are returns them all
+	if stats, _ := index.Stats(100); len(stats.TopTerms) != stats.UniqueTerms {
+		t.Errorf("%d top terms, want all %d", len(stats.TopTerms), stats.UniqueTerms)
+	}
+}
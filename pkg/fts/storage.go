@@ -0,0 +1,268 @@
+package fts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidFsyncPolicy = errors.New("invalid fsync policy")
+	ErrStorageNotWritable = errors.New("storage is not writable")
+)
+
+// Storage persists the catalog and the files of each index: write-ahead logs,
+// checkpoints, segments and document stores.  Files are named by slash
+// separated paths such as "indexes/products/index.wal".  Missing files are
+// reported with errors for which os.IsNotExist is true.
+type Storage interface {
+	// ReadFile returns the contents of a file.
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile replaces a file with data.  The replacement is atomic and
+	// durable when WriteFile returns.
+	WriteFile(name string, data []byte) error
+
+	// OpenFile opens a file for reading and writing, creating it if needed.
+	OpenFile(name string) (File, error)
+
+	// Rename renames a file, replacing any file already called newName.
+	Rename(oldName string, newName string) error
+
+	// Remove removes a file.
+	Remove(name string) error
+
+	// RemoveAll removes every file under dir.
+	RemoveAll(dir string) error
+
+	// List returns the files directly in dir, which is empty if dir doesn't exist.
+	List(dir string) ([]FileInfo, error)
+
+	// Close releases the storage.
+	Close() error
+}
+
+// File is an open file of a Storage.  Writes aren't durable until Sync returns.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Size returns the size of the file.
+	Size() (int64, error)
+
+	// Truncate changes the size of the file.
+	Truncate(size int64) error
+
+	// Sync makes the writes to the file durable.
+	Sync() error
+
+	// Close closes the file.
+	Close() error
+}
+
+// FileInfo describes a file in a Storage.
+type FileInfo struct {
+	Name string
+	Size int64
+}
+
+// notExist returns the error reported for a missing file.
+func notExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// FsyncPolicy is when a DirStorage flushes writes to disk.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways makes every acknowledged write durable.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncNever leaves flushing to the operating system.  Acknowledged
+	// writes survive the process crashing but not the machine.
+	FsyncNever FsyncPolicy = "never"
+)
+
+// ParseFsyncPolicy parses an fsync policy.  An empty string is FsyncAlways.
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch FsyncPolicy(strings.ToLower(s)) {
+	case "", FsyncAlways:
+		return FsyncAlways, nil
+	case FsyncNever:
+		return FsyncNever, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidFsyncPolicy, s)
+	}
+}
+
+// DirStorage stores files in a directory of the filesystem.
+type DirStorage struct {
+	root  string
+	perm  os.FileMode
+	fsync bool
+}
+
+// NewDirStorage returns a Storage keeping its files under the directory root.
+// Files are created with perm, or 0644 when it is zero, and directories with
+// perm plus search permission for whoever can read.
+func NewDirStorage(root string, perm os.FileMode, fsync FsyncPolicy) *DirStorage {
+	if perm == 0 {
+		perm = filePerm
+	}
+	return &DirStorage{root: root, perm: perm, fsync: fsync != FsyncNever}
+}
+
+// CheckWritable creates the root directory if needed and checks that files
+// can be written in it.
+func (s *DirStorage) CheckWritable() error {
+	name := "writable" + tmpSuffix
+	if err := s.WriteFile(name, []byte{}); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrStorageNotWritable, s.root, err)
+	}
+	if err := s.Remove(name); err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrStorageNotWritable, s.root, err)
+	}
+	return nil
+}
+
+// mkdirAll creates the directory holding path.
+func (s *DirStorage) mkdirAll(path string) error {
+	return os.MkdirAll(filepath.Dir(path), dirPerm(s.perm))
+}
+
+// dirPerm returns the permission for directories holding files created with
+// perm: perm plus search permission for whoever can read.
+func dirPerm(perm os.FileMode) os.FileMode {
+	return perm | (perm&0444)>>2
+}
+
+// syncDir flushes a directory unless the fsync policy is FsyncNever.
+func (s *DirStorage) syncDir(dir string) error {
+	if !s.fsync {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// path returns the filesystem path of a file.
+func (s *DirStorage) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *DirStorage) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(s.path(name))
+}
+
+func (s *DirStorage) WriteFile(name string, data []byte) error {
+	if err := s.mkdirAll(s.path(name)); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path(name), data, s.perm, s.fsync)
+}
+
+func (s *DirStorage) OpenFile(name string) (File, error) {
+	p := s.path(name)
+	if err := s.mkdirAll(p); err != nil {
+		return nil, err
+	}
+
+	_, statErr := os.Stat(p)
+	file, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, s.perm)
+	if err != nil {
+		return nil, err
+	}
+
+	// a new file isn't durable until its directory entry is
+	if os.IsNotExist(statErr) {
+		if err := s.syncDir(filepath.Dir(p)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return dirFile{file, s.fsync}, nil
+}
+
+func (s *DirStorage) Rename(oldName string, newName string) error {
+	if err := os.Rename(s.path(oldName), s.path(newName)); err != nil {
+		return err
+	}
+
+	return s.syncDir(filepath.Dir(s.path(newName)))
+}
+
+func (s *DirStorage) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *DirStorage) RemoveAll(dir string) error {
+	return os.RemoveAll(s.path(dir))
+}
+
+func (s *DirStorage) List(dir string) ([]FileInfo, error) {
+	entries, err := ioutil.ReadDir(s.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, FileInfo{Name: entry.Name(), Size: entry.Size()})
+		}
+	}
+	return files, nil
+}
+
+func (s *DirStorage) Close() error {
+	return nil
+}
+
+// dirFile is an open file of a DirStorage.
+type dirFile struct {
+	*os.File
+	fsync bool
+}
+
+func (f dirFile) Sync() error {
+	if !f.fsync {
+		return nil
+	}
+	return f.File.Sync()
+}
+
+func (f dirFile) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// joinName joins the elements of a storage file name.
+func joinName(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// inDir returns true when name is a file directly in dir.  An empty dir is
+// the root.
+func inDir(name string, dir string) bool {
+	rest := strings.TrimPrefix(name, dirPrefix(dir))
+	return (rest != name || dir == "") && rest != "" && !strings.Contains(rest, "/")
+}
+
+// dirPrefix returns the prefix of the names of the files under dir.
+func dirPrefix(dir string) string {
+	if dir = strings.TrimSuffix(dir, "/"); dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
@@ -0,0 +1,310 @@
+package fts
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// storageBackends opens an empty storage of each backend.
+var storageBackends = map[string]func(t *testing.T) Storage{
+	"dir": func(t *testing.T) Storage {
+		return NewDirStorage(t.TempDir(), 0, FsyncAlways)
+	},
+	"memory": func(t *testing.T) Storage {
+		return NewMemoryStorage()
+	},
+	"bolt": func(t *testing.T) Storage {
+		storage, err := OpenBoltStorage(filepath.Join(t.TempDir(), "fts.db"), 0, FsyncAlways)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	},
+}
+
+// TestStorage checks that every backend behaves the way the indexes expect.
+func TestStorage(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, storage Storage)
+	}{
+		{"write and read", testStorageWriteFile},
+		{"missing files", testStorageMissing},
+		{"atomic write", testStorageAtomicWrite},
+		{"open file", testStorageOpenFile},
+		{"rename", testStorageRename},
+		{"remove", testStorageRemove},
+		{"remove all", testStorageRemoveAll},
+		{"list", testStorageList},
+	}
+
+	for backend, open := range storageBackends {
+		t.Run(backend, func(t *testing.T) {
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					storage := open(t)
+					defer storage.Close()
+					test.test(t, storage)
+				})
+			}
+		})
+	}
+}
+
+// mustWrite writes a file, failing the test when it can't.
+func mustWrite(t *testing.T, storage Storage, name string, data string) {
+	t.Helper()
+	if err := storage.WriteFile(name, []byte(data)); err != nil {
+		t.Fatalf("writing %s: %s", name, err)
+	}
+}
+
+// wantContents checks a file's contents.
+func wantContents(t *testing.T, storage Storage, name string, want string) {
+	t.Helper()
+	data, err := storage.ReadFile(name)
+	if err != nil {
+		t.Fatalf("reading %s: %s", name, err)
+	}
+	if string(data) != want {
+		t.Fatalf("%s = %q, want %q", name, data, want)
+	}
+}
+
+// wantMissing checks that a file doesn't exist.
+func wantMissing(t *testing.T, storage Storage, name string) {
+	t.Helper()
+	if _, err := storage.ReadFile(name); !os.IsNotExist(err) {
+		t.Fatalf("reading %s = %v, want a not exist error", name, err)
+	}
+}
+
+// listNames returns the sorted names of the files in dir.
+func listNames(t *testing.T, storage Storage, dir string) []string {
+	t.Helper()
+	files, err := storage.List(dir)
+	if err != nil {
+		t.Fatalf("listing %s: %s", dir, err)
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testStorageWriteFile(t *testing.T, storage Storage) {
+	mustWrite(t, storage, "indexes/books/index.checkpoint", "first")
+	wantContents(t, storage, "indexes/books/index.checkpoint", "first")
+
+	mustWrite(t, storage, "indexes/books/index.checkpoint", "second, and longer")
+	wantContents(t, storage, "indexes/books/index.checkpoint", "second, and longer")
+
+	mustWrite(t, storage, "indexes/books/index.checkpoint", "")
+	wantContents(t, storage, "indexes/books/index.checkpoint", "")
+}
+
+func testStorageMissing(t *testing.T, storage Storage) {
+	wantMissing(t, storage, "indexes.json")
+	if err := storage.Rename("indexes.json", "indexes.json.bak"); !os.IsNotExist(err) {
+		t.Errorf("renaming a missing file = %v, want a not exist error", err)
+	}
+	if err := storage.Remove("indexes.json"); !os.IsNotExist(err) {
+		t.Errorf("removing a missing file = %v, want a not exist error", err)
+	}
+	if err := storage.RemoveAll("indexes/books"); err != nil {
+		t.Errorf("removing a missing directory = %v, want nil", err)
+	}
+	if names := listNames(t, storage, "indexes/books"); len(names) != 0 {
+		t.Errorf("missing directory lists %v", names)
+	}
+}
+
+func testStorageAtomicWrite(t *testing.T, storage Storage) {
+	// readers see either the old contents or the new, never a mix
+	old := string(make([]byte, 200<<10))
+	new := fmt.Sprintf("%0*d", 300<<10, 1)
+	mustWrite(t, storage, "indexes.json", old)
+
+	var readers sync.WaitGroup
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := storage.ReadFile("indexes.json")
+			if err == nil && string(data) != old && string(data) != new {
+				err = fmt.Errorf("read %d bytes that are neither version", len(data))
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for j := 0; j < 10; j++ {
+		mustWrite(t, storage, "indexes.json", new)
+		mustWrite(t, storage, "indexes.json", old)
+	}
+	close(done)
+	readers.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is left behind by the writes
+	if names := listNames(t, storage, ""); len(names) != 1 || names[0] != "indexes.json" {
+		t.Errorf("files after writing = %v, want [indexes.json]", names)
+	}
+}
+
+func testStorageOpenFile(t *testing.T, storage Storage) {
+	file, err := storage.OpenFile("indexes/books/0000000000000001.docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if size, err := file.Size(); err != nil || size != 0 {
+		t.Fatalf("size of a new file = %d, %v, want 0", size, err)
+	}
+
+	// writes beyond a page boundary of the bolt backend and past the end
+	data := []byte(fmt.Sprintf("%0*d", 100<<10, 7))
+	if _, err := file.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte("tail"), int64(len(data))+10); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data)) + 14
+	if got, err := file.Size(); err != nil || got != size {
+		t.Fatalf("size = %d, %v, want %d", got, err, size)
+	}
+
+	read := make([]byte, 20)
+	if _, err := file.ReadAt(read, int64(len(data))-6); err != nil {
+		t.Fatal(err)
+	}
+	if want := "000007\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00tail"; string(read) != want {
+		t.Errorf("read %q, want %q", read, want)
+	}
+	if n, err := file.ReadAt(read, size-4); err != io.EOF || n != 4 {
+		t.Errorf("reading past the end = %d, %v, want 4, EOF", n, err)
+	}
+
+	if err := file.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := file.Size(); err != nil || got != 10 {
+		t.Fatalf("size after truncating = %d, %v, want 10", got, err)
+	}
+	if err := file.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	wantContents(t, storage, "indexes/books/0000000000000001.docs", string(data[:10]))
+
+	// reopening keeps the contents
+	reopened, err := storage.OpenFile("indexes/books/0000000000000001.docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got, err := reopened.Size(); err != nil || got != 10 {
+		t.Fatalf("size after reopening = %d, %v, want 10", got, err)
+	}
+}
+
+func testStorageRename(t *testing.T, storage Storage) {
+	mustWrite(t, storage, "indexes/books/index.wal", "log")
+	mustWrite(t, storage, "indexes/books/index.checkpoint", "old")
+
+	if err := storage.Rename("indexes/books/index.wal", "indexes/books/index.checkpoint"); err != nil {
+		t.Fatal(err)
+	}
+	wantMissing(t, storage, "indexes/books/index.wal")
+	wantContents(t, storage, "indexes/books/index.checkpoint", "log")
+
+	if err := storage.Rename("indexes/books/index.checkpoint", "indexes/books/index.checkpoint.corrupt"); err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, storage, "indexes/books"); fmt.Sprint(names) != "[index.checkpoint.corrupt]" {
+		t.Errorf("files after renaming = %v", names)
+	}
+}
+
+func testStorageRemove(t *testing.T, storage Storage) {
+	mustWrite(t, storage, "indexes/books/0000000000000001.seg", "segment")
+	mustWrite(t, storage, "indexes/books/0000000000000002.seg", "segment")
+
+	if err := storage.Remove("indexes/books/0000000000000001.seg"); err != nil {
+		t.Fatal(err)
+	}
+	wantMissing(t, storage, "indexes/books/0000000000000001.seg")
+	wantContents(t, storage, "indexes/books/0000000000000002.seg", "segment")
+}
+
+func testStorageRemoveAll(t *testing.T, storage Storage) {
+	for _, name := range []string{
+		"indexes.json",
+		"indexes/books/index.checkpoint",
+		"indexes/books/0000000000000001.seg",
+		"indexes/books/nested/file",
+		"indexes/bookshelf/index.checkpoint",
+		"indexes/film/index.checkpoint",
+	} {
+		mustWrite(t, storage, name, name)
+	}
+
+	if err := storage.RemoveAll("indexes/books"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"indexes/books/index.checkpoint", "indexes/books/0000000000000001.seg", "indexes/books/nested/file"} {
+		wantMissing(t, storage, name)
+	}
+	for _, name := range []string{"indexes.json", "indexes/bookshelf/index.checkpoint", "indexes/film/index.checkpoint"} {
+		wantContents(t, storage, name, name)
+	}
+	if names := listNames(t, storage, "indexes/books"); len(names) != 0 {
+		t.Errorf("removed directory lists %v", names)
+	}
+}
+
+func testStorageList(t *testing.T, storage Storage) {
+	mustWrite(t, storage, "indexes.json", "catalog")
+	mustWrite(t, storage, "indexes/books/index.checkpoint", "checkpoint")
+	mustWrite(t, storage, "indexes/books/0000000000000001.seg", "a segment")
+	mustWrite(t, storage, "indexes/books/nested/file", "nested")
+	mustWrite(t, storage, "indexes/bookshelf/index.checkpoint", "other")
+
+	files, err := storage.List("indexes/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Name < files[b].Name })
+	want := []FileInfo{{Name: "0000000000000001.seg", Size: 9}, {Name: "index.checkpoint", Size: 10}}
+	if fmt.Sprint(files) != fmt.Sprint(want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+
+	if names := listNames(t, storage, ""); fmt.Sprint(names) != "[indexes.json]" {
+		t.Errorf("files of the root = %v, want [indexes.json]", names)
+	}
+}
@@ -0,0 +1,240 @@
+package fts
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxTaskFailures bounds the number of failure messages kept per task.
+const maxTaskFailures = 100
+
+// maxFinishedTasks bounds the number of finished tasks kept for reporting.
+const maxFinishedTasks = 100
+
+type TaskStatus string
+
+const (
+	TaskRunning   TaskStatus = "running"
+	TaskCompleted TaskStatus = "completed"
+	TaskFailed    TaskStatus = "failed"
+	TaskCancelled TaskStatus = "cancelled"
+)
+
+// TaskInfo is a point in time view of a task's progress.
+type TaskInfo struct {
+	Id          string     `json:"id"`
+	Type        string     `json:"type"`
+	Description string     `json:"description"`
+	Status      TaskStatus `json:"status"`
+	Total       int        `json:"total"`
+	Processed   int        `json:"processed"`
+	Skipped     int        `json:"skipped"`
+	Failed      int        `json:"failed"`
+	Failures    []string   `json:"failures,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	StartTime   time.Time  `json:"startTime"`
+	EndTime     *time.Time `json:"endTime,omitempty"`
+}
+
+// Task is a long running operation executing in the background.
+type Task struct {
+	mu     sync.Mutex
+	info   TaskInfo
+	cancel context.CancelFunc
+}
+
+// Info returns a copy of the task's current state.
+func (t *Task) Info() TaskInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info := t.info
+	info.Failures = append([]string(nil), t.info.Failures...)
+	return info
+}
+
+// SetTotal sets the amount of work the task expects to do.
+func (t *Task) SetTotal(total int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Total = total
+}
+
+// Progress records that another unit of work was processed.
+func (t *Task) Progress() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Processed++
+}
+
+// Skip records that a unit of work was processed but had nothing to do.
+func (t *Task) Skip() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Processed++
+	t.info.Skipped++
+}
+
+// Fail records that a unit of work was processed but failed.
+func (t *Task) Fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.info.Processed++
+	t.info.Failed++
+	if len(t.info.Failures) < maxTaskFailures {
+		t.info.Failures = append(t.info.Failures, err.Error())
+	}
+}
+
+// finish marks the task as done based on the result of its work.
+func (t *Task) finish(ctx context.Context, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.info.EndTime = &now
+	switch {
+	case ctx.Err() == context.Canceled:
+		t.info.Status = TaskCancelled
+	case err != nil:
+		t.info.Status = TaskFailed
+		t.info.Error = err.Error()
+	default:
+		t.info.Status = TaskCompleted
+	}
+}
+
+// TaskManager keeps track of background tasks.
+type TaskManager struct {
+	mu      sync.Mutex
+	tasks   map[string]*Task
+	ctx     context.Context
+	stop    context.CancelFunc
+	running sync.WaitGroup
+	closed  bool
+}
+
+// NewTaskManager creates a new task manager
+func NewTaskManager() *TaskManager {
+	ctx, stop := context.WithCancel(context.Background())
+	return &TaskManager{tasks: make(map[string]*Task), ctx: ctx, stop: stop}
+}
+
+// Start runs fn in the background as a new task.  fn should return early when
+// ctx is cancelled, which happens when the task is cancelled or the task
+// manager is closed.  A task started after Close is cancelled without running.
+func (tm *TaskManager) Start(taskType string, description string, fn func(ctx context.Context, task *Task) error) *Task {
+	ctx, cancel := context.WithCancel(tm.ctx)
+	task := &Task{
+		info: TaskInfo{
+			Id:          fmt.Sprintf("%s", uuid.New()),
+			Type:        taskType,
+			Description: description,
+			Status:      TaskRunning,
+			StartTime:   time.Now(),
+		},
+		cancel: cancel,
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.prune()
+	tm.tasks[task.info.Id] = task
+	if tm.closed {
+		cancel()
+		task.finish(ctx, nil)
+		return task
+	}
+
+	tm.running.Add(1)
+	go func() {
+		defer tm.running.Done()
+		defer cancel()
+		task.finish(ctx, fn(ctx, task))
+	}()
+
+	return task
+}
+
+// Close cancels the running tasks and waits for them to return, or for ctx
+// to be done, in which case it returns ctx's error.
+func (tm *TaskManager) Close(ctx context.Context) error {
+	tm.mu.Lock()
+	tm.closed = true
+	tm.mu.Unlock()
+	tm.stop()
+
+	done := make(chan struct{})
+	go func() {
+		tm.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get returns a task by id.
+func (tm *TaskManager) Get(taskId string) (*Task, bool) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	task, ok := tm.tasks[taskId]
+	return task, ok
+}
+
+// List returns the state of all known tasks, oldest first.
+func (tm *TaskManager) List() []TaskInfo {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	infos := make([]TaskInfo, 0, len(tm.tasks))
+	for _, task := range tm.tasks {
+		infos = append(infos, task.Info())
+	}
+	sort.Slice(infos, func(a, b int) bool {
+		return infos[a].StartTime.Before(infos[b].StartTime)
+	})
+	return infos
+}
+
+// Cancel requests cancellation of a running task.
+func (tm *TaskManager) Cancel(taskId string) bool {
+	task, ok := tm.Get(taskId)
+	if !ok {
+		return false
+	}
+
+	task.cancel()
+	return true
+}
+
+// prune forgets the oldest finished tasks.  The caller must hold the lock.
+func (tm *TaskManager) prune() {
+	finished := make([]*Task, 0)
+	for _, task := range tm.tasks {
+		if task.Info().Status != TaskRunning {
+			finished = append(finished, task)
+		}
+	}
+
+	if len(finished) < maxFinishedTasks {
+		return
+	}
+
+	sort.Slice(finished, func(a, b int) bool {
+		return finished[a].Info().StartTime.Before(finished[b].Info().StartTime)
+	})
+	for _, task := range finished[:len(finished)-maxFinishedTasks+1] {
+		delete(tm.tasks, task.info.Id)
+	}
+}
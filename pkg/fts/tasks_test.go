@@ -0,0 +1,149 @@
+package fts
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTaskManagerClose(t *testing.T) {
+	tm := NewTaskManager()
+	var stopped atomic.Bool
+	started := make(chan struct{})
+	running := tm.Start("reindex", "waits for cancellation", func(ctx context.Context, task *Task) error {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		stopped.Store(true)
+		return ctx.Err()
+	})
+	<-started
+
+	if err := tm.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !stopped.Load() {
+		t.Error("Close returned before the task did")
+	}
+	if status := running.Info().Status; status != TaskCancelled {
+		t.Errorf("running task is %s, want %s", status, TaskCancelled)
+	}
+
+	// tasks started once closed never run
+	late := tm.Start("rebuild", "started after closing", func(ctx context.Context, task *Task) error {
+		t.Error("task started after Close ran")
+		return nil
+	})
+	if status := late.Info().Status; status != TaskCancelled {
+		t.Errorf("task started after Close is %s, want %s", status, TaskCancelled)
+	}
+	if _, ok := tm.Get(late.Info().Id); !ok {
+		t.Error("task started after Close isn't listed")
+	}
+}
+
+func TestTaskManagerCloseTimesOut(t *testing.T) {
+	tm := NewTaskManager()
+	release := make(chan struct{})
+	defer close(release)
+	tm.Start("reindex", "ignores cancellation", func(ctx context.Context, task *Task) error {
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tm.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestIndexManagerCloseStopsTasks(t *testing.T) {
+	indexManager := newTestIndexManager(t)
+	index, _ := indexManager.GetIndex("books")
+
+	var wrote atomic.Bool
+	started := make(chan struct{})
+	task := indexManager.Tasks.Start("reindex", "writes after cancellation", func(ctx context.Context, task *Task) error {
+		close(started)
+		<-ctx.Done()
+		// the task finishes its work before the indexes are saved
+		_, err := index.AddDocument("2", map[string]interface{}{"title": "dune"})
+		wrote.Store(err == nil)
+		return err
+	})
+	<-started
+
+	if err := indexManager.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !wrote.Load() {
+		t.Fatalf("task failed: %+v", task.Info())
+	}
+
+	reopened, err := NewIndexManager(indexManager.Storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := reopened.GetIndex("books")
+	if _, ok := books.GetDocument("2"); !ok {
+		t.Error("document written by the task was not saved")
+	}
+}
+
+// closeRecordingStorage is a MemoryStorage that records being closed.
+type closeRecordingStorage struct {
+	*MemoryStorage
+	closed atomic.Bool
+}
+
+func (s *closeRecordingStorage) Close() error {
+	s.closed.Store(true)
+	return s.MemoryStorage.Close()
+}
+
+func TestIndexManagerCloseLeavesRunningTasks(t *testing.T) {
+	storage := &closeRecordingStorage{MemoryStorage: NewMemoryStorage()}
+	indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := MakeIndex("books", []string{"title"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan struct{})
+	done := make(chan error)
+	indexManager.Tasks.Start("reindex", "ignores cancellation", func(ctx context.Context, task *Task) error {
+		<-release
+		_, err := index.AddDocument("1", map[string]interface{}{"title": "the hobbit"})
+		done <- err
+		return err
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := indexManager.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if storage.closed.Load() {
+		t.Fatal("storage closed under a running task")
+	}
+
+	// the task's write is kept by the write-ahead log
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, _ := reopened.GetIndex("books")
+	if _, ok := books.GetDocument("1"); !ok {
+		t.Error("document written after Close gave up was lost")
+	}
+}
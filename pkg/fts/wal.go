@@ -0,0 +1,257 @@
+package fts
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+)
+
+// walHeaderSize is the size of the length and crc32 preceding each record.
+const walHeaderSize = 8
+
+type walOp string
+
+const (
+	walAdd     walOp = "add"
+	walReplace walOp = "replace"
+	walDelete  walOp = "delete"
+)
+
+// walRecord is a document mutation recorded in the write-ahead log.
+type walRecord struct {
+	Lsn      uint64                 `json:"lsn"`
+	Op       walOp                  `json:"op"`
+	Id       string                 `json:"id"`
+	Document map[string]interface{} `json:"document,omitempty"`
+}
+
+// wal is an index's write-ahead log.  Records are framed as a little endian
+// uint32 length and crc32 followed by the json encoded record.
+//
+// Appends only write to the file.  Callers then wait in sync for their record
+// to become durable, and concurrent waiters share a single fsync (group commit).
+type wal struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	storage Storage
+	name    string
+	file    File
+	size    int64
+	lsn     uint64
+	synced  uint64
+	syncing bool
+	err     error
+}
+
+// openWal opens the write-ahead log called name in storage, returning it
+// along with the records it contains.  A torn record at the end of the log,
+// left by a crash in the middle of an append, is discarded.  lsn is the
+// sequence number of the last record known to be checkpointed.
+func openWal(storage Storage, name string, lsn uint64) (*wal, []walRecord, error) {
+	file, err := storage.OpenFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, size, err := readWal(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if fileSize, err := file.Size(); err == nil && fileSize > size {
+		log.Printf("Discarding %d bytes of torn records at the end of %s", fileSize-size, name)
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	if len(records) > 0 && records[len(records)-1].Lsn > lsn {
+		lsn = records[len(records)-1].Lsn
+	}
+
+	w := &wal{storage: storage, name: name, file: file, size: size, lsn: lsn, synced: lsn}
+	w.cond = sync.NewCond(&w.mu)
+	return w, records, nil
+}
+
+// readWal reads records until the end of the file or the first damaged record,
+// returning the records and the offset just past the last good one.
+func readWal(file File) ([]walRecord, int64, error) {
+	size, err := file.Size()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+	records := make([]walRecord, 0)
+	var offset int64
+	header := make([]byte, walHeaderSize)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return nil, 0, err
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return nil, 0, err
+		}
+
+		if crc32.ChecksumIEEE(payload) != sum {
+			return records, offset, nil
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return records, offset, nil
+		}
+
+		records = append(records, record)
+		offset += int64(walHeaderSize + len(payload))
+	}
+}
+
+// append writes a record to the log, assigning its sequence number.  The
+// record isn't durable until sync returns for that sequence number.
+func (w *wal) append(record walRecord) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	record.Lsn = w.lsn + 1
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[walHeaderSize:], payload)
+
+	if _, err := w.file.WriteAt(frame, w.size); err != nil {
+		// the file may hold part of the frame so nothing can be appended after it
+		w.err = err
+		return 0, err
+	}
+
+	w.lsn = record.Lsn
+	w.size += int64(len(frame))
+	return record.Lsn, nil
+}
+
+// sync waits until the record with sequence number lsn is durable.  Whoever
+// finds no fsync in progress performs one covering every record appended so
+// far, while the others wait for it.
+func (w *wal) sync(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.synced < lsn && w.err == nil {
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+
+		w.syncing = true
+		target := w.lsn
+		file := w.file
+		w.mu.Unlock()
+		err := file.Sync()
+		w.mu.Lock()
+		w.syncing = false
+
+		if err != nil {
+			w.err = err
+		} else if target > w.synced {
+			w.synced = target
+		}
+		w.cond.Broadcast()
+	}
+
+	return w.err
+}
+
+// length returns the size of the log, which is where the next record will
+// be appended.
+func (w *wal) length() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.size
+}
+
+// discard drops the first size bytes of the log, which hold the records a
+// checkpoint covers.  The records appended after them are kept by replacing
+// the log with a copy of them, so a crash leaves either the old log or the
+// new one.  The caller must ensure no appends happen concurrently.
+func (w *wal) discard(size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// a sync in progress would be left using the file being replaced
+	for w.syncing {
+		w.cond.Wait()
+	}
+
+	if size >= w.size {
+		if err := w.file.Truncate(0); err != nil {
+			return err
+		}
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.size = 0
+		w.synced = w.lsn
+		return nil
+	}
+
+	kept := make([]byte, w.size-size)
+	if _, err := w.file.ReadAt(kept, size); err != nil {
+		return err
+	}
+	if err := w.storage.WriteFile(w.name, kept); err != nil {
+		return err
+	}
+	file, err := w.storage.OpenFile(w.name)
+	if err != nil {
+		// the log can't be appended to without its file
+		w.err = err
+		return err
+	}
+
+	w.file.Close()
+	w.file = file
+	w.size = int64(len(kept))
+	w.synced = w.lsn
+	return nil
+}
+
+// close closes the log file.
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = errors.New("write-ahead log is closed")
+	}
+	return w.file.Close()
+}
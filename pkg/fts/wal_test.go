@@ -0,0 +1,316 @@
+package fts
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testWalRecords are the records appended by the write-ahead log tests.
+var testWalRecords = []walRecord{
+	{Op: walAdd, Id: "1", Document: map[string]interface{}{"title": "the hobbit"}},
+	{Op: walReplace, Id: "1", Document: map[string]interface{}{"title": "the hobbit, or there and back again"}},
+	{Op: walAdd, Id: "2", Document: map[string]interface{}{"title": "dune", "pages": float64(412)}},
+	{Op: walDelete, Id: "1"},
+}
+
+// writeTestWal appends the test records to a new log and returns the storage
+// holding it and the offset each record starts at.
+func writeTestWal(t *testing.T) (*MemoryStorage, []int64) {
+	t.Helper()
+
+	storage := NewMemoryStorage()
+	w, records, err := openWal(storage, "index.wal", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("new log has %d records", len(records))
+	}
+
+	offsets := make([]int64, 0, len(testWalRecords))
+	for _, record := range testWalRecords {
+		offsets = append(offsets, w.size)
+		lsn, err := w.append(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.sync(lsn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+	return storage, offsets
+}
+
+// wantWalRecords checks that records are the first n test records.
+func wantWalRecords(t *testing.T, records []walRecord, n int) {
+	t.Helper()
+
+	if len(records) != n {
+		t.Fatalf("read %d records, want %d", len(records), n)
+	}
+	for j, record := range records {
+		want := testWalRecords[j]
+		want.Lsn = uint64(j + 1)
+		if !reflect.DeepEqual(record, want) {
+			t.Errorf("record %d = %+v, want %+v", j, record, want)
+		}
+	}
+}
+
+func TestWalFraming(t *testing.T) {
+	storage, offsets := writeTestWal(t)
+	data, err := storage.ReadFile("index.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every record is its length, its crc32 and then its json
+	for j, offset := range offsets {
+		length := binary.LittleEndian.Uint32(data[offset:])
+		sum := binary.LittleEndian.Uint32(data[offset+4:])
+		payload := data[offset+walHeaderSize : offset+walHeaderSize+int64(length)]
+		if crc32.ChecksumIEEE(payload) != sum {
+			t.Errorf("record %d doesn't match its crc32", j)
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			t.Fatalf("record %d: %s", j, err)
+		}
+		if record.Lsn != uint64(j+1) {
+			t.Errorf("record %d has lsn %d", j, record.Lsn)
+		}
+
+		end := int64(len(data))
+		if j+1 < len(offsets) {
+			end = offsets[j+1]
+		}
+		if next := offset + walHeaderSize + int64(length); next != end {
+			t.Errorf("record %d ends at %d, want %d", j, next, end)
+		}
+	}
+
+	w, records, err := openWal(storage, "index.wal", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	wantWalRecords(t, records, len(testWalRecords))
+	if w.lsn != uint64(len(testWalRecords)) {
+		t.Errorf("lsn = %d, want %d", w.lsn, len(testWalRecords))
+	}
+}
+
+func TestWalDiscardsDamagedTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the log, given the offset of its last record
+		damage func(data []byte, last int64) []byte
+	}{
+		{"torn header", func(data []byte, last int64) []byte {
+			return data[:last+3]
+		}},
+		{"torn payload", func(data []byte, last int64) []byte {
+			return data[:len(data)-1]
+		}},
+		{"corrupt payload", func(data []byte, last int64) []byte {
+			data[last+walHeaderSize+2] ^= 0xff
+			return data
+		}},
+		{"corrupt length", func(data []byte, last int64) []byte {
+			binary.LittleEndian.PutUint32(data[last:], 1<<20)
+			return data
+		}},
+		{"invalid json", func(data []byte, last int64) []byte {
+			payload := []byte(`{"lsn":`)
+			frame := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+			binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+			binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+			return append(data[:last], append(frame, payload...)...)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage, offsets := writeTestWal(t)
+			data, err := storage.ReadFile("index.wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := offsets[len(offsets)-1]
+			if err := storage.WriteFile("index.wal", test.damage(data, last)); err != nil {
+				t.Fatal(err)
+			}
+
+			w, records, err := openWal(storage, "index.wal", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantWalRecords(t, records, len(testWalRecords)-1)
+			if size, _ := w.file.Size(); size != last {
+				t.Errorf("log is %d bytes after opening, want it cut to %d", size, last)
+			}
+
+			// appends carry on from the last good record
+			lsn, err := w.append(walRecord{Op: walAdd, Id: "3"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.sync(lsn); err != nil {
+				t.Fatal(err)
+			}
+			w.close()
+			if lsn != uint64(len(testWalRecords)) {
+				t.Errorf("appended lsn %d, want %d", lsn, len(testWalRecords))
+			}
+
+			_, records, err = openWal(storage, "index.wal", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(testWalRecords) || records[len(records)-1].Id != "3" {
+				t.Errorf("reopened log has %+v", records)
+			}
+		})
+	}
+}
+
+func TestWalDiscardKeepsLsn(t *testing.T) {
+	storage, _ := writeTestWal(t)
+	w, _, err := openWal(storage, "index.wal", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	if err := w.discard(w.size); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := w.file.Size(); size != 0 {
+		t.Errorf("log is %d bytes after reset", size)
+	}
+	lsn, err := w.append(walRecord{Op: walDelete, Id: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn != uint64(len(testWalRecords)+1) {
+		t.Errorf("lsn after reset = %d, want %d", lsn, len(testWalRecords)+1)
+	}
+}
+
+func TestWalDiscardKeepsLaterRecords(t *testing.T) {
+	storage, offsets := writeTestWal(t)
+	w, _, err := openWal(storage, "index.wal", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	// the first two records were checkpointed
+	if err := w.discard(offsets[2]); err != nil {
+		t.Fatal(err)
+	}
+	lsn, err := w.append(walRecord{Op: walDelete, Id: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.sync(lsn); err != nil {
+		t.Fatal(err)
+	}
+
+	_, records, err := openWal(storage, "index.wal", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]uint64, 0, len(records))
+	for _, record := range records {
+		got = append(got, record.Lsn)
+	}
+	if fmt.Sprint(got) != "[3 4 5]" {
+		t.Errorf("log holds records %v after discarding, want [3 4 5]", got)
+	}
+}
+
+func TestCheckpointReplayAfterCrash(t *testing.T) {
+	storage := NewMemoryStorage()
+	indexManager, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := MakeIndex("books", []string{"title"})
+	if err := indexManager.AddIndex(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(id string, title string) {
+		t.Helper()
+		if _, err := index.AddDocument(id, map[string]interface{}{"title": title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// some documents are checkpointed and some are only in the log
+	write("1", "the hobbit")
+	write("2", "dune")
+	write("3", "the silmarillion")
+	if err := indexManager.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	write("4", "the fellowship of the ring")
+	write("2", "dune messiah")
+	if err := index.DeleteDocument("3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the crash tears the frame being appended and the index is never closed
+	file, err := storage.OpenFile("indexes/books/index.wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := file.Size()
+	if _, err := file.WriteAt([]byte{0xff, 0x00, 0x00}, size); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewIndexManager(storage, "indexes.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, ok := reopened.GetIndex("books")
+	if !ok {
+		t.Fatal("index is missing after the crash")
+	}
+
+	titles := make(map[string]interface{})
+	for _, document := range books.ListDocuments() {
+		contents, err := document.Contents()
+		if err != nil {
+			t.Fatalf("reading %s: %s", document.Id, err)
+		}
+		titles[document.Id] = contents["title"]
+	}
+	want := map[string]interface{}{"1": "the hobbit", "2": "dune messiah", "4": "the fellowship of the ring"}
+	if !reflect.DeepEqual(titles, want) {
+		t.Errorf("documents after replay = %v, want %v", titles, want)
+	}
+
+	for term, ids := range map[string][]string{
+		"hobbit":       {"1"},
+		"ring":         {"4"},
+		"dune":         {"2"},
+		"messiah":      {"2"},
+		"silmarillion": nil,
+	} {
+		got := books.Search(term, OperatorOr)
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(ids) {
+			t.Errorf("search %q = %v, want %v", term, got, ids)
+		}
+	}
+}